@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+const (
+	defaultRoleSessionName = "fluent-bit-go-s3"
+	minRoleDuration        = 15 * time.Minute
+	// Role credentials are refreshed this long before they expire.
+	roleExpiryWindow = time.Minute
+)
+
+// roleConfig describes the role assumed with STS on top of the base credentials.
+type roleConfig struct {
+	roleARN              string
+	externalID           string
+	sessionName          string
+	webIdentityTokenFile string
+	duration             time.Duration
+}
+
+// getRoleConfig returns nil when RoleARN is not specified, which uses the base credentials as they are.
+func getRoleConfig(roleARN, externalID, roleSessionName, webIdentityTokenFile, roleDuration string) (*roleConfig, error) {
+	if roleARN == "" {
+		if externalID != "" || roleSessionName != "" || webIdentityTokenFile != "" || roleDuration != "" {
+			return nil, fmt.Errorf("roleARN must be specified to assume a role")
+		}
+		return nil, nil
+	}
+
+	conf := &roleConfig{
+		roleARN:              roleARN,
+		externalID:           externalID,
+		sessionName:          roleSessionName,
+		webIdentityTokenFile: webIdentityTokenFile,
+		duration:             stscreds.DefaultDuration,
+	}
+	if conf.sessionName == "" {
+		conf.sessionName = defaultRoleSessionName
+	}
+
+	if webIdentityTokenFile != "" && externalID != "" {
+		return nil, fmt.Errorf("externalID cannot be used with webIdentityTokenFile")
+	}
+
+	if roleDuration != "" {
+		duration, err := time.ParseDuration(roleDuration)
+		if err != nil || duration < minRoleDuration {
+			return nil, fmt.Errorf("invalid roleDuration: %v (%v or longer)", roleDuration, minRoleDuration)
+		}
+		conf.duration = duration
+	}
+
+	return conf, nil
+}
+
+// newRoleCredentials returns credentials of the role which are refreshed with svc
+// before they expire. svc is signed with the base credentials, which are not needed
+// for web identity federation.
+func newRoleCredentials(svc stsiface.STSAPI, conf *roleConfig) *credentials.Credentials {
+	if conf.webIdentityTokenFile != "" {
+		p := stscreds.NewWebIdentityRoleProvider(svc, conf.roleARN, conf.sessionName, conf.webIdentityTokenFile)
+		p.ExpiryWindow = roleExpiryWindow
+		return credentials.NewCredentials(p)
+	}
+
+	return stscreds.NewCredentialsWithClient(svc, conf.roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = conf.sessionName
+		p.Duration = conf.duration
+		p.ExpiryWindow = roleExpiryWindow
+		if conf.externalID != "" {
+			p.ExternalID = &conf.externalID
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubSTS struct {
+	stsiface.STSAPI
+	expiration  time.Time
+	calls       int
+	assumed     *sts.AssumeRoleInput
+	webIdentity *sts.AssumeRoleWithWebIdentityInput
+}
+
+func (s *stubSTS) credentials() *sts.Credentials {
+	s.calls++
+	return &sts.Credentials{
+		AccessKeyId:     aws.String("ASIAEXAMPLE"),
+		SecretAccessKey: aws.String("SECRET"),
+		SessionToken:    aws.String("TOKEN"),
+		Expiration:      aws.Time(s.expiration),
+	}
+}
+
+func (s *stubSTS) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	s.assumed = input
+	return &sts.AssumeRoleOutput{Credentials: s.credentials()}, nil
+}
+
+func (s *stubSTS) AssumeRoleWithWebIdentityRequest(input *sts.AssumeRoleWithWebIdentityInput) (*request.Request, *sts.AssumeRoleWithWebIdentityOutput) {
+	s.webIdentity = input
+	output := &sts.AssumeRoleWithWebIdentityOutput{Credentials: s.credentials()}
+	// The request has no handlers, so sending it just returns output.
+	return request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{}, input, output), output
+}
+
+func TestGetRoleConfig(t *testing.T) {
+	conf, err := getRoleConfig("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, conf, "No role is assumed by default")
+
+	conf, err = getRoleConfig("arn:aws:iam::123456789012:role/example", "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "fluent-bit-go-s3", conf.sessionName)
+	assert.Equal(t, 15*time.Minute, conf.duration)
+
+	conf, err = getRoleConfig("arn:aws:iam::123456789012:role/example", "external", "session", "", "1h")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "external", conf.externalID)
+	assert.Equal(t, "session", conf.sessionName)
+	assert.Equal(t, time.Hour, conf.duration)
+}
+
+func TestGetRoleConfigInvalid(t *testing.T) {
+	_, err := getRoleConfig("", "external", "", "", "")
+	assert.Equal(t, errors.New("roleARN must be specified to assume a role"), err)
+
+	_, err = getRoleConfig("arn:aws:iam::123456789012:role/example", "external", "", "/path/to/token", "")
+	assert.Equal(t, errors.New("externalID cannot be used with webIdentityTokenFile"), err)
+
+	_, err = getRoleConfig("arn:aws:iam::123456789012:role/example", "", "", "", "10m")
+	assert.Equal(t, errors.New("invalid roleDuration: 10m (15m0s or longer)"), err)
+}
+
+func TestNewRoleCredentials(t *testing.T) {
+	conf, _ := getRoleConfig("arn:aws:iam::123456789012:role/example", "external", "", "", "1h")
+	svc := &stubSTS{expiration: time.Now().Add(time.Hour)}
+	creds := newRoleCredentials(svc, conf)
+
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "ASIAEXAMPLE", value.AccessKeyID)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/example", *svc.assumed.RoleArn)
+	assert.Equal(t, "external", *svc.assumed.ExternalId)
+	assert.Equal(t, "fluent-bit-go-s3", *svc.assumed.RoleSessionName)
+	assert.Equal(t, int64(3600), *svc.assumed.DurationSeconds)
+
+	creds.Get()
+	assert.Equal(t, 1, svc.calls, "credentials are cached until they expire")
+
+	// Credentials expiring within the expiry window are refreshed.
+	svc.expiration = time.Now().Add(30 * time.Second)
+	creds.Expire()
+	creds.Get()
+	creds.Get()
+	assert.Equal(t, 3, svc.calls)
+}
+
+func TestNewRoleCredentialsWithWebIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(tokenFile, []byte("web-identity-token"), 0600)
+
+	conf, _ := getRoleConfig("arn:aws:iam::123456789012:role/example", "", "irsa", tokenFile, "")
+	svc := &stubSTS{expiration: time.Now().Add(time.Hour)}
+	creds := newRoleCredentials(svc, conf)
+
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "ASIAEXAMPLE", value.AccessKeyID)
+	assert.Equal(t, "web-identity-token", *svc.webIdentity.WebIdentityToken)
+	assert.Equal(t, "irsa", *svc.webIdentity.RoleSessionName)
+
+	// A rotated token is read when the credentials are refreshed.
+	ioutil.WriteFile(tokenFile, []byte("rotated-token"), 0600)
+	creds.Expire()
+	creds.Get()
+	assert.Equal(t, "rotated-token", *svc.webIdentity.WebIdentityToken)
+}
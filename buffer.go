@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"time"
+)
+
+// batch is a set of formatted records which are uploaded as one S3 object.
+type batch struct {
+	partition partition
+	lines     string
+	records   int
+	createdAt time.Time
+	// eventTime is the time of the first record when UseEventTime is enabled.
+	eventTime time.Time
+	// files are the staging files holding lines when StoreDir is specified.
+	files []string
+	// objectKey is rendered on the first attempt, so that retries upload the same object.
+	objectKey string
+}
+
+// recordBuffers holds a recordBuffer for each partition which has pending records.
+type recordBuffers struct {
+	mu      sync.Mutex
+	store   *fileStore
+	buffers map[partition]*recordBuffer
+}
+
+func newRecordBuffers(store *fileStore) *recordBuffers {
+	return &recordBuffers{
+		store:   store,
+		buffers: make(map[partition]*recordBuffer),
+	}
+}
+
+// append adds lines to the buffer of p and returns its buffered size in bytes.
+func (b *recordBuffers) append(p partition, eventTime time.Time, lines string, records int) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buffer, ok := b.buffers[p]
+	if !ok {
+		buffer = &recordBuffer{partition: p, eventTime: eventTime, store: b.store}
+		b.buffers[p] = buffer
+	}
+	return buffer.append(lines, records)
+}
+
+func (b *recordBuffers) get(p partition) *recordBuffer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buffers[p]
+}
+
+func (b *recordBuffers) partitions() []partition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	partitions := make([]partition, 0, len(b.buffers))
+	for p := range b.buffers {
+		partitions = append(partitions, p)
+	}
+	return partitions
+}
+
+// size returns the number of bytes buffered for all partitions.
+func (b *recordBuffers) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var size int
+	for _, buffer := range b.buffers {
+		size += buffer.size()
+	}
+	return size
+}
+
+// release drops the buffer of p unless records were appended after it was taken.
+func (b *recordBuffers) release(p partition) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if buffer, ok := b.buffers[p]; ok && buffer.size() == 0 {
+		delete(b.buffers, p)
+	}
+}
+
+// recordBuffer accumulates formatted records until they are uploaded as one S3 object.
+type recordBuffer struct {
+	mu        sync.Mutex
+	partition partition
+	eventTime time.Time
+	data      bytes.Buffer
+	records   int
+	createdAt time.Time
+	store     *fileStore
+	file      *os.File
+	files     []string
+}
+
+// append adds lines to the buffer and returns the buffered size in bytes.
+// When a store is attached, lines are written to disk before they are buffered.
+func (b *recordBuffer) append(lines string, records int) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.store != nil {
+		if b.file == nil {
+			f, err := b.store.create(b.partition, b.eventTime)
+			if err != nil {
+				return b.data.Len(), err
+			}
+			b.file = f
+			b.files = append(b.files, f.Name())
+		}
+		if err := b.store.write(b.file, lines); err != nil {
+			return b.data.Len(), err
+		}
+	}
+
+	if b.data.Len() == 0 {
+		b.createdAt = time.Now()
+	}
+	b.data.WriteString(lines)
+	b.records += records
+	return b.data.Len(), nil
+}
+
+func (b *recordBuffer) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.data.Len()
+}
+
+// age returns how long the oldest buffered record has been waiting.
+func (b *recordBuffer) age(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.data.Len() == 0 {
+		return 0
+	}
+	return now.Sub(b.createdAt)
+}
+
+// take empties the buffer and returns its contents.
+func (b *recordBuffer) take() *batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+	taken := &batch{
+		partition: b.partition,
+		eventTime: b.eventTime,
+		lines:     b.data.String(),
+		records:   b.records,
+		createdAt: b.createdAt,
+		files:     b.files,
+	}
+	b.data.Reset()
+	b.records = 0
+	b.files = nil
+	return taken
+}
+
+// restore puts a batch which could not be uploaded back in front of the newer records.
+func (b *recordBuffer) restore(failed *batch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	newer := b.data.String()
+	b.data.Reset()
+	b.data.WriteString(failed.lines)
+	b.data.WriteString(newer)
+	b.records += failed.records
+	b.createdAt = failed.createdAt
+	b.files = append(failed.files, b.files...)
+}
+
+func (s3operator *s3operator) buffering() bool {
+	return s3operator.buffer != nil
+}
+
+// flushBuffer uploads the records buffered for each partition as separate objects.
+func (s3operator *s3operator) flushBuffer() error {
+	var lastErr error
+	for _, p := range s3operator.buffer.partitions() {
+		if err := s3operator.flushPartition(p); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// flushPartition uploads all records buffered for p as a single object.
+func (s3operator *s3operator) flushPartition(p partition) error {
+	s3operator.uploadMutex.Lock()
+	defer s3operator.uploadMutex.Unlock()
+
+	buffer := s3operator.buffer.get(p)
+	if buffer == nil {
+		return nil
+	}
+	taken := buffer.take()
+	if taken.lines == "" {
+		s3operator.buffer.release(p)
+		if s3operator.store != nil {
+			return s3operator.store.remove(taken.files)
+		}
+		return nil
+	}
+
+	if s3operator.workers != nil {
+		if !s3operator.workers.offer(taken) {
+			buffer.restore(taken)
+			return errUploadQueueFull
+		}
+		s3operator.buffer.release(p)
+		return nil
+	}
+
+	if err := s3operator.uploadBatch(taken); err != nil {
+		if s3operator.givesUp(err) {
+			// Retrying would only make the buffer grow without bound.
+			s3operator.uploadFailed(taken, err, false)
+			s3operator.buffer.release(p)
+			return nil
+		}
+		buffer.restore(taken)
+		return err
+	}
+	s3operator.buffer.release(p)
+	return nil
+}
+
+// runUploadTimer uploads a partition, or completes its stream, once its oldest record exceeds UploadTimeout.
+func (s3operator *s3operator) runUploadTimer() {
+	defer s3operator.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s3operator.done:
+			return
+		case now := <-ticker.C:
+			if s3operator.streaming() {
+				s3operator.flushStreams(now)
+				continue
+			}
+			for _, p := range s3operator.buffer.partitions() {
+				buffer := s3operator.buffer.get(p)
+				if buffer == nil || buffer.age(now) < s3operator.uploadTimeout {
+					continue
+				}
+				if err := s3operator.flushPartition(p); err != nil {
+					s3operator.logger.Warnf("error sending message for S3: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// close stops the upload timer and uploads whatever is still buffered, streamed or queued.
+func (s3operator *s3operator) close() error {
+	if s3operator.done != nil {
+		// The upload timer, the sweeper and the upload of pending batches stop.
+		close(s3operator.done)
+		s3operator.wg.Wait()
+	}
+	if s3operator.streaming() {
+		s3operator.closeStreams()
+		return nil
+	}
+
+	if s3operator.workers == nil {
+		if !s3operator.buffering() {
+			return nil
+		}
+		return s3operator.flushBuffer()
+	}
+
+	if s3operator.buffering() {
+		// The queue may be full, but the buffered records must not be left behind.
+		for _, p := range s3operator.buffer.partitions() {
+			if taken := s3operator.buffer.get(p).take(); taken.lines != "" {
+				s3operator.workers.push(taken)
+			} else if s3operator.store != nil {
+				s3operator.store.remove(taken.files)
+			}
+			s3operator.buffer.release(p)
+		}
+	}
+	s3operator.workers.close()
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordBufferTake(t *testing.T) {
+	buffer := &recordBuffer{}
+	size, err := buffer.append("line1\n", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, size)
+	size, err = buffer.append("line2\n", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 12, size)
+
+	taken := buffer.take()
+	assert.Equal(t, "line1\nline2\n", taken.lines)
+	assert.Equal(t, 2, taken.records)
+	assert.Equal(t, 0, buffer.size())
+	assert.Equal(t, time.Duration(0), buffer.age(time.Now()))
+}
+
+func TestRecordBufferRestore(t *testing.T) {
+	buffer := &recordBuffer{}
+	buffer.append("line1\n", 1)
+	failed := buffer.take()
+
+	buffer.append("line2\n", 1)
+	buffer.restore(failed)
+
+	taken := buffer.take()
+	assert.Equal(t, "line1\nline2\n", taken.lines, "failed records come before newer ones")
+	assert.Equal(t, 2, taken.records)
+	assert.Equal(t, failed.createdAt, taken.createdAt)
+}
+
+func TestRecordBuffersFlushEachPartition(t *testing.T) {
+	f, err := newObjectKeyFormatter("%{path}/%{tag}/%{index}.%{file_extension}")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	testplugin := &testFluentPlugin{}
+	plugin = testplugin
+	s3mock := &s3operator{
+		prefix:       "exampleprefix",
+		logger:       newLogger(log.InfoLevel),
+		location:     time.UTC,
+		keyFormatter: f,
+		buffer:       newRecordBuffers(nil),
+	}
+
+	s3mock.buffer.append(partition{tag: "app"}, time.Time{}, "line1\n", 1)
+	s3mock.buffer.append(partition{tag: "web"}, time.Time{}, "line2\n", 1)
+	s3mock.buffer.append(partition{tag: "app"}, time.Time{}, "line3\n", 1)
+
+	assert.Nil(t, s3mock.flushPartition(partition{tag: "app"}))
+	assert.Len(t, testplugin.events, 1)
+	assert.Equal(t, "exampleprefix/app/0.log", testplugin.events[0].objectKey)
+	assert.Equal(t, "line1\nline3\n", string(testplugin.events[0].data))
+	assert.Equal(t, []partition{{tag: "web"}}, s3mock.buffer.partitions(), "uploaded partitions are released")
+
+	assert.Nil(t, s3mock.flushBuffer())
+	assert.Len(t, testplugin.events, 2)
+	assert.Equal(t, "exampleprefix/web/0.log", testplugin.events[1].objectKey)
+	assert.Len(t, s3mock.buffer.partitions(), 0)
+}
@@ -0,0 +1,162 @@
+// Command fluent-bit-go-s3-decrypt reads back objects which fluent-bit-go-s3
+// uploaded with ClientSideEncryption.
+//
+//	fluent-bit-go-s3-decrypt [flags] s3://bucket/key
+//	fluent-bit-go-s3-decrypt [flags] -metadata head-object.json object
+//
+// The decrypted object is written as it was before encryption, that is still
+// compressed by Compress.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cosmo0920/fluent-bit-go-s3/envelope"
+)
+
+// keyUnwrapper unwraps data keys with the key of their wrap algorithm.
+type keyUnwrapper struct {
+	rsa *envelope.RSAKeyUnwrapper
+	kms func() *envelope.KMSKeyUnwrapper
+}
+
+func (u *keyUnwrapper) UnwrapKey(wrapAlg string, wrapped []byte, matDesc map[string]string, cekAlg string) ([]byte, error) {
+	switch wrapAlg {
+	case envelope.WrapRSAOAEPSHA1:
+		if u.rsa == nil {
+			return nil, fmt.Errorf("the data key is wrapped by RSA: -private-key is required")
+		}
+		return u.rsa.UnwrapKey(wrapAlg, wrapped, matDesc, cekAlg)
+	case envelope.WrapKMSContext:
+		return u.kms().UnwrapKey(wrapAlg, wrapped, matDesc, cekAlg)
+	}
+	return nil, fmt.Errorf("unsupported wrap algorithm: %q", wrapAlg)
+}
+
+func main() {
+	privateKeyFile := flag.String("private-key", "", "PEM file of the RSA private key of CSEPublicKeyFile")
+	kmsKeyID := flag.String("kms-key-id", "", "KMS key which must have wrapped the data key (optional)")
+	region := flag.String("region", "", "region of the bucket and KMS")
+	profile := flag.String("profile", "", "profile of the shared credentials")
+	endpoint := flag.String("endpoint", "", "endpoint of S3 compatible storage")
+	metadataFile := flag.String("metadata", "", "JSON of the object metadata or the output of `aws s3api head-object`, for local objects")
+	out := flag.String("o", "", "output file (default stdout)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] s3://bucket/key | -metadata file object\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), *privateKeyFile, *kmsKeyID, *region, *profile, *endpoint, *metadataFile, *out); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+}
+
+func run(object, privateKeyFile, kmsKeyID, region, profile, endpoint, metadataFile, out string) error {
+	cfg := aws.Config{}
+	if region != "" {
+		cfg.WithRegion(region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            cfg,
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return err
+	}
+
+	unwrapper := &keyUnwrapper{
+		kms: func() *envelope.KMSKeyUnwrapper {
+			return envelope.NewKMSKeyUnwrapper(envelope.NewKMS(sess), kmsKeyID)
+		},
+	}
+	if privateKeyFile != "" {
+		privateKey, err := envelope.ReadRSAPrivateKey(privateKeyFile)
+		if err != nil {
+			return err
+		}
+		unwrapper.rsa = envelope.NewRSAKeyUnwrapper(privateKey)
+	}
+
+	var ciphertext []byte
+	var metadata map[string]*string
+	if strings.HasPrefix(object, "s3://") {
+		if metadataFile != "" {
+			return fmt.Errorf("-metadata is only for local objects")
+		}
+		location := strings.SplitN(strings.TrimPrefix(object, "s3://"), "/", 2)
+		if len(location) != 2 || location[0] == "" || location[1] == "" {
+			return fmt.Errorf("invalid object: %s (s3://bucket/key)", object)
+		}
+		s3cfg := aws.NewConfig()
+		if endpoint != "" {
+			s3cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+		}
+		output, err := s3.New(sess, s3cfg).GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(location[0]),
+			Key:    aws.String(location[1]),
+		})
+		if err != nil {
+			return err
+		}
+		defer output.Body.Close()
+		if ciphertext, err = ioutil.ReadAll(output.Body); err != nil {
+			return err
+		}
+		metadata = output.Metadata
+	} else {
+		if metadataFile == "" {
+			return fmt.Errorf("-metadata is required for local objects")
+		}
+		if metadata, err = readMetadata(metadataFile); err != nil {
+			return err
+		}
+		if ciphertext, err = ioutil.ReadFile(object); err != nil {
+			return err
+		}
+	}
+
+	plaintext, err := envelope.Decrypt(unwrapper, ciphertext, metadata)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(plaintext)
+		return err
+	}
+	return ioutil.WriteFile(out, plaintext, 0600)
+}
+
+// readMetadata reads the metadata of an object, which may be in the Metadata of
+// the output of head-object.
+func readMetadata(path string) (map[string]*string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var headObject struct {
+		Metadata map[string]*string
+	}
+	if err := json.Unmarshal(data, &headObject); err == nil && headObject.Metadata != nil {
+		return headObject.Metadata, nil
+	}
+	var metadata map[string]*string
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata in %s: %v", path, err)
+	}
+	return metadata, nil
+}
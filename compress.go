@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// codec describes how objects are compressed before they are uploaded.
+type codec struct {
+	name            string
+	extension       string
+	contentType     string
+	contentEncoding string
+	// minLevel and maxLevel are both zero when the codec has no levels.
+	minLevel     int
+	maxLevel     int
+	defaultLevel int
+	compress     func(body []byte, level int) ([]byte, error)
+	// newWriter returns a writer which compresses a stream into w.
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+}
+
+var codecs = map[format]*codec{
+	plainTextFormat: {
+		name: "plainText",
+		compress: func(body []byte, level int) ([]byte, error) {
+			return body, nil
+		},
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+	},
+	gzipFormat: {
+		name:            "gzip",
+		extension:       ".gz",
+		contentEncoding: "gzip",
+		minLevel:        gzip.BestSpeed,
+		maxLevel:        gzip.BestCompression,
+		defaultLevel:    gzip.DefaultCompression,
+		compress:        makeGzipWithLevel,
+		newWriter:       newGzipWriter,
+	},
+	zstdFormat: {
+		name:         "zstd",
+		extension:    ".zst",
+		contentType:  "application/zstd",
+		minLevel:     1,
+		maxLevel:     22,
+		defaultLevel: 3,
+		compress:     makeZstd,
+		newWriter:    newZstdWriter,
+	},
+	snappyFormat: {
+		name:        "snappy",
+		extension:   ".sz",
+		contentType: "application/x-snappy-framed",
+		compress:    compressWith(newSnappyWriter),
+		newWriter:   newSnappyWriter,
+	},
+	lz4Format: {
+		name:        "lz4",
+		extension:   ".lz4",
+		contentType: "application/x-lz4",
+		minLevel:    0,
+		maxLevel:    9,
+		compress:    compressWith(newLZ4Writer),
+		newWriter:   newLZ4Writer,
+	},
+	bzip2Format: {
+		name:        "bzip2",
+		extension:   ".bz2",
+		contentType: "application/x-bzip2",
+		// Levels are the block sizes of the bzip2 command in 100 kB.
+		minLevel:     bzip2.BestSpeed,
+		maxLevel:     bzip2.BestCompression,
+		defaultLevel: bzip2.BestCompression,
+		compress:     compressWith(newBzip2Writer),
+		newWriter:    newBzip2Writer,
+	},
+}
+
+func lookupCodec(name string) (format, bool) {
+	for f, c := range codecs {
+		if c.name == name {
+			return f, true
+		}
+	}
+	return plainTextFormat, false
+}
+
+// getCompressionLevel validates level against the levels of the codec.
+func getCompressionLevel(compressFormat format, level string) (int, error) {
+	c := codecs[compressFormat]
+	if level == "" {
+		return c.defaultLevel, nil
+	}
+	if c.minLevel == 0 && c.maxLevel == 0 {
+		return 0, fmt.Errorf("compressionLevel is not supported by %s", c.name)
+	}
+	n, err := strconv.Atoi(level)
+	if err != nil || n < c.minLevel || n > c.maxLevel {
+		return 0, fmt.Errorf("invalid compressionLevel for %s: %v (%d-%d)", c.name, level, c.minLevel, c.maxLevel)
+	}
+	return n, nil
+}
+
+func makeGzip(body []byte) ([]byte, error) {
+	return makeGzipWithLevel(body, gzip.DefaultCompression)
+}
+
+// based on https://text.baldanders.info/golang/gzip-operation/
+func makeGzipWithLevel(body []byte, level int) ([]byte, error) {
+	var b bytes.Buffer
+	gw, err := newGzipWriter(&b, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func newGzipWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	gw.Name = "fluent-bit-go-s3"
+	gw.ModTime = time.Now()
+	return gw, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressWith returns the compress function of a codec which only has a writer.
+func compressWith(newWriter func(w io.Writer, level int) (io.WriteCloser, error)) func(body []byte, level int) ([]byte, error) {
+	return func(body []byte, level int) ([]byte, error) {
+		var b bytes.Buffer
+		w, err := newWriter(&b, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+}
+
+// newZstdEncoder maps the levels of the zstd command onto the speeds of the
+// encoder, which are fastest (1-2), default (3-5) and better (6-22). Empty
+// bodies are written as a frame too, so that every object can be decoded.
+func newZstdEncoder(w io.Writer, level int) (*zstd.Encoder, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithZeroFrames(true))
+}
+
+func makeZstd(body []byte, level int) ([]byte, error) {
+	enc, err := newZstdEncoder(nil, level)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(body, nil), nil
+}
+
+// zstdBlockSize is the size of data which a zstdWriter holds. It is the
+// maximum block size of zstd, so that flushes do not shrink blocks.
+const zstdBlockSize = 128 * 1024
+
+// zstdWriter flushes the encoder whenever it passes data, since the encoder
+// writes blocks from its own goroutines while multipart streams read the
+// written parts after Write.
+type zstdWriter struct {
+	enc *zstd.Encoder
+	buf []byte
+}
+
+func (w *zstdWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < zstdBlockSize {
+		return len(p), nil
+	}
+	if _, err := w.enc.Write(w.buf); err != nil {
+		return 0, err
+	}
+	w.buf = w.buf[:0]
+	return len(p), w.enc.Flush()
+}
+
+// Close writes the remaining data and the end of the frame. It does not close w.
+func (w *zstdWriter) Close() error {
+	if _, err := w.enc.Write(w.buf); err != nil {
+		return err
+	}
+	w.buf = nil
+	return w.enc.Close()
+}
+
+func newZstdWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	enc, err := newZstdEncoder(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdWriter{enc: enc}, nil
+}
+
+// newSnappyWriter writes the snappy framing format. Close does not close w.
+// See https://github.com/google/snappy/blob/master/framing_format.txt
+func newSnappyWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+// lz4Depth returns the search depth of the high compression encoder for the
+// levels 1-9, or zero for the fast encoder of level 0.
+func lz4Depth(level int) int {
+	if level <= 0 {
+		return 0
+	}
+	return 1 << uint(8+level)
+}
+
+// newLZ4Writer writes the LZ4 frame format. Close does not close w.
+// See https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md
+func newLZ4Writer(w io.Writer, level int) (io.WriteCloser, error) {
+	lw := lz4.NewWriter(w)
+	lw.Header.CompressionLevel = lz4Depth(level)
+	return lw, nil
+}
+
+// encodeLZ4Block encodes src in the LZ4 block format, which is used for the
+// LZ4_RAW codec of parquet.
+func encodeLZ4Block(src []byte, level int) ([]byte, error) {
+	// With a buffer of CompressBlockBound, incompressible data is stored as literals.
+	dst := make([]byte, lz4.CompressBlockBound(len(src)))
+	var n int
+	var err error
+	if depth := lz4Depth(level); depth > 0 {
+		n, err = lz4.CompressBlockHC(src, dst, depth)
+	} else {
+		n, err = lz4.CompressBlock(src, dst, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+func newBzip2Writer(w io.Writer, level int) (io.WriteCloser, error) {
+	return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/stretchr/testify/assert"
+)
+
+func testInputs() map[string][]byte {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	r.Read(random)
+	var logs bytes.Buffer
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&logs, "{\"log\":\"line %d\",\"level\":\"info\"}\n", i)
+	}
+	return map[string][]byte{
+		"empty":  {},
+		"short":  []byte("abc"),
+		"logs":   logs.Bytes(),
+		"random": random,
+		"repeat": []byte(strings.Repeat("a", 200000)),
+	}
+}
+
+// decompress decodes the output of a codec with the decoders of its format.
+func decompress(t *testing.T, compressFormat format, compressed []byte) []byte {
+	t.Helper()
+	var r io.Reader
+	switch compressFormat {
+	case plainTextFormat:
+		return compressed
+	case gzipFormat:
+		gr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		r = gr
+	case snappyFormat:
+		r = snappy.NewReader(bytes.NewReader(compressed))
+	case lz4Format:
+		r = lz4.NewReader(bytes.NewReader(compressed))
+	case bzip2Format:
+		r = bzip2.NewReader(bytes.NewReader(compressed))
+	case zstdFormat:
+		zr, err := zstd.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		t.Fatalf("unexpected format %d", compressFormat)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to decompress %s: %v", codecs[compressFormat].name, err)
+	}
+	return decompressed
+}
+
+// levels returns the lowest, default and highest levels of c.
+func levels(c *codec) []int {
+	if c.minLevel == 0 && c.maxLevel == 0 {
+		return []int{c.defaultLevel}
+	}
+	return []int{c.minLevel, c.defaultLevel, c.maxLevel}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for f, c := range codecs {
+		for _, level := range levels(c) {
+			for name, input := range testInputs() {
+				compressed, err := c.compress(input, level)
+				if err != nil {
+					t.Fatalf("failed test %#v", err)
+				}
+				assert.True(t, bytes.Equal(input, decompress(t, f, compressed)), "%s level %d round trips %s", c.name, level, name)
+			}
+		}
+	}
+}
+
+func TestCompressionLevels(t *testing.T) {
+	logs := testInputs()["logs"]
+	for _, f := range []format{gzipFormat, lz4Format, zstdFormat} {
+		c := codecs[f]
+		fastest, _ := c.compress(logs, c.minLevel)
+		best, _ := c.compress(logs, c.maxLevel)
+		assert.True(t, len(best) < len(fastest), "%s compresses better at level %d (%d bytes) than %d (%d bytes)", c.name, c.maxLevel, len(best), c.minLevel, len(fastest))
+	}
+}
+
+func TestCodecWriters(t *testing.T) {
+	for f, c := range codecs {
+		for _, level := range levels(c) {
+			for name, input := range testInputs() {
+				var b bytes.Buffer
+				w, err := c.newWriter(&b, level)
+				if err != nil {
+					t.Fatalf("failed test %#v", err)
+				}
+				// Multipart streams read the written data after every Write.
+				written := 0
+				for data := input; len(data) > 0; {
+					n := 7919
+					if n > len(data) {
+						n = len(data)
+					}
+					if _, err := w.Write(data[:n]); err != nil {
+						t.Fatalf("failed test %#v", err)
+					}
+					data = data[n:]
+					assert.True(t, b.Len() >= written, "%s does not rewrite written data", c.name)
+					written = b.Len()
+				}
+				assert.Nil(t, w.Close())
+				assert.True(t, bytes.Equal(input, decompress(t, f, b.Bytes())), "%s level %d streams %s", c.name, level, name)
+			}
+		}
+	}
+}
+
+func TestEncodeLZ4Block(t *testing.T) {
+	for _, level := range []int{0, 9} {
+		for name, input := range testInputs() {
+			encoded, err := encodeLZ4Block(input, level)
+			if err != nil {
+				t.Fatalf("failed test %#v", err)
+			}
+			if len(input) == 0 {
+				// The decoder rejects the block of only an empty literal.
+				assert.Equal(t, []byte{0}, encoded)
+				continue
+			}
+			decoded := make([]byte, len(input))
+			n, err := lz4.UncompressBlock(encoded, decoded)
+			assert.Nil(t, err, name)
+			assert.True(t, bytes.Equal(input, decoded[:n]), "%s level %d round trips", name, level)
+		}
+	}
+}
+
+func TestGetCompressionLevel(t *testing.T) {
+	level, err := getCompressionLevel(gzipFormat, "")
+	assert.Nil(t, err)
+	assert.Equal(t, -1, level, "gzip default compression")
+
+	level, err = getCompressionLevel(gzipFormat, "9")
+	assert.Nil(t, err)
+	assert.Equal(t, 9, level)
+
+	_, err = getCompressionLevel(gzipFormat, "10")
+	assert.Equal(t, errors.New("invalid compressionLevel for gzip: 10 (1-9)"), err)
+
+	level, err = getCompressionLevel(zstdFormat, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, level, "zstd default level")
+
+	level, err = getCompressionLevel(zstdFormat, "19")
+	assert.Nil(t, err)
+	assert.Equal(t, 19, level)
+
+	level, err = getCompressionLevel(lz4Format, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, level, "lz4 fast compression")
+
+	_, err = getCompressionLevel(lz4Format, "12")
+	assert.Equal(t, errors.New("invalid compressionLevel for lz4: 12 (0-9)"), err)
+
+	_, err = getCompressionLevel(snappyFormat, "1")
+	assert.Equal(t, errors.New("compressionLevel is not supported by snappy"), err)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+type credentialSource string
+
+const (
+	envCredentialSource         credentialSource = "env"
+	sharedCredentialSource      credentialSource = "shared"
+	ec2CredentialSource         credentialSource = "ec2"
+	ecsCredentialSource         credentialSource = "ecs"
+	webIdentityCredentialSource credentialSource = "web_identity"
+	staticCredentialSource      credentialSource = "static"
+)
+
+var credentialSources = []credentialSource{
+	envCredentialSource,
+	sharedCredentialSource,
+	ec2CredentialSource,
+	ecsCredentialSource,
+	webIdentityCredentialSource,
+	staticCredentialSource,
+}
+
+const remoteCredentialsExpiryWindow = 5 * time.Minute
+
+// parseCredentialChain parses comma separated credential sources such as "env,shared,ec2".
+func parseCredentialChain(chain string) ([]credentialSource, error) {
+	var sources []credentialSource
+	for _, name := range strings.Split(chain, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		source := credentialSource(name)
+		valid := false
+		for _, s := range credentialSources {
+			if s == source {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid credentialChain: unknown source %s", name)
+		}
+		for _, s := range sources {
+			if s == source {
+				return nil, fmt.Errorf("invalid credentialChain: duplicated source %s", name)
+			}
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// newCredentialChain returns credentials which are retrieved from the first source
+// in chain which can provide them. Remote sources use the region of the plugin. As
+// with RoleARN, web identity federation calls the STS endpoint of the region, not
+// the Endpoint of S3.
+func newCredentialChain(chain []credentialSource, accessKeyID, secretKey, credential, profile, region string) (*credentials.Credentials, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{Region: aws.String(region)},
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create session for credentialChain: %v", err)
+	}
+
+	providers := make([]credentials.Provider, 0, len(chain))
+	for _, source := range chain {
+		providers = append(providers, newCredentialProvider(source, accessKeyID, secretKey, credential, profile, sess))
+	}
+	return credentials.NewCredentials(&credentials.ChainProvider{
+		Providers:     providers,
+		VerboseErrors: true,
+	}), nil
+}
+
+func newCredentialProvider(source credentialSource, accessKeyID, secretKey, credential, profile string, sess *session.Session) credentials.Provider {
+	switch source {
+	case envCredentialSource:
+		return &credentials.EnvProvider{}
+	case sharedCredentialSource:
+		return &credentials.SharedCredentialsProvider{Filename: credential, Profile: profile}
+	case ec2CredentialSource:
+		return &ec2rolecreds.EC2RoleProvider{
+			Client:       ec2metadata.New(sess),
+			ExpiryWindow: remoteCredentialsExpiryWindow,
+		}
+	case ecsCredentialSource:
+		if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") == "" && os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") == "" {
+			return unavailableCredentialProvider(source, "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is not set")
+		}
+		d := defaults.Get()
+		return defaults.RemoteCredProvider(*d.Config, d.Handlers)
+	case webIdentityCredentialSource:
+		roleARN := os.Getenv("AWS_ROLE_ARN")
+		tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		if roleARN == "" || tokenFile == "" {
+			return unavailableCredentialProvider(source, "AWS_ROLE_ARN or AWS_WEB_IDENTITY_TOKEN_FILE is not set")
+		}
+		p := stscreds.NewWebIdentityRoleProvider(sts.New(sess), roleARN, os.Getenv("AWS_ROLE_SESSION_NAME"), tokenFile)
+		p.ExpiryWindow = roleExpiryWindow
+		return p
+	}
+	if accessKeyID == "" || secretKey == "" {
+		return unavailableCredentialProvider(source, "AccessKeyID and SecretAccessKey are not specified")
+	}
+	return &credentials.StaticProvider{Value: credentials.Value{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretKey,
+	}}
+}
+
+func unavailableCredentialProvider(source credentialSource, reason string) credentials.Provider {
+	return credentials.ErrorProvider{
+		Err:          awserr.New("CredentialsNotAvailable", reason, nil),
+		ProviderName: string(source),
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCredentialChain(t *testing.T) {
+	chain, err := parseCredentialChain("env, shared,ec2,ecs,web_identity,static")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, credentialSources, chain)
+
+	chain, err = parseCredentialChain("")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, chain)
+
+	_, err = parseCredentialChain("env,instance")
+	assert.Equal(t, errors.New("invalid credentialChain: unknown source instance"), err)
+
+	_, err = parseCredentialChain("env,shared,env")
+	assert.Equal(t, errors.New("invalid credentialChain: duplicated source env"), err)
+}
+
+func TestCredentialChainFallback(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	defer os.RemoveAll(dir)
+	credential := filepath.Join(dir, "credentials")
+	ioutil.WriteFile(credential, []byte("[default]\naws_access_key_id = DEFAULTKEY\naws_secret_access_key = DEFAULTSECRET\n[dev]\naws_access_key_id = DEVKEY\naws_secret_access_key = DEVSECRET\n"), 0600)
+
+	chain := []credentialSource{envCredentialSource, sharedCredentialSource, staticCredentialSource}
+	creds, err := newCredentialChain(chain, "STATICKEY", "STATICSECRET", credential, "dev", "us-east-1")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "DEVKEY", value.AccessKeyID)
+	assert.Equal(t, credentials.SharedCredsProviderName, value.ProviderName)
+
+	creds, _ = newCredentialChain(chain, "STATICKEY", "STATICSECRET", filepath.Join(dir, "nonexistent"), "dev", "us-east-1")
+	value, err = creds.Get()
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "STATICKEY", value.AccessKeyID)
+	assert.Equal(t, credentials.StaticProviderName, value.ProviderName)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "ENVKEY")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "ENVSECRET")
+	creds, _ = newCredentialChain(chain, "STATICKEY", "STATICSECRET", credential, "dev", "us-east-1")
+	value, err = creds.Get()
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "ENVKEY", value.AccessKeyID)
+	assert.Equal(t, credentials.EnvProviderName, value.ProviderName)
+}
+
+func TestCredentialChainUnavailable(t *testing.T) {
+	for _, name := range []string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	creds, err := newCredentialChain([]credentialSource{ecsCredentialSource, webIdentityCredentialSource, staticCredentialSource}, "", "", "", "", "us-east-1")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	_, err = creds.Get()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is not set")
+	assert.Contains(t, err.Error(), "AWS_ROLE_ARN or AWS_WEB_IDENTITY_TOKEN_FILE is not set")
+	assert.Contains(t, err.Error(), "AccessKeyID and SecretAccessKey are not specified")
+}
+
+func TestCredentialChainRemoteSources(t *testing.T) {
+	for _, name := range []string{"AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_SESSION_NAME"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(tokenFile, []byte("web-identity-token"), 0600)
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/fluent-bit")
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	os.Setenv("AWS_ROLE_SESSION_NAME", "fluent-bit-go-s3")
+
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>` +
+			`<AccessKeyId>ROLEKEY</AccessKeyId><SecretAccessKey>ROLESECRET</SecretAccessKey><SessionToken>TOKEN</SessionToken>` +
+			`<Expiration>2100-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer server.Close()
+
+	// STS is resolved in the region of the plugin, as RoleARN does, and served by the fake.
+	var stsRegion string
+	resolver := endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if service == sts.EndpointsID {
+			stsRegion = region
+			return endpoints.ResolvedEndpoint{URL: server.URL, SigningRegion: region}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	})
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("ap-northeast-1"), EndpointResolver: resolver})
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	p := newCredentialProvider(ec2CredentialSource, "", "", "", "", sess)
+	assert.Equal(t, "ap-northeast-1", aws.StringValue(p.(*ec2rolecreds.EC2RoleProvider).Client.Config.Region))
+	assert.NotEqual(t, server.URL, p.(*ec2rolecreds.EC2RoleProvider).Client.Endpoint, "instance metadata is not served by STS")
+
+	value, err := newCredentialProvider(webIdentityCredentialSource, "", "", "", "", sess).Retrieve()
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "ROLEKEY", value.AccessKeyID)
+	assert.Equal(t, "ap-northeast-1", stsRegion)
+	assert.Equal(t, "AssumeRoleWithWebIdentity", form.Get("Action"))
+	assert.Equal(t, "web-identity-token", form.Get("WebIdentityToken"))
+}
+
+func TestCredentialChainInvalidSharedConfig(t *testing.T) {
+	for _, name := range []string{"AWS_CONFIG_FILE", "AWS_SDK_LOAD_CONFIG", "AWS_PROFILE"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config")
+	ioutil.WriteFile(config, []byte("[default]\nrole_arn = arn:aws:iam::123456789012:role/fluent-bit\ncredential_source = Unknown\n"), 0600)
+	os.Setenv("AWS_CONFIG_FILE", config)
+
+	_, err = newCredentialChain([]credentialSource{ec2CredentialSource}, "", "", "", "", "us-east-1")
+	assert.Error(t, err)
+}
+
+func TestGetCredentialsWithProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	defer os.RemoveAll(dir)
+	credential := filepath.Join(dir, "credentials")
+	ioutil.WriteFile(credential, []byte("[default]\naws_access_key_id = DEFAULTKEY\naws_secret_access_key = DEFAULTSECRET\n[dev]\naws_access_key_id = DEVKEY\naws_secret_access_key = DEVSECRET\n"), 0600)
+
+	c := &s3PluginConfig{}
+	creds, err := c.GetCredentials("", "", credential, "", nil, "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	value, _ := creds.Get()
+	assert.Equal(t, "DEFAULTKEY", value.AccessKeyID)
+
+	creds, err = c.GetCredentials("", "", credential, "dev", nil, "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	value, _ = creds.Get()
+	assert.Equal(t, "DEVKEY", value.AccessKeyID)
+
+	_, err = c.GetCredentials("", "", credential, "prod", nil, "")
+	assert.Error(t, err)
+}
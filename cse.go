@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/cosmo0920/fluent-bit-go-s3/envelope"
+)
+
+const (
+	cseRSA = "rsa"
+	cseKMS = "kms"
+)
+
+// cseConfig describes the client-side encryption of uploaded objects in the
+// envelope format of the S3 encryption client.
+type cseConfig struct {
+	algorithm string
+	kmsKeyID  string
+	wrapper   envelope.KeyWrapper
+}
+
+// getCSEConfig returns nil unless ClientSideEncryption is specified. The wrapper
+// of KMS is created by setup since it needs the session.
+func getCSEConfig(clientSideEncryption, publicKeyFile, kmsKeyID string) (*cseConfig, error) {
+	switch clientSideEncryption {
+	case "":
+		if publicKeyFile != "" {
+			return nil, fmt.Errorf("csePublicKeyFile is only available with clientSideEncryption %s", cseRSA)
+		}
+		if kmsKeyID != "" {
+			return nil, fmt.Errorf("cseKMSKeyId is only available with clientSideEncryption %s", cseKMS)
+		}
+		return nil, nil
+	case cseRSA:
+		if kmsKeyID != "" {
+			return nil, fmt.Errorf("cseKMSKeyId is only available with clientSideEncryption %s", cseKMS)
+		}
+		if publicKeyFile == "" {
+			return nil, fmt.Errorf("clientSideEncryption %s requires csePublicKeyFile", cseRSA)
+		}
+		publicKey, err := envelope.ReadRSAPublicKey(publicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid csePublicKeyFile: %v", err)
+		}
+		return &cseConfig{algorithm: cseRSA, wrapper: envelope.NewRSAKeyWrapper(publicKey)}, nil
+	case cseKMS:
+		if publicKeyFile != "" {
+			return nil, fmt.Errorf("csePublicKeyFile is only available with clientSideEncryption %s", cseRSA)
+		}
+		if kmsKeyID == "" {
+			return nil, fmt.Errorf("clientSideEncryption %s requires cseKMSKeyId", cseKMS)
+		}
+		return &cseConfig{algorithm: cseKMS, kmsKeyID: kmsKeyID}, nil
+	}
+	return nil, fmt.Errorf("invalid clientSideEncryption: %v (%s or %s)", clientSideEncryption, cseRSA, cseKMS)
+}
+
+// setup creates the KMS client. KMS is called at its own endpoint of the region
+// even if Endpoint points to an S3 compatible storage.
+func (c *cseConfig) setup(p client.ConfigProvider) {
+	if c == nil || c.algorithm != cseKMS {
+		return
+	}
+	svc := envelope.NewKMS(p, aws.NewConfig().WithEndpoint(""))
+	c.wrapper = envelope.NewKMSKeyWrapper(svc, c.kmsKeyID)
+}
+
+// encrypt replaces the body of an upload with its ciphertext and adds the
+// envelope to the metadata. It returns the body which is uploaded.
+func (c *cseConfig) encrypt(input *s3manager.UploadInput, body []byte) ([]byte, error) {
+	if c == nil {
+		return body, nil
+	}
+	ciphertext, envelopeMetadata, err := envelope.Encrypt(c.wrapper, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// The metadata of objectConfig is shared by all uploads.
+	metadata := make(map[string]*string, len(input.Metadata)+len(envelopeMetadata))
+	for k, v := range input.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range envelopeMetadata {
+		metadata[k] = v
+	}
+	input.Metadata = metadata
+	input.Body = bytes.NewReader(ciphertext)
+	// Clients must not decompress the ciphertext, which is compressed before encryption.
+	input.ContentEncoding = nil
+	return ciphertext, nil
+}
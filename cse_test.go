@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/cosmo0920/fluent-bit-go-s3/envelope"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a client of S3 which keeps objects in memory instead of sending
+// requests. It supports PutObject and HeadObject. The SDK does not compute
+// Content-MD5 by itself, so that the checksums of the plugin are tested.
+type fakeS3 struct {
+	*s3.S3
+	requests []*http.Request
+	inputs   []*s3.PutObjectInput
+	objects  map[string][]byte
+	// corrupt flips a bit of stored objects, as a broken proxy might.
+	corrupt bool
+	// bucketKMS encrypts objects with SSE-KMS by the default encryption of the
+	// bucket, whose ETags are not the MD5 of the objects.
+	bucketKMS bool
+}
+
+func newFakeS3() *fakeS3 {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:                        aws.String("us-east-1"),
+		Credentials:                   credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		S3DisableContentMD5Validation: aws.Bool(true),
+	}))
+	f := &fakeS3{S3: s3.New(sess), objects: make(map[string][]byte)}
+	f.Handlers.Send.Clear()
+	f.Handlers.Send.PushBack(f.send)
+	return f
+}
+
+func (f *fakeS3) send(r *request.Request) {
+	header := http.Header{}
+	switch input := r.Params.(type) {
+	case *s3.PutObjectInput:
+		body, _ := ioutil.ReadAll(input.Body)
+		if f.corrupt && len(body) > 0 {
+			body[0] ^= 1
+		}
+		f.requests = append(f.requests, r.HTTPRequest)
+		f.inputs = append(f.inputs, input)
+		f.objects[*input.Key] = body
+		f.setETag(header, body)
+	case *s3.HeadObjectInput:
+		body, ok := f.objects[*input.Key]
+		if !ok {
+			r.HTTPResponse = &http.Response{StatusCode: http.StatusNotFound, Header: header, Body: ioutil.NopCloser(bytes.NewReader(nil))}
+			return
+		}
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+		f.setETag(header, body)
+	}
+	r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Header: header, Body: ioutil.NopCloser(bytes.NewReader(nil))}
+}
+
+func (f *fakeS3) setETag(header http.Header, body []byte) {
+	if f.bucketKMS {
+		header.Set("X-Amz-Server-Side-Encryption", s3.ServerSideEncryptionAwsKms)
+		header.Set("ETag", `"`+md5Hex([]byte("kms:"+string(body)))+`"`)
+		return
+	}
+	header.Set("ETag", `"`+md5Hex(body)+`"`)
+}
+
+func writeTestPublicKey(t *testing.T) (*rsa.PrivateKey, string, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(dir, "public.pem")
+	ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	return key, path, func() { os.RemoveAll(dir) }
+}
+
+func TestGetCSEConfig(t *testing.T) {
+	conf, err := getCSEConfig("", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, conf, "objects are not encrypted by default")
+
+	_, path, cleanup := writeTestPublicKey(t)
+	defer cleanup()
+	conf, err = getCSEConfig("rsa", path, "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, envelope.WrapRSAOAEPSHA1, conf.wrapper.WrapAlgorithm())
+
+	conf, err = getCSEConfig("kms", "", "alias/logs")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &cseConfig{algorithm: "kms", kmsKeyID: "alias/logs"}, conf)
+
+	_, err = getCSEConfig("aes", "", "")
+	assert.Equal(t, errors.New("invalid clientSideEncryption: aes (rsa or kms)"), err)
+	_, err = getCSEConfig("rsa", "", "")
+	assert.Equal(t, errors.New("clientSideEncryption rsa requires csePublicKeyFile"), err)
+	_, err = getCSEConfig("kms", "", "")
+	assert.Equal(t, errors.New("clientSideEncryption kms requires cseKMSKeyId"), err)
+	_, err = getCSEConfig("rsa", path, "alias/logs")
+	assert.Equal(t, errors.New("cseKMSKeyId is only available with clientSideEncryption kms"), err)
+	_, err = getCSEConfig("", path, "")
+	assert.Equal(t, errors.New("csePublicKeyFile is only available with clientSideEncryption rsa"), err)
+	_, err = getCSEConfig("rsa", filepath.Join(filepath.Dir(path), "missing.pem"), "")
+	assert.Contains(t, err.Error(), "invalid csePublicKeyFile")
+}
+
+func TestPutWithClientSideEncryption(t *testing.T) {
+	key, path, cleanup := writeTestPublicKey(t)
+	defer cleanup()
+	conf, err := getCSEConfig("rsa", path, "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	objectConf, err := getObjectConfig("", "", "", "", "team=logs")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+
+	svc := newFakeS3()
+	s3operator := &s3operator{
+		bucket:         "examplebucket",
+		uploader:       s3manager.NewUploaderWithClient(svc),
+		compressFormat: gzipFormat,
+		logger:         newLogger(log.InfoLevel),
+		location:       time.UTC,
+		object:         objectConf,
+		cse:            conf,
+		metrics:        newOperatorMetrics(0, "examplebucket"),
+	}
+	line := "{\"log\":\"secret\"}\n"
+	if err := (&fluentPlugin{}).Put(s3operator, "exampleprefix/object.gz", time.Now(), line); err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+
+	assert.Len(t, svc.inputs, 1)
+	input := svc.inputs[0]
+	assert.Nil(t, input.ContentEncoding, "the ciphertext is not gzip")
+	assert.Equal(t, "logs", *input.Metadata["team"])
+	assert.Len(t, objectConf.metadata, 1, "the shared metadata is not modified")
+	assert.Equal(t, envelope.WrapRSAOAEPSHA1, *input.Metadata[envelope.MetaWrapAlg])
+
+	compressed, err := envelope.Decrypt(envelope.NewRSAKeyUnwrapper(key), svc.objects["exampleprefix/object.gz"], input.Metadata)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	decompressed, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, line, string(decompressed))
+}
+
+func TestNewS3OutputWithClientSideEncryption(t *testing.T) {
+	_, path, cleanup := writeTestPublicKey(t)
+	defer cleanup()
+	s3Creds = &testS3Credential{}
+	base := testFluentPlugin{
+		credential:           "examplecredentials",
+		bucket:               "examplebucket",
+		s3prefix:             "exampleprefix",
+		region:               "exampleregion",
+		autoCreateBucket:     "false",
+		logLevel:             "info",
+		clientSideEncryption: "rsa",
+		csePublicKeyFile:     path,
+	}
+
+	streaming := base
+	streaming.totalFileSize = "1M"
+	streaming.streaming = "true"
+	plugin = &streaming
+	_, err := newS3Output(nil, 0)
+	assert.Equal(t, errors.New("clientSideEncryption cannot be used with streaming"), err)
+
+	deadLetter := base
+	deadLetter.deadLetter = "s3://deadletters/prefix"
+	plugin = &deadLetter
+	_, err = newS3Output(nil, 0)
+	assert.Equal(t, errors.New("clientSideEncryption cannot be used with deadLetter on S3"), err)
+}
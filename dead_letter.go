@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const deadLetterExt = ".json"
+
+type deadLetterConfig struct {
+	// dir is the local directory of dead letters. bucket and prefix are used instead when it is empty.
+	dir     string
+	bucket  string
+	prefix  string
+	redrive bool
+}
+
+// deadLetter is a batch which could not be uploaded, with the reason of the failure.
+type deadLetter struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Error    string    `json:"error"`
+	Code     string    `json:"code,omitempty"`
+	Records  int       `json:"records"`
+	FailedAt time.Time `json:"failed_at"`
+	Lines    string    `json:"lines"`
+}
+
+// deadLetterStore keeps dead letters by name in a local directory or an S3 bucket.
+type deadLetterStore interface {
+	put(name string, data []byte) error
+	list() ([]string, error)
+	get(name string) ([]byte, error)
+	delete(name string) error
+	String() string
+}
+
+// getDeadLetterConfig parses DeadLetter, which is either a local directory or s3://bucket/prefix.
+func getDeadLetterConfig(deadLetter, redrive string) (*deadLetterConfig, error) {
+	if deadLetter == "" {
+		if redrive != "" {
+			return nil, fmt.Errorf("deadLetterRedrive requires deadLetter")
+		}
+		return nil, nil
+	}
+
+	conf := &deadLetterConfig{}
+	if strings.HasPrefix(deadLetter, "s3://") {
+		location := strings.SplitN(strings.TrimPrefix(deadLetter, "s3://"), "/", 2)
+		if location[0] == "" {
+			return nil, fmt.Errorf("invalid deadLetter: bucket is missing in %s", deadLetter)
+		}
+		conf.bucket = location[0]
+		if len(location) == 2 {
+			conf.prefix = strings.Trim(location[1], "/")
+		}
+	} else {
+		conf.dir = deadLetter
+	}
+
+	if redrive != "" {
+		r, err := strconv.ParseBool(redrive)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deadLetterRedrive: %v", redrive)
+		}
+		conf.redrive = r
+	}
+
+	return conf, nil
+}
+
+func newDeadLetterStore(conf *deadLetterConfig, svc s3iface.S3API) (deadLetterStore, error) {
+	if conf.dir == "" {
+		return &s3DeadLetterStore{svc: svc, bucket: conf.bucket, prefix: conf.prefix}, nil
+	}
+	if err := os.MkdirAll(conf.dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create deadLetter: %v", err)
+	}
+	return &localDeadLetterStore{dir: conf.dir}, nil
+}
+
+type localDeadLetterStore struct {
+	dir string
+}
+
+func (s *localDeadLetterStore) put(name string, data []byte) error {
+	// Written files are renamed into place, so that a re-drive never reads a partial one.
+	f, err := ioutil.TempFile(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, name))
+}
+
+func (s *localDeadLetterStore) list() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+deadLetterExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (s *localDeadLetterStore) get(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (s *localDeadLetterStore) delete(name string) error {
+	return os.Remove(name)
+}
+
+func (s *localDeadLetterStore) String() string {
+	return s.dir
+}
+
+type s3DeadLetterStore struct {
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+}
+
+func (s *s3DeadLetterStore) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *s3DeadLetterStore) put(name string, data []byte) error {
+	_, err := s.svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key(name)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func (s *s3DeadLetterStore) list() ([]string, error) {
+	var keys []string
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key("")),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if strings.HasSuffix(aws.StringValue(object.Key), deadLetterExt) {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+		}
+		return true
+	})
+	return keys, err
+}
+
+func (s *s3DeadLetterStore) get(name string) ([]byte, error) {
+	out, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+func (s *s3DeadLetterStore) delete(name string) error {
+	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	return err
+}
+
+func (s *s3DeadLetterStore) String() string {
+	return "s3://" + s.bucket + "/" + s.key("")
+}
+
+// sendToDeadLetter writes b, which failed with err, into the dead letter store.
+func (s3operator *s3operator) sendToDeadLetter(b *batch, err error) error {
+	letter := &deadLetter{
+		Bucket:   s3operator.bucket,
+		Key:      b.objectKey,
+		Error:    err.Error(),
+		Records:  b.records,
+		FailedAt: time.Now().UTC(),
+		Lines:    b.lines,
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		letter.Code = aerr.Code()
+	}
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s%s", letter.FailedAt.UnixNano(), newUUID(), deadLetterExt)
+	return s3operator.deadLetters.put(name, data)
+}
+
+// deadLetterBatch writes b into DeadLetter, and reports whether it is written.
+func (s3operator *s3operator) deadLetterBatch(b *batch, err error) bool {
+	if s3operator.deadLetters == nil {
+		return false
+	}
+	if dlErr := s3operator.sendToDeadLetter(b, err); dlErr != nil {
+		s3operator.logger.Errorf("error writing dead letter into %s: %v", s3operator.deadLetters, dlErr)
+		return false
+	}
+	s3operator.logger.Errorf("error sending message for S3, %d records are written into %s: %v", b.records, s3operator.deadLetters, err)
+	s3operator.unstage([]*batch{b})
+	return true
+}
+
+// redriveDeadLetters uploads dead letters again to their original keys, oldest first.
+// Dead letters of other buckets are left as they are.
+func (s3operator *s3operator) redriveDeadLetters() error {
+	names, err := s3operator.deadLetters.list()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		data, err := s3operator.deadLetters.get(name)
+		if err != nil {
+			return err
+		}
+		letter := &deadLetter{}
+		if err := json.Unmarshal(data, letter); err != nil {
+			s3operator.logger.Warnf("[s3operator] skipped broken dead letter %s: %v", name, err)
+			continue
+		}
+		if letter.Bucket != s3operator.bucket {
+			s3operator.logger.Warnf("[s3operator] skipped dead letter %s of bucket %s", name, letter.Bucket)
+			continue
+		}
+		if err := s3operator.put(letter.Key, letter.FailedAt, letter.Lines); err != nil {
+			return err
+		}
+		if err := s3operator.deadLetters.delete(name); err != nil {
+			return err
+		}
+		s3operator.logger.Infof("[s3operator] re-drove dead letter %s to %s", name, letter.Key)
+	}
+	return nil
+}
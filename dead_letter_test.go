@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/fluent/fluent-bit-go/output"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryS3 keeps objects of a bucket in memory.
+type memoryS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (m *memoryS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, _ := ioutil.ReadAll(input.Body)
+	m.objects[*input.Bucket+"/"+*input.Key] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *memoryS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	page := &s3.ListObjectsV2Output{}
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, *input.Bucket+"/"+*input.Prefix) {
+			keys = append(keys, strings.TrimPrefix(key, *input.Bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key)})
+	}
+	fn(page, true)
+	return nil
+}
+
+func (m *memoryS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data, ok := m.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (m *memoryS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(m.objects, *input.Bucket+"/"+*input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestGetDeadLetterConfig(t *testing.T) {
+	conf, err := getDeadLetterConfig("", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, conf)
+
+	conf, err = getDeadLetterConfig("/var/lib/fluent-bit/s3-dead-letter", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &deadLetterConfig{dir: "/var/lib/fluent-bit/s3-dead-letter"}, conf)
+
+	conf, err = getDeadLetterConfig("s3://backup-bucket/dead-letter/", "true")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &deadLetterConfig{bucket: "backup-bucket", prefix: "dead-letter", redrive: true}, conf)
+
+	conf, err = getDeadLetterConfig("s3://backup-bucket", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &deadLetterConfig{bucket: "backup-bucket"}, conf)
+
+	_, err = getDeadLetterConfig("s3:///dead-letter", "")
+	assert.Equal(t, errors.New("invalid deadLetter: bucket is missing in s3:///dead-letter"), err)
+	_, err = getDeadLetterConfig("/tmp/dead-letter", "sometimes")
+	assert.Equal(t, errors.New("invalid deadLetterRedrive: sometimes"), err)
+	_, err = getDeadLetterConfig("", "true")
+	assert.Equal(t, errors.New("deadLetterRedrive requires deadLetter"), err)
+}
+
+func TestPluginFlusherWritesDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDeadLetterStore(&deadLetterConfig{dir: dir}, nil)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+
+	testplugin := &failingPlugin{
+		testFluentPlugin: &testFluentPlugin{},
+		errs: []error{
+			awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"),
+		},
+	}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"mykey": "myvalue"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3mock := &s3operator{
+		bucket:      "examplebucket",
+		prefix:      "exampleprefix",
+		logger:      newLogger(log.InfoLevel),
+		location:    time.UTC,
+		formatter:   &jsonFormatter{},
+		deadLetters: store,
+	}
+	s3operators = []*s3operator{s3mock}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res, "the chunk is kept as a dead letter")
+	assert.Len(t, testplugin.events, 0)
+
+	names, err := store.list()
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Len(t, names, 1)
+	data, _ := store.get(names[0])
+	letter := &deadLetter{}
+	if err := json.Unmarshal(data, letter); err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "examplebucket", letter.Bucket)
+	assert.True(t, strings.HasPrefix(letter.Key, "exampleprefix/"), letter.Key)
+	assert.Equal(t, "AccessDenied", letter.Code)
+	assert.Equal(t, 1, letter.Records)
+	assert.Equal(t, "{\"mykey\":\"myvalue\"}\n", letter.Lines)
+
+	// Once the permission is fixed, dead letters are uploaded to their original keys.
+	assert.Nil(t, s3mock.redriveDeadLetters())
+	assert.Len(t, testplugin.events, 1)
+	assert.Equal(t, letter.Key, testplugin.events[0].objectKey)
+	assert.Equal(t, letter.Lines, string(testplugin.events[0].data))
+	names, _ = store.list()
+	assert.Len(t, names, 0)
+}
+
+func TestPluginFlusherWritesDeadLetterAfterRetries(t *testing.T) {
+	svc := &memoryS3{objects: make(map[string][]byte)}
+	store, _ := newDeadLetterStore(&deadLetterConfig{bucket: "backup-bucket", prefix: "dead-letter"}, svc)
+
+	testplugin := &failingPlugin{
+		testFluentPlugin: &testFluentPlugin{},
+		errs: []error{
+			awserr.New("SlowDown", "Please reduce your request rate.", nil),
+			awserr.New("SlowDown", "Please reduce your request rate.", nil),
+		},
+	}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"mykey": "myvalue"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3mock := &s3operator{
+		bucket:      "examplebucket",
+		prefix:      "exampleprefix",
+		logger:      newLogger(log.InfoLevel),
+		location:    time.UTC,
+		formatter:   &jsonFormatter{},
+		retry:       &retryConfig{maxRetries: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond},
+		deadLetters: store,
+	}
+	s3operators = []*s3operator{s3mock}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Equal(t, 2, testplugin.attempts)
+	assert.Equal(t, "s3://backup-bucket/dead-letter/", store.String())
+
+	names, err := store.list()
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Len(t, names, 1)
+	assert.True(t, strings.HasPrefix(names[0], "dead-letter/"), names[0])
+
+	assert.Nil(t, s3mock.redriveDeadLetters())
+	assert.Len(t, testplugin.events, 1)
+	assert.Len(t, svc.objects, 0)
+}
+
+func TestRedriveSkipsDeadLettersOfOtherBuckets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := newDeadLetterStore(&deadLetterConfig{dir: dir}, nil)
+	data, _ := json.Marshal(&deadLetter{Bucket: "otherbucket", Key: "other/key.log", Lines: "line\n"})
+	store.put("0-other"+deadLetterExt, data)
+
+	testplugin := &testFluentPlugin{}
+	plugin = testplugin
+	s3mock := &s3operator{
+		bucket:      "examplebucket",
+		logger:      newLogger(log.InfoLevel),
+		deadLetters: store,
+	}
+	assert.Nil(t, s3mock.redriveDeadLetters())
+	assert.Len(t, testplugin.events, 0)
+	names, _ := store.list()
+	assert.Len(t, names, 1)
+}
@@ -0,0 +1,169 @@
+// Package envelope encrypts objects in the envelope format of the Amazon S3
+// encryption client (V2): the body is encrypted with a random AES-256 data key in
+// GCM mode, and the data key is wrapped by a key provider and stored with the IV
+// in the object metadata.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Metadata keys of the envelope. S3 returns them in the canonical form of HTTP headers.
+const (
+	MetaKeyV2                    = "X-Amz-Key-V2"
+	MetaKeyV1                    = "X-Amz-Key"
+	MetaIV                       = "X-Amz-Iv"
+	MetaMatDesc                  = "X-Amz-Matdesc"
+	MetaWrapAlg                  = "X-Amz-Wrap-Alg"
+	MetaCEKAlg                   = "X-Amz-Cek-Alg"
+	MetaTagLen                   = "X-Amz-Tag-Len"
+	MetaUnencryptedContentLength = "X-Amz-Unencrypted-Content-Length"
+)
+
+const (
+	// AESGCMNoPadding is the content encryption algorithm of the envelope.
+	AESGCMNoPadding = "AES/GCM/NoPadding"
+
+	dataKeySize = 32
+	ivSize      = 12
+	tagSize     = 16
+)
+
+// DataKey is a data key generated by a KeyWrapper.
+type DataKey struct {
+	Plaintext []byte
+	Wrapped   []byte
+	// MatDesc is the material description which is needed to unwrap the key.
+	MatDesc map[string]string
+}
+
+// KeyWrapper generates data keys and wraps them with a key encryption key.
+type KeyWrapper interface {
+	// WrapAlgorithm returns the value of x-amz-wrap-alg.
+	WrapAlgorithm() string
+	GenerateDataKey(cekAlg string) (*DataKey, error)
+}
+
+// KeyUnwrapper returns the plaintext of wrapped data keys.
+type KeyUnwrapper interface {
+	UnwrapKey(wrapAlg string, wrapped []byte, matDesc map[string]string, cekAlg string) ([]byte, error)
+}
+
+// Encrypt encrypts plaintext with a new data key of w and returns the ciphertext
+// with the metadata of the envelope.
+func Encrypt(w KeyWrapper, plaintext []byte) ([]byte, map[string]*string, error) {
+	key, err := w.GenerateDataKey(AESGCMNoPadding)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(key.Plaintext) != dataKeySize {
+		return nil, nil, fmt.Errorf("data key must be %d bytes, got %d", dataKeySize, len(key.Plaintext))
+	}
+
+	iv := make([]byte, ivSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(key.Plaintext, ivSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The tag is appended to the ciphertext as the S3 encryption client expects.
+	ciphertext := aead.Seal(nil, iv, plaintext, nil)
+
+	matDesc := key.MatDesc
+	if matDesc == nil {
+		matDesc = map[string]string{}
+	}
+	md, err := json.Marshal(matDesc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := map[string]*string{
+		MetaKeyV2:                    aws.String(base64.StdEncoding.EncodeToString(key.Wrapped)),
+		MetaIV:                       aws.String(base64.StdEncoding.EncodeToString(iv)),
+		MetaMatDesc:                  aws.String(string(md)),
+		MetaWrapAlg:                  aws.String(w.WrapAlgorithm()),
+		MetaCEKAlg:                   aws.String(AESGCMNoPadding),
+		MetaTagLen:                   aws.String(strconv.Itoa(tagSize * 8)),
+		MetaUnencryptedContentLength: aws.String(strconv.Itoa(len(plaintext))),
+	}
+	return ciphertext, metadata, nil
+}
+
+// Decrypt returns the plaintext of an object encrypted in the envelope format.
+// The keys of metadata are matched case-insensitively.
+func Decrypt(u KeyUnwrapper, ciphertext []byte, metadata map[string]*string) ([]byte, error) {
+	meta := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if v != nil {
+			meta[http.CanonicalHeaderKey(k)] = *v
+		}
+	}
+
+	if _, ok := meta[MetaKeyV2]; !ok {
+		if _, ok := meta[MetaKeyV1]; ok {
+			return nil, fmt.Errorf("envelopes of the V1 format are not supported")
+		}
+		return nil, fmt.Errorf("object is not encrypted: %s is missing", MetaKeyV2)
+	}
+	cekAlg := meta[MetaCEKAlg]
+	if cekAlg != AESGCMNoPadding {
+		return nil, fmt.Errorf("unsupported %s: %q", MetaCEKAlg, cekAlg)
+	}
+	if tagLen, ok := meta[MetaTagLen]; ok && tagLen != strconv.Itoa(tagSize*8) {
+		return nil, fmt.Errorf("unsupported %s: %q", MetaTagLen, tagLen)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(meta[MetaKeyV2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", MetaKeyV2, err)
+	}
+	iv, err := base64.StdEncoding.DecodeString(meta[MetaIV])
+	if err != nil || len(iv) == 0 {
+		return nil, fmt.Errorf("invalid %s: %q", MetaIV, meta[MetaIV])
+	}
+	matDesc := map[string]string{}
+	if md := meta[MetaMatDesc]; md != "" {
+		if err := json.Unmarshal([]byte(md), &matDesc); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", MetaMatDesc, err)
+		}
+	}
+
+	key, err := u.UnwrapKey(meta[MetaWrapAlg], wrapped, matDesc, cekAlg)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, iv, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt object: %v", err)
+	}
+
+	if length, ok := meta[MetaUnencryptedContentLength]; ok && length != strconv.Itoa(len(plaintext)) {
+		return nil, fmt.Errorf("decrypted object is %d bytes, but %s is %s", len(plaintext), MetaUnencryptedContentLength, length)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte, nonceSize int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, nonceSize)
+}
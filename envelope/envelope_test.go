@@ -0,0 +1,153 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRSAKey *rsa.PrivateKey
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	if testRSAKey == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		testRSAKey = key
+	}
+	return testRSAKey
+}
+
+func TestEncryptAndDecryptWithRSA(t *testing.T) {
+	key := rsaKey(t)
+	plaintext := []byte("{\"log\":\"hello\"}\n")
+
+	ciphertext, metadata, err := Encrypt(NewRSAKeyWrapper(&key.PublicKey), plaintext)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Len(t, ciphertext, len(plaintext)+tagSize)
+	assert.Equal(t, "RSA-OAEP-SHA1", *metadata["X-Amz-Wrap-Alg"])
+	assert.Equal(t, "AES/GCM/NoPadding", *metadata["X-Amz-Cek-Alg"])
+	assert.Equal(t, "128", *metadata["X-Amz-Tag-Len"])
+	assert.Equal(t, "16", *metadata["X-Amz-Unencrypted-Content-Length"])
+	assert.Equal(t, "{}", *metadata["X-Amz-Matdesc"])
+	iv, _ := base64.StdEncoding.DecodeString(*metadata["X-Amz-Iv"])
+	assert.Len(t, iv, ivSize)
+
+	// S3 returns the metadata keys in various cases depending on the client.
+	lower := make(map[string]*string)
+	for k, v := range metadata {
+		lower[strings.ToLower(k)] = v
+	}
+	decrypted, err := Decrypt(NewRSAKeyUnwrapper(key), ciphertext, lower)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, plaintext, decrypted)
+
+	other, _, _ := Encrypt(NewRSAKeyWrapper(&key.PublicKey), plaintext)
+	assert.NotEqual(t, ciphertext, other, "every object has its own data key and IV")
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	key := rsaKey(t)
+	ciphertext, metadata, err := Encrypt(NewRSAKeyWrapper(&key.PublicKey), []byte("secret"))
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	unwrapper := NewRSAKeyUnwrapper(key)
+
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[0] ^= 1
+	_, err = Decrypt(unwrapper, tampered, metadata)
+	assert.Equal(t, errors.New("cannot decrypt object: cipher: message authentication failed"), err)
+
+	_, err = Decrypt(unwrapper, ciphertext, map[string]*string{})
+	assert.Equal(t, errors.New("object is not encrypted: X-Amz-Key-V2 is missing"), err)
+	_, err = Decrypt(unwrapper, ciphertext, map[string]*string{"x-amz-key": aws.String("")})
+	assert.Equal(t, errors.New("envelopes of the V1 format are not supported"), err)
+
+	modified := copyMetadata(metadata)
+	modified["X-Amz-Cek-Alg"] = aws.String("AES/CBC/PKCS5Padding")
+	_, err = Decrypt(unwrapper, ciphertext, modified)
+	assert.Equal(t, errors.New(`unsupported X-Amz-Cek-Alg: "AES/CBC/PKCS5Padding"`), err)
+
+	modified = copyMetadata(metadata)
+	modified["X-Amz-Wrap-Alg"] = aws.String("kms+context")
+	_, err = Decrypt(unwrapper, ciphertext, modified)
+	assert.Equal(t, errors.New("cannot unwrap a data key of kms+context with an RSA private key"), err)
+
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	_, err = Decrypt(NewRSAKeyUnwrapper(other), ciphertext, metadata)
+	assert.Contains(t, err.Error(), "cannot unwrap data key")
+}
+
+func copyMetadata(metadata map[string]*string) map[string]*string {
+	m := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		m[k] = v
+	}
+	return m
+}
+
+func TestReadRSAKeys(t *testing.T) {
+	key := rsaKey(t)
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+		return path
+	}
+	pkix, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	for _, path := range []string{
+		write("pkix.pem", "PUBLIC KEY", pkix),
+		write("pkcs1-public.pem", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&key.PublicKey)),
+	} {
+		publicKey, err := ReadRSAPublicKey(path)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		assert.Equal(t, &key.PublicKey, publicKey)
+	}
+	for _, path := range []string{
+		write("pkcs8.pem", "PRIVATE KEY", pkcs8),
+		write("pkcs1.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+	} {
+		privateKey, err := ReadRSAPrivateKey(path)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		assert.True(t, bytes.Equal(key.N.Bytes(), privateKey.N.Bytes()))
+	}
+
+	plain := filepath.Join(dir, "plain.txt")
+	ioutil.WriteFile(plain, []byte("not a key"), 0600)
+	_, err = ReadRSAPublicKey(plain)
+	assert.Equal(t, errors.New(plain+" is not PEM encoded"), err)
+	_, err = ReadRSAPublicKey(filepath.Join(dir, "pkcs8.pem"))
+	assert.Contains(t, err.Error(), "does not contain an RSA public key")
+}
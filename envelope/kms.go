@@ -0,0 +1,203 @@
+package envelope
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+const (
+	// WrapKMSContext is the wrap algorithm of KMS keys.
+	WrapKMSContext = "kms+context"
+	// cekAlgContextKey binds the content encryption algorithm to the data key
+	// through the encryption context, which is stored as the material description.
+	cekAlgContextKey = "aws:x-amz-cek-alg"
+)
+
+// KMS is a minimal client of AWS KMS, which the vendored aws-sdk-go does not
+// contain. Only GenerateDataKey and Decrypt are implemented.
+type KMS struct {
+	*client.Client
+}
+
+// NewKMS creates a client of KMS in the same way as the clients of aws-sdk-go.
+func NewKMS(p client.ConfigProvider, cfgs ...*aws.Config) *KMS {
+	c := p.ClientConfig("kms", cfgs...)
+	svc := &KMS{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   "kms",
+				ServiceID:     "KMS",
+				SigningName:   c.SigningName,
+				SigningRegion: c.SigningRegion,
+				PartitionID:   c.PartitionID,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2014-11-01",
+				JSONVersion:   "1.1",
+				TargetPrefix:  "TrentService",
+			},
+			c.Handlers,
+		),
+	}
+	svc.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	svc.Handlers.Build.PushBack(buildKMSRequest)
+	svc.Handlers.Unmarshal.PushBack(unmarshalKMSResponse)
+	svc.Handlers.UnmarshalMeta.PushBack(unmarshalKMSMeta)
+	svc.Handlers.UnmarshalError.PushBack(unmarshalKMSError)
+	return svc
+}
+
+type kmsGenerateDataKeyInput struct {
+	KeyId             string
+	KeySpec           string
+	EncryptionContext map[string]string
+}
+
+type kmsGenerateDataKeyOutput struct {
+	CiphertextBlob []byte
+	Plaintext      []byte
+	KeyId          string
+}
+
+type kmsDecryptInput struct {
+	CiphertextBlob    []byte
+	EncryptionContext map[string]string
+	KeyId             string `json:",omitempty"`
+}
+
+type kmsDecryptOutput struct {
+	Plaintext []byte
+	KeyId     string
+}
+
+func (c *KMS) generateDataKey(input *kmsGenerateDataKeyInput) (*kmsGenerateDataKeyOutput, error) {
+	output := &kmsGenerateDataKeyOutput{}
+	req := c.NewRequest(&request.Operation{Name: "GenerateDataKey", HTTPMethod: "POST", HTTPPath: "/"}, input, output)
+	return output, req.Send()
+}
+
+func (c *KMS) decrypt(input *kmsDecryptInput) (*kmsDecryptOutput, error) {
+	output := &kmsDecryptOutput{}
+	req := c.NewRequest(&request.Operation{Name: "Decrypt", HTTPMethod: "POST", HTTPPath: "/"}, input, output)
+	return output, req.Send()
+}
+
+// buildKMSRequest encodes the parameters in the JSON protocol of KMS. []byte
+// fields are base64 encoded by encoding/json as KMS expects.
+func buildKMSRequest(r *request.Request) {
+	body, err := json.Marshal(r.Params)
+	if err != nil {
+		r.Error = awserr.New(request.ErrCodeSerialization, "failed to encode KMS request", err)
+		return
+	}
+	r.SetBufferBody(body)
+	r.HTTPRequest.Header.Set("X-Amz-Target", r.ClientInfo.TargetPrefix+"."+r.Operation.Name)
+	r.HTTPRequest.Header.Set("Content-Type", "application/x-amz-json-"+r.ClientInfo.JSONVersion)
+}
+
+func unmarshalKMSResponse(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	if err := json.NewDecoder(r.HTTPResponse.Body).Decode(r.Data); err != nil {
+		r.Error = awserr.New(request.ErrCodeSerialization, "failed to decode KMS response", err)
+	}
+}
+
+func unmarshalKMSMeta(r *request.Request) {
+	r.RequestID = r.HTTPResponse.Header.Get("X-Amzn-Requestid")
+}
+
+func unmarshalKMSError(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	body, err := ioutil.ReadAll(r.HTTPResponse.Body)
+	if err != nil {
+		r.Error = awserr.New(request.ErrCodeSerialization, "failed to read KMS error response", err)
+		return
+	}
+	var e struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(body, &e)
+	code := e.Type
+	// The type may be qualified like com.amazonaws.kms#NotFoundException.
+	if i := strings.LastIndex(code, "#"); i >= 0 {
+		code = code[i+1:]
+	}
+	if code == "" {
+		code = "UnknownError"
+		e.Message = string(body)
+	}
+	r.Error = awserr.NewRequestFailure(awserr.New(code, e.Message, nil), r.HTTPResponse.StatusCode, r.RequestID)
+}
+
+// KMSKeyWrapper generates data keys under a KMS key.
+type KMSKeyWrapper struct {
+	svc   *KMS
+	keyID string
+}
+
+// NewKMSKeyWrapper returns a KeyWrapper of the KMS key, which can be a key ID, an
+// ARN or an alias.
+func NewKMSKeyWrapper(svc *KMS, keyID string) *KMSKeyWrapper {
+	return &KMSKeyWrapper{svc: svc, keyID: keyID}
+}
+
+// WrapAlgorithm implements KeyWrapper.
+func (w *KMSKeyWrapper) WrapAlgorithm() string {
+	return WrapKMSContext
+}
+
+// GenerateDataKey implements KeyWrapper.
+func (w *KMSKeyWrapper) GenerateDataKey(cekAlg string) (*DataKey, error) {
+	matDesc := map[string]string{cekAlgContextKey: cekAlg}
+	output, err := w.svc.generateDataKey(&kmsGenerateDataKeyInput{
+		KeyId:             w.keyID,
+		KeySpec:           "AES_256",
+		EncryptionContext: matDesc,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate data key: %v", err)
+	}
+	return &DataKey{Plaintext: output.Plaintext, Wrapped: output.CiphertextBlob, MatDesc: matDesc}, nil
+}
+
+// KMSKeyUnwrapper decrypts data keys with KMS.
+type KMSKeyUnwrapper struct {
+	svc *KMS
+	// keyID restricts decryption to a KMS key if it is not empty.
+	keyID string
+}
+
+// NewKMSKeyUnwrapper returns a KeyUnwrapper of KMS. KMS finds the key from the
+// wrapped data key unless keyID is specified.
+func NewKMSKeyUnwrapper(svc *KMS, keyID string) *KMSKeyUnwrapper {
+	return &KMSKeyUnwrapper{svc: svc, keyID: keyID}
+}
+
+// UnwrapKey implements KeyUnwrapper.
+func (u *KMSKeyUnwrapper) UnwrapKey(wrapAlg string, wrapped []byte, matDesc map[string]string, cekAlg string) ([]byte, error) {
+	if wrapAlg != WrapKMSContext {
+		return nil, fmt.Errorf("cannot unwrap a data key of %s with KMS", wrapAlg)
+	}
+	if alg := matDesc[cekAlgContextKey]; alg != cekAlg {
+		return nil, fmt.Errorf("data key is wrapped for %q, not %q", alg, cekAlg)
+	}
+	output, err := u.svc.decrypt(&kmsDecryptInput{
+		CiphertextBlob:    wrapped,
+		EncryptionContext: matDesc,
+		KeyId:             u.keyID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key: %v", err)
+	}
+	return output.Plaintext, nil
+}
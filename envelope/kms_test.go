@@ -0,0 +1,106 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestKMS returns a client of a fake KMS which wraps data keys by prefixing
+// them with the encryption context.
+func newTestKMS(t *testing.T) (*KMS, *[]string, func()) {
+	var targets []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.Header.Get("X-Amz-Target")
+		targets = append(targets, target)
+		assert.Equal(t, "application/x-amz-json-1.1", r.Header.Get("Content-Type"))
+		assert.Contains(t, r.Header.Get("Authorization"), "/kms/aws4_request")
+
+		var input map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&input)
+		context, _ := json.Marshal(input["EncryptionContext"])
+		w.Header().Set("X-Amzn-Requestid", "request-id")
+		switch target {
+		case "TrentService.GenerateDataKey":
+			key := bytes.Repeat([]byte{7}, dataKeySize)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"KeyId":          input["KeyId"],
+				"Plaintext":      key,
+				"CiphertextBlob": append(append([]byte(nil), context...), key...),
+			})
+		case "TrentService.Decrypt":
+			var blob []byte
+			json.Unmarshal([]byte(`"`+input["CiphertextBlob"].(string)+`"`), &blob)
+			if !bytes.HasPrefix(blob, context) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"InvalidCiphertextException","message":"context does not match"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"Plaintext": blob[len(context):]})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.kms#UnknownOperationException"}`))
+		}
+	}))
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	return NewKMS(sess), &targets, server.Close
+}
+
+func TestEncryptAndDecryptWithKMS(t *testing.T) {
+	svc, targets, cleanup := newTestKMS(t)
+	defer cleanup()
+
+	plaintext := []byte("line 1\nline 2\n")
+	ciphertext, metadata, err := Encrypt(NewKMSKeyWrapper(svc, "alias/logs"), plaintext)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "kms+context", *metadata["X-Amz-Wrap-Alg"])
+	assert.Equal(t, `{"aws:x-amz-cek-alg":"AES/GCM/NoPadding"}`, *metadata["X-Amz-Matdesc"])
+
+	decrypted, err := Decrypt(NewKMSKeyUnwrapper(svc, ""), ciphertext, metadata)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, plaintext, decrypted)
+	assert.Equal(t, []string{"TrentService.GenerateDataKey", "TrentService.Decrypt"}, *targets)
+
+	// The material description is the encryption context, so it cannot be modified.
+	modified := copyMetadata(metadata)
+	modified["X-Amz-Matdesc"] = aws.String(`{"aws:x-amz-cek-alg":"AES/GCM/NoPadding","tenant":"other"}`)
+	_, err = Decrypt(NewKMSKeyUnwrapper(svc, ""), ciphertext, modified)
+	assert.Contains(t, err.Error(), "cannot unwrap data key: InvalidCiphertextException: context does not match")
+
+	modified["X-Amz-Matdesc"] = aws.String(`{}`)
+	_, err = Decrypt(NewKMSKeyUnwrapper(svc, ""), ciphertext, modified)
+	assert.Contains(t, err.Error(), `data key is wrapped for "", not "AES/GCM/NoPadding"`)
+}
+
+func TestKMSError(t *testing.T) {
+	svc, _, cleanup := newTestKMS(t)
+	defer cleanup()
+
+	req := svc.NewRequest(&request.Operation{Name: "ListKeys", HTTPMethod: "POST", HTTPPath: "/"}, &struct{}{}, &struct{}{})
+	err := req.Send()
+	if assert.Error(t, err) {
+		aerr := err.(awserr.RequestFailure)
+		assert.Equal(t, "UnknownOperationException", aerr.Code())
+		assert.Equal(t, http.StatusBadRequest, aerr.StatusCode())
+		assert.Equal(t, "request-id", aerr.RequestID())
+	}
+}
@@ -0,0 +1,132 @@
+package envelope
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// WrapRSAOAEPSHA1 is the wrap algorithm of RSA key pairs.
+const WrapRSAOAEPSHA1 = "RSA-OAEP-SHA1"
+
+// RSAKeyWrapper wraps data keys with an RSA public key, so that the node which
+// encrypts objects cannot decrypt them.
+type RSAKeyWrapper struct {
+	publicKey *rsa.PublicKey
+}
+
+// NewRSAKeyWrapper returns a KeyWrapper of the public key.
+func NewRSAKeyWrapper(publicKey *rsa.PublicKey) *RSAKeyWrapper {
+	return &RSAKeyWrapper{publicKey: publicKey}
+}
+
+// WrapAlgorithm implements KeyWrapper.
+func (w *RSAKeyWrapper) WrapAlgorithm() string {
+	return WrapRSAOAEPSHA1
+}
+
+// GenerateDataKey implements KeyWrapper. Like the S3 encryption client, the
+// content encryption algorithm is encrypted together with the key, so that it
+// cannot be replaced in the metadata.
+func (w *RSAKeyWrapper) GenerateDataKey(cekAlg string) (*DataKey, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 0, 1+len(key)+len(cekAlg))
+	secret = append(secret, byte(len(key)))
+	secret = append(secret, key...)
+	secret = append(secret, cekAlg...)
+
+	wrapped, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, w.publicKey, secret, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot wrap data key: %v", err)
+	}
+	return &DataKey{Plaintext: key, Wrapped: wrapped}, nil
+}
+
+// RSAKeyUnwrapper unwraps data keys with an RSA private key.
+type RSAKeyUnwrapper struct {
+	privateKey *rsa.PrivateKey
+}
+
+// NewRSAKeyUnwrapper returns a KeyUnwrapper of the private key.
+func NewRSAKeyUnwrapper(privateKey *rsa.PrivateKey) *RSAKeyUnwrapper {
+	return &RSAKeyUnwrapper{privateKey: privateKey}
+}
+
+// UnwrapKey implements KeyUnwrapper.
+func (u *RSAKeyUnwrapper) UnwrapKey(wrapAlg string, wrapped []byte, matDesc map[string]string, cekAlg string) ([]byte, error) {
+	if wrapAlg != WrapRSAOAEPSHA1 {
+		return nil, fmt.Errorf("cannot unwrap a data key of %s with an RSA private key", wrapAlg)
+	}
+	secret, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, u.privateKey, wrapped, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key: %v", err)
+	}
+	if len(secret) == 0 || int(secret[0]) > len(secret)-1 {
+		return nil, fmt.Errorf("cannot unwrap data key: invalid length")
+	}
+	n := int(secret[0])
+	if alg := string(secret[1+n:]); alg != cekAlg {
+		return nil, fmt.Errorf("data key is wrapped for %q, not %q", alg, cekAlg)
+	}
+	return secret[1 : 1+n], nil
+}
+
+// ReadRSAPublicKey reads a PEM encoded public key in PKIX or PKCS #1.
+func ReadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s does not contain an RSA public key: %v", path, err)
+	}
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an RSA public key: %T", path, key)
+	}
+	return publicKey, nil
+}
+
+// ReadRSAPrivateKey reads a PEM encoded private key in PKCS #1 or PKCS #8.
+func ReadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s does not contain an RSA private key: %v", path, err)
+	}
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an RSA private key: %T", path, key)
+	}
+	return privateKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", path)
+	}
+	return block, nil
+}
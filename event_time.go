@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+)
+
+// eventTime converts the timestamp returned by GetRecord. Records without
+// a valid timestamp are treated as if they happened now.
+func eventTime(ts interface{}) time.Time {
+	switch t := ts.(type) {
+	case output.FLBTime:
+		return t.Time
+	case uint64:
+		return time.Unix(int64(t), 0)
+	}
+	return time.Now()
+}
+
+// objectTime returns the time used to render the key of b. It is the upload time
+// unless UseEventTime is enabled.
+func (s3operator *s3operator) objectTime(b *batch) time.Time {
+	if b.eventTime.IsZero() {
+		return time.Now()
+	}
+	return b.eventTime
+}
+
+// timeSlice returns the time part of object keys for t. Records of the same
+// slice are uploaded into the same object when UseEventTime is enabled.
+func (s3operator *s3operator) timeSlice(t time.Time) string {
+	if s3operator.keyFormatter != nil {
+		return s3operator.keyFormatter.timeSlice(s3operator, t)
+	}
+	if s3operator.location != nil {
+		t = t.In(s3operator.location)
+	}
+	return t.Format(s3operator.timeFormat)
+}
+
+// injectTime adds t to record under TimeKey.
+func (s3operator *s3operator) injectTime(record map[interface{}]interface{}, t time.Time) {
+	if s3operator.location != nil {
+		t = t.In(s3operator.location)
+	}
+	switch s3operator.timeKeyFormat {
+	case "unix":
+		record[s3operator.timeKey] = t.Unix()
+	case "unix_ms":
+		record[s3operator.timeKey] = t.UnixNano() / int64(time.Millisecond)
+	case "unix_float":
+		record[s3operator.timeKey] = float64(t.UnixNano()) / float64(time.Second)
+	default:
+		record[s3operator.timeKey] = t.Format(s3operator.timeKeyFormat)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventTime(t *testing.T) {
+	ts := time.Date(2019, time.March, 10, 10, 11, 12, 0, time.UTC)
+	assert.True(t, ts.Equal(eventTime(output.FLBTime{Time: ts})))
+	assert.True(t, ts.Equal(eventTime(uint64(ts.Unix()))))
+
+	before := time.Now()
+	assert.False(t, eventTime(0).Before(before), "invalid timestamps fall back to now")
+}
+
+func TestInjectTime(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Tokyo")
+	ts := time.Date(2019, time.March, 10, 10, 11, 12, 500000000, time.UTC)
+	for timeKeyFormat, expected := range map[string]interface{}{
+		time.RFC3339:          "2019-03-10T19:11:12+09:00",
+		"2006-01-02 15:04:05": "2019-03-10 19:11:12",
+		"unix":                int64(1552212672),
+		"unix_ms":             int64(1552212672500),
+		"unix_float":          1552212672.5,
+	} {
+		s3mock := &s3operator{
+			location:      loc,
+			timeKey:       "time",
+			timeKeyFormat: timeKeyFormat,
+		}
+		record := map[interface{}]interface{}{"log": "line"}
+		s3mock.injectTime(record, ts)
+		assert.Equal(t, expected, record["time"], "Inject time with %s", timeKeyFormat)
+	}
+}
+
+func TestTimeSlice(t *testing.T) {
+	ts := time.Date(2019, time.March, 10, 10, 11, 12, 0, time.UTC)
+	s3mock := &s3operator{
+		timeFormat: "20060102/15",
+		location:   time.UTC,
+	}
+	assert.Equal(t, "20190310/10", s3mock.timeSlice(ts))
+	assert.Equal(t, s3mock.timeSlice(ts), s3mock.timeSlice(ts.Add(30*time.Minute)))
+
+	f, _ := newObjectKeyFormatter("%{path}/dt=%Y-%m-%d/%{timestamp}-%{uuid}.log")
+	s3mock.keyFormatter = f
+	assert.Equal(t, s3mock.timeSlice(ts), s3mock.timeSlice(ts.Add(time.Hour)), "%{timestamp} does not split objects")
+	assert.NotEqual(t, s3mock.timeSlice(ts), s3mock.timeSlice(ts.Add(24*time.Hour)))
+}
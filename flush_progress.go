@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// flushProgress remembers the partitions of a chunk which were uploaded, or given up,
+// before another partition of the same chunk failed. Fluent Bit retries the chunk as
+// a whole, so that those partitions are skipped on the retry instead of being
+// uploaded twice.
+type flushProgress struct {
+	mu     sync.Mutex
+	chunks map[string]*chunkProgress
+}
+
+type chunkProgress struct {
+	done     map[partition]bool
+	lastUsed time.Time
+}
+
+// chunks which are not retried for a day are dropped once there are this many of them.
+const maxChunkProgress = 1024
+
+func newFlushProgress() *flushProgress {
+	return &flushProgress{chunks: make(map[string]*chunkProgress)}
+}
+
+// chunkID identifies a chunk by its batches, which are the same each time Fluent Bit
+// retries the chunk.
+func chunkID(batches []*batch) string {
+	h := sha256.New()
+	for _, b := range batches {
+		h.Write([]byte(encodePartition(b.partition, b.eventTime)))
+		h.Write([]byte(b.partition.slice + "\n"))
+		h.Write([]byte(b.lines))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// done reports whether p of the chunk was finished by a previous attempt.
+func (f *flushProgress) done(id string, p partition) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.chunks[id]
+	return ok && c.done[p]
+}
+
+// markDone records that p of the chunk was uploaded or given up.
+func (f *flushProgress) markDone(id string, p partition) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if len(f.chunks) >= maxChunkProgress {
+		for k, c := range f.chunks {
+			if now.Sub(c.lastUsed) > 24*time.Hour {
+				delete(f.chunks, k)
+			}
+		}
+	}
+
+	c, ok := f.chunks[id]
+	if !ok {
+		c = &chunkProgress{done: make(map[partition]bool)}
+		f.chunks[id] = c
+	}
+	c.done[p] = true
+	c.lastUsed = now
+}
+
+// forget drops the chunk once Fluent Bit does not retry it anymore.
+func (f *flushProgress) forget(id string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.chunks, id)
+}
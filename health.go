@@ -0,0 +1,144 @@
+package main
+
+import (
+	// context is the name of the plugin context in this package.
+	gocontext "context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// readinessTimeout bounds the HeadBucket request of a readiness check.
+const readinessTimeout = 5 * time.Second
+
+// uploadHealth tracks the outcome of recent uploads of an s3operator. A nil
+// uploadHealth records nothing.
+type uploadHealth struct {
+	mu                  sync.Mutex
+	lastSuccess         time.Time
+	lastFailure         time.Time
+	lastError           string
+	consecutiveFailures int
+}
+
+func (h *uploadHealth) succeeded() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastSuccess = time.Now()
+	h.consecutiveFailures = 0
+}
+
+func (h *uploadHealth) failed(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastFailure = time.Now()
+	h.lastError = err.Error()
+	h.consecutiveFailures++
+}
+
+// operatorState is the state of an s3operator reported by the health endpoint.
+type operatorState struct {
+	Operator            int        `json:"operator"`
+	Bucket              string     `json:"bucket"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	BufferedBytes       int        `json:"buffered_bytes"`
+	QueuedBatches       int        `json:"queued_batches"`
+	Ready               *bool      `json:"ready,omitempty"`
+	ReadyError          string     `json:"ready_error,omitempty"`
+}
+
+func (s3operator *s3operator) state(operatorID int) *operatorState {
+	state := &operatorState{
+		Operator: operatorID,
+		Bucket:   s3operator.bucket,
+	}
+	if h := s3operator.health; h != nil {
+		h.mu.Lock()
+		if !h.lastSuccess.IsZero() {
+			t := h.lastSuccess.UTC()
+			state.LastSuccess = &t
+		}
+		if !h.lastFailure.IsZero() {
+			t := h.lastFailure.UTC()
+			state.LastFailure = &t
+		}
+		state.LastError = h.lastError
+		state.ConsecutiveFailures = h.consecutiveFailures
+		h.mu.Unlock()
+	}
+	if s3operator.buffering() {
+		state.BufferedBytes = s3operator.buffer.size()
+	}
+	if s3operator.workers != nil {
+		state.QueuedBatches = s3operator.workers.pending()
+	}
+	return state
+}
+
+// checkBucket confirms that the bucket exists and the credentials can access it.
+func (s3operator *s3operator) checkBucket(ctx gocontext.Context) error {
+	_, err := s3operator.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s3operator.bucket),
+	})
+	return err
+}
+
+// healthHandler reports the state of every s3operator. It always responds with
+// 200, so that it can be used as a liveness probe while S3 is unavailable.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	states := make([]*operatorState, 0, len(s3operators))
+	for operatorID, s3operator := range s3operators {
+		states = append(states, s3operator.state(operatorID))
+	}
+	writeStates(w, http.StatusOK, states)
+}
+
+// readyHandler reports the state of every s3operator with a HeadBucket of its
+// bucket. It responds with 503 unless every bucket is reachable.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	states := make([]*operatorState, 0, len(s3operators))
+	for operatorID, s3operator := range s3operators {
+		state := s3operator.state(operatorID)
+		ctx, cancel := gocontext.WithTimeout(r.Context(), readinessTimeout)
+		err := s3operator.checkBucket(ctx)
+		cancel()
+		ready := err == nil
+		state.Ready = &ready
+		if err != nil {
+			state.ReadyError = err.Error()
+			status = http.StatusServiceUnavailable
+		}
+		states = append(states, state)
+	}
+	writeStates(w, status, states)
+}
+
+func writeStates(w http.ResponseWriter, status int, states []*operatorState) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(states)
+}
+
+// serveHealth starts to serve /health and /ready on address.
+func serveHealth(address string) error {
+	if err := serveHTTP(address, "/health", healthHandler); err != nil {
+		return err
+	}
+	return serveHTTP(address, "/ready", readyHandler)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/fluent/fluent-bit-go/output"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// headBucketS3 answers HeadBucket with err.
+type headBucketS3 struct {
+	s3iface.S3API
+	err     error
+	buckets []string
+}
+
+func (s *headBucketS3) HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
+	s.buckets = append(s.buckets, *input.Bucket)
+	return &s3.HeadBucketOutput{}, s.err
+}
+
+func getStates(t *testing.T, handler http.HandlerFunc, path string) (int, []*operatorState) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", path, nil))
+	var states []*operatorState
+	if err := json.Unmarshal(recorder.Body.Bytes(), &states); err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	return recorder.Code, states
+}
+
+func TestHealthHandler(t *testing.T) {
+	testplugin := &failingPlugin{
+		testFluentPlugin: &testFluentPlugin{},
+		errs: []error{
+			awserr.New("SlowDown", "Please reduce your request rate.", nil),
+		},
+	}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"mykey": "myvalue"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3mock := &s3operator{
+		bucket:    "examplebucket",
+		logger:    newLogger(log.InfoLevel),
+		location:  time.UTC,
+		formatter: &jsonFormatter{},
+		health:    &uploadHealth{},
+	}
+	s3operators = []*s3operator{s3mock}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_RETRY, res)
+
+	status, states := getStates(t, healthHandler, "/health")
+	assert.Equal(t, http.StatusOK, status, "failures do not fail the liveness")
+	assert.Len(t, states, 1)
+	assert.Equal(t, "examplebucket", states[0].Bucket)
+	assert.Equal(t, 1, states[0].ConsecutiveFailures)
+	assert.Equal(t, "SlowDown: Please reduce your request rate.", states[0].LastError)
+	assert.Nil(t, states[0].LastSuccess)
+	assert.NotNil(t, states[0].LastFailure)
+	assert.Nil(t, states[0].Ready, "/health does not call S3")
+
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"mykey": "myvalue"})
+	res = FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+
+	s3mock.buffer = newRecordBuffers(nil)
+	s3mock.buffer.append(partition{tag: "app"}, time.Time{}, "line1\n", 1)
+	s3mock.buffer.append(partition{tag: "web"}, time.Time{}, "line2\n", 1)
+
+	_, states = getStates(t, healthHandler, "/health")
+	assert.Equal(t, 0, states[0].ConsecutiveFailures)
+	assert.NotNil(t, states[0].LastSuccess)
+	assert.Equal(t, 12, states[0].BufferedBytes)
+}
+
+func TestReadyHandler(t *testing.T) {
+	reachable := &headBucketS3{}
+	unreachable := &headBucketS3{
+		err: awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), 403, "id"),
+	}
+	s3operators = []*s3operator{
+		{bucket: "examplebucket", client: reachable},
+		{bucket: "otherbucket", client: unreachable},
+	}
+
+	status, states := getStates(t, readyHandler, "/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, []string{"examplebucket"}, reachable.buckets)
+	assert.Equal(t, []string{"otherbucket"}, unreachable.buckets)
+	assert.True(t, *states[0].Ready)
+	assert.False(t, *states[1].Ready)
+	assert.Contains(t, states[1].ReadyError, "Forbidden")
+
+	unreachable.err = nil
+	status, _ = getStates(t, readyHandler, "/ready")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestUploadHealth(t *testing.T) {
+	var h *uploadHealth
+	h.failed(errors.New("ignored")) // nil uploadHealth records nothing.
+
+	h = &uploadHealth{}
+	h.failed(errors.New("first"))
+	h.failed(errors.New("second"))
+	assert.Equal(t, 2, h.consecutiveFailures)
+	assert.Equal(t, "second", h.lastError)
+	h.succeeded()
+	assert.Equal(t, 0, h.consecutiveFailures)
+	assert.False(t, h.lastSuccess.IsZero())
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	md5Checksum = "md5"
+	// sha256Checksum is accepted for compatibility, but needs no header of its own.
+	sha256Checksum = "sha256"
+	// S3 rejects bodies which do not match this header with BadDigest. Bodies which
+	// do not match X-Amz-Content-Sha256, which the signer always sets, are rejected
+	// with XAmzContentSHA256Mismatch.
+	contentMD5Header = "Content-Md5"
+	// errCodeUploadVerification is the error code of uploaded objects which do
+	// not match their bodies. It is retried like the errors of S3.
+	errCodeUploadVerification = "UploadVerificationFailed"
+)
+
+// integrityConfig describes how uploads are protected against corruption.
+type integrityConfig struct {
+	// checksum is md5 or empty.
+	checksum string
+	// verify checks the ETag and the size of uploaded objects and parts.
+	verify bool
+}
+
+// getIntegrityConfig returns nil unless Checksum or VerifyUpload is specified.
+func getIntegrityConfig(checksum, verifyUpload string) (*integrityConfig, error) {
+	conf := &integrityConfig{}
+
+	switch checksum {
+	case "":
+	case md5Checksum:
+		conf.checksum = checksum
+	case sha256Checksum:
+		// The signer already sends the SHA-256 of every body as X-Amz-Content-Sha256.
+	default:
+		return nil, fmt.Errorf("invalid checksum: %v (%s or %s)", checksum, md5Checksum, sha256Checksum)
+	}
+
+	if verifyUpload != "" {
+		verify, err := strconv.ParseBool(verifyUpload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verifyUpload: %v", verifyUpload)
+		}
+		conf.verify = verify
+	}
+
+	if conf.checksum == "" && !conf.verify {
+		return nil, nil
+	}
+	return conf, nil
+}
+
+// sha256Hex returns the SHA-256 of data in hex, which is also the suffix of
+// SuffixAlgorithm sha256.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// md5Hex returns the MD5 of data in hex, which is the ETag of objects and parts
+// uploaded without SSE-KMS and SSE-C.
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// requestOptions returns the options which set the checksum on every request
+// sending a body.
+func (c *integrityConfig) requestOptions() []request.Option {
+	if c == nil || c.checksum == "" {
+		return nil
+	}
+	return []request.Option{func(r *request.Request) {
+		r.Handlers.Build.PushBack(c.setChecksumHeader)
+	}}
+}
+
+// setChecksumHeader sets Content-MD5 of the body of PutObject and UploadPart. It runs
+// after the SDK, which computes the same header unless S3DisableContentMD5Validation
+// is set, so that the body is only hashed when the header is missing.
+func (c *integrityConfig) setChecksumHeader(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "UploadPart":
+	default:
+		return
+	}
+	if r.Error != nil || r.HTTPRequest.Header.Get(contentMD5Header) != "" {
+		return
+	}
+	h := md5.New()
+	if err := hashRequestBody(h, r); err != nil {
+		r.Error = awserr.New("ChecksumError", "failed to compute body checksum", err)
+		return
+	}
+	r.HTTPRequest.Header.Set(contentMD5Header, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// hashRequestBody writes the body of r into h and rewinds it to be sent.
+func hashRequestBody(h io.Writer, r *request.Request) error {
+	if r.Body == nil {
+		return nil
+	}
+	start, err := r.Body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, r.Body); err != nil {
+		return err
+	}
+	_, err = r.Body.Seek(start, io.SeekStart)
+	return err
+}
+
+// verifiesETag reports whether the ETag of an object or a part is the MD5 of its
+// body, which is not true with SSE-KMS and SSE-C. The encryption is taken from the
+// response of S3, so that the default encryption of the bucket is also honoured.
+func (s3operator *s3operator) verifiesETag(serverSideEncryption, sseCustomerAlgorithm *string) bool {
+	if aws.StringValue(sseCustomerAlgorithm) != "" || strings.HasPrefix(aws.StringValue(serverSideEncryption), s3.ServerSideEncryptionAwsKms) {
+		return false
+	}
+	// S3 compatible services may not return the encryption of objects.
+	if c := s3operator.sse; c != nil && (c.algorithm == s3.ServerSideEncryptionAwsKms || c.customerKey != "") {
+		return false
+	}
+	return true
+}
+
+// expectedETag returns the ETag of body uploaded by s3manager, which splits it
+// into parts in the same way.
+func expectedETag(body []byte, partSize int64, maxUploadParts int) string {
+	size := int64(len(body))
+	if size <= partSize {
+		return md5Hex(body)
+	}
+	if size/partSize >= int64(maxUploadParts) {
+		partSize = size/int64(maxUploadParts) + 1
+	}
+
+	var sums []byte
+	parts := 0
+	for offset := int64(0); offset < size; offset += partSize {
+		end := offset + partSize
+		if end > size {
+			end = size
+		}
+		sum := md5.Sum(body[offset:end])
+		sums = append(sums, sum[:]...)
+		parts++
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts)
+}
+
+// verifyUpload compares the object uploaded as objectKey with its body.
+func (s3operator *s3operator) verifyUpload(objectKey string, body []byte) error {
+	if c := s3operator.integrity; c == nil || !c.verify {
+		return nil
+	}
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s3operator.bucket),
+		Key:    aws.String(objectKey),
+	}
+	s3operator.sse.applyHead(input)
+	output, err := s3operator.client.HeadObjectWithContext(aws.BackgroundContext(), input)
+	if err != nil {
+		return err
+	}
+
+	if size := aws.Int64Value(output.ContentLength); size != int64(len(body)) {
+		return newVerificationError("uploaded object %s is %d bytes, expected %d", objectKey, size, len(body))
+	}
+	if !s3operator.verifiesETag(output.ServerSideEncryption, output.SSECustomerAlgorithm) {
+		return nil
+	}
+	partSize, maxUploadParts := s3manager.DefaultUploadPartSize, s3manager.MaxUploadParts
+	if u := s3operator.uploader; u != nil {
+		partSize, maxUploadParts = u.PartSize, u.MaxUploadParts
+	}
+	expected := expectedETag(body, partSize, maxUploadParts)
+	if etag := unquoteETag(output.ETag); etag != expected {
+		return newVerificationError("uploaded object %s has ETag %s, expected %s", objectKey, etag, expected)
+	}
+	return nil
+}
+
+// verifyPart compares the ETag of an uploaded part with the MD5 of its body.
+func (s3operator *s3operator) verifyPart(objectKey string, partNumber int64, body []byte, output *s3.UploadPartOutput) error {
+	if c := s3operator.integrity; c == nil || !c.verify || !s3operator.verifiesETag(output.ServerSideEncryption, output.SSECustomerAlgorithm) {
+		return nil
+	}
+	if actual, expected := unquoteETag(output.ETag), md5Hex(body); actual != expected {
+		return newVerificationError("part %d of %s has ETag %s, expected %s", partNumber, objectKey, actual, expected)
+	}
+	return nil
+}
+
+func unquoteETag(etag *string) string {
+	return strings.Trim(aws.StringValue(etag), `"`)
+}
+
+func newVerificationError(format string, args ...interface{}) error {
+	return awserr.New(errCodeUploadVerification, fmt.Sprintf(format, args...), nil)
+}
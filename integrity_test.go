@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetIntegrityConfig(t *testing.T) {
+	conf, err := getIntegrityConfig("", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, conf, "uploads are not verified by default")
+	assert.Len(t, conf.requestOptions(), 0)
+
+	conf, err = getIntegrityConfig("md5", "true")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &integrityConfig{checksum: "md5", verify: true}, conf)
+	assert.Len(t, conf.requestOptions(), 1)
+
+	conf, err = getIntegrityConfig("", "true")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Len(t, conf.requestOptions(), 0, "VerifyUpload does not need checksum headers")
+
+	conf, err = getIntegrityConfig("sha256", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, conf, "the signer already sends the SHA-256 of bodies")
+
+	_, err = getIntegrityConfig("crc32", "")
+	assert.Equal(t, errors.New("invalid checksum: crc32 (md5 or sha256)"), err)
+	_, err = getIntegrityConfig("", "always")
+	assert.Equal(t, errors.New("invalid verifyUpload: always"), err)
+}
+
+func TestExpectedETag(t *testing.T) {
+	body := []byte("0123456789ab")
+	assert.Equal(t, md5Hex(body), expectedETag(body, 12, 10000))
+
+	multipartETag := func(parts ...string) string {
+		var sums []byte
+		for _, part := range parts {
+			sum := md5.Sum([]byte(part))
+			sums = append(sums, sum[:]...)
+		}
+		return fmt.Sprintf("%s-%d", md5Hex(sums), len(parts))
+	}
+	assert.Equal(t, multipartETag("01234", "56789", "ab"), expectedETag(body, 5, 10000))
+	assert.Equal(t, multipartETag("0123", "4567", "89ab"), expectedETag(body, 1, 4), "parts are enlarged to fit in MaxUploadParts")
+}
+
+func newIntegrityOperator(svc *fakeS3, integrity *integrityConfig) *s3operator {
+	return &s3operator{
+		bucket: "examplebucket",
+		uploader: s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+			u.RequestOptions = append(u.RequestOptions, integrity.requestOptions()...)
+		}),
+		compressFormat: plainTextFormat,
+		logger:         newLogger(log.InfoLevel),
+		location:       time.UTC,
+		integrity:      integrity,
+		metrics:        newOperatorMetrics(0, "examplebucket"),
+		client:         svc,
+	}
+}
+
+func TestPutWithChecksum(t *testing.T) {
+	line := "{\"log\":\"hello\"}\n"
+	sum := md5.Sum([]byte(line))
+	for checksum, expected := range map[string]string{
+		"":    "",
+		"md5": base64.StdEncoding.EncodeToString(sum[:]),
+	} {
+		svc := newFakeS3()
+		s3operator := newIntegrityOperator(svc, &integrityConfig{checksum: checksum})
+		if err := (&fluentPlugin{}).Put(s3operator, "exampleprefix/object.log", time.Now(), line); err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		assert.Len(t, svc.requests, 1)
+		assert.Equal(t, expected, svc.requests[0].Header.Get("Content-Md5"))
+		// The signer sends the SHA-256 of the body regardless of Checksum.
+		assert.Equal(t, sha256Hex([]byte(line)), svc.requests[0].Header.Get("X-Amz-Content-Sha256"))
+	}
+}
+
+func TestSetChecksumHeader(t *testing.T) {
+	line := "{\"log\":\"hello\"}\n"
+	sum := md5.Sum([]byte(line))
+	conf := &integrityConfig{checksum: "md5"}
+	svc := newFakeS3()
+
+	body := bytes.NewReader([]byte(line))
+	r, _ := svc.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String("examplebucket"), Key: aws.String("object.log"), Body: body})
+	// The fake disables Content-MD5 of the SDK, as S3DisableContentMD5Validation does.
+	assert.NoError(t, r.Build())
+	conf.setChecksumHeader(r)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(sum[:]), r.HTTPRequest.Header.Get("Content-Md5"))
+	assert.Equal(t, int64(len(line)), int64(body.Len()), "the body is rewound to be sent")
+
+	r, _ = svc.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String("examplebucket"), Key: aws.String("object.log"), Body: bytes.NewReader([]byte(line))})
+	assert.NoError(t, r.Build())
+	r.HTTPRequest.Header.Set("Content-Md5", "computed-by-sdk")
+	conf.setChecksumHeader(r)
+	assert.Equal(t, "computed-by-sdk", r.HTTPRequest.Header.Get("Content-Md5"), "the header of the SDK is kept")
+}
+
+func TestPutWithVerifyUpload(t *testing.T) {
+	line := "{\"log\":\"hello\"}\n"
+	svc := newFakeS3()
+	s3operator := newIntegrityOperator(svc, &integrityConfig{verify: true})
+	if err := (&fluentPlugin{}).Put(s3operator, "exampleprefix/object.log", time.Now(), line); err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+
+	svc.corrupt = true
+	err := (&fluentPlugin{}).Put(s3operator, "exampleprefix/object.log", time.Now(), line)
+	if assert.Error(t, err) {
+		assert.Equal(t, errCodeUploadVerification, err.(awserr.Error).Code())
+		assert.Contains(t, err.Error(), "uploaded object exampleprefix/object.log has ETag")
+		assert.True(t, isTransientError(err), "a corrupted upload is retried")
+	}
+
+	// ETags of SSE-KMS are not MD5, so that only the size is verified.
+	s3operator.sse = &sseConfig{algorithm: "aws:kms"}
+	assert.NoError(t, (&fluentPlugin{}).Put(s3operator, "exampleprefix/object.log", time.Now(), line))
+	svc.objects["exampleprefix/object.log"] = []byte("truncated")
+	err = s3operator.verifyUpload("exampleprefix/object.log", []byte(line))
+	assert.Equal(t, awserr.New(errCodeUploadVerification, "uploaded object exampleprefix/object.log is 9 bytes, expected 16", nil), err)
+}
+
+func TestPutWithVerifyUploadToBucketWithKMS(t *testing.T) {
+	line := "{\"log\":\"hello\"}\n"
+	svc := newFakeS3()
+	svc.bucketKMS = true
+	s3operator := newIntegrityOperator(svc, &integrityConfig{verify: true})
+
+	// The plugin does not request SSE-KMS, but the bucket encrypts objects by default.
+	assert.NoError(t, (&fluentPlugin{}).Put(s3operator, "exampleprefix/object.log", time.Now(), line))
+
+	svc.objects["exampleprefix/object.log"] = []byte("truncated")
+	err := s3operator.verifyUpload("exampleprefix/object.log", []byte(line))
+	assert.Equal(t, awserr.New(errCodeUploadVerification, "uploaded object exampleprefix/object.log is 9 bytes, expected 16", nil), err)
+}
+
+func TestVerifyPart(t *testing.T) {
+	s3operator := &s3operator{integrity: &integrityConfig{verify: true}}
+	body := []byte("part")
+	assert.NoError(t, s3operator.verifyPart("object.log", 1, body, &s3.UploadPartOutput{ETag: aws.String(`"` + md5Hex(body) + `"`)}))
+
+	err := s3operator.verifyPart("object.log", 2, body, &s3.UploadPartOutput{ETag: aws.String(`"0123"`)})
+	assert.Equal(t, awserr.New(errCodeUploadVerification, "part 2 of object.log has ETag 0123, expected "+md5Hex(body), nil), err)
+
+	// Parts encrypted with SSE-KMS by the default encryption of the bucket or with SSE-C have other ETags.
+	assert.NoError(t, s3operator.verifyPart("object.log", 2, body, &s3.UploadPartOutput{ETag: aws.String(`"0123"`), ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms)}))
+	assert.NoError(t, s3operator.verifyPart("object.log", 2, body, &s3.UploadPartOutput{ETag: aws.String(`"0123"`), SSECustomerAlgorithm: aws.String("AES256")}))
+	err = s3operator.verifyPart("object.log", 2, body, &s3.UploadPartOutput{ETag: aws.String(`"0123"`), ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256)})
+	assert.Error(t, err, "ETags of SSE-S3 are the MD5 of the body")
+
+	s3operator.integrity = nil
+	assert.NoError(t, s3operator.verifyPart("object.log", 2, body, &s3.UploadPartOutput{ETag: aws.String(`"0123"`)}))
+}
+
+func TestIsTransientChecksumError(t *testing.T) {
+	assert.True(t, isTransientError(awserr.NewRequestFailure(awserr.New("BadDigest", "The Content-MD5 you specified did not match what we received.", nil), 400, "id")))
+	assert.True(t, isTransientError(awserr.NewRequestFailure(awserr.New("XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.", nil), 400, "id")))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/json-iterator/go"
+	msgpack "github.com/ugorji/go/codec"
+)
+
+// invalidUTF8Mode selects how strings which are not valid UTF-8 are written into JSON.
+type invalidUTF8Mode int
+
+const (
+	// replaceInvalidUTF8 replaces invalid bytes with U+FFFD like encoding/json.
+	replaceInvalidUTF8 invalidUTF8Mode = iota
+	// escapeInvalidUTF8 writes invalid bytes as \xNN, keeping the valid part readable.
+	escapeInvalidUTF8
+	// base64InvalidUTF8 writes the whole string in base64.
+	base64InvalidUTF8
+)
+
+func getInvalidUTF8Mode(invalidUTF8 string) (invalidUTF8Mode, error) {
+	switch invalidUTF8 {
+	case "", "replace":
+		return replaceInvalidUTF8, nil
+	case "escape":
+		return escapeInvalidUTF8, nil
+	case "base64":
+		return base64InvalidUTF8, nil
+	}
+	return 0, fmt.Errorf("invalid invalidUTF8: %v (replace, escape or base64)", invalidUTF8)
+}
+
+// jsonEncoder converts records decoded from msgpack into values which can be
+// marshaled as JSON. The zero value replaces invalid UTF-8.
+type jsonEncoder struct {
+	invalidUTF8 invalidUTF8Mode
+}
+
+// encode converts a record into a map with string keys.
+func (e jsonEncoder) encode(record map[interface{}]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		m[e.key(k)] = e.value(v)
+	}
+	return m
+}
+
+// marshal encodes a record as a line of JSON.
+func (e jsonEncoder) marshal(record map[interface{}]interface{}) (string, error) {
+	js, err := jsoniter.Marshal(e.encode(record))
+	if err != nil {
+		return "{}", err
+	}
+	return string(js), nil
+}
+
+// stringify returns strings as they are and encodes other values as JSON.
+func (e jsonEncoder) stringify(value interface{}) (string, error) {
+	switch v := e.value(value).(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		js, err := jsoniter.Marshal(v)
+		return string(js), err
+	}
+}
+
+// key converts a map key into a string. msgpack allows keys of any type.
+func (e jsonEncoder) key(k interface{}) string {
+	switch t := k.(type) {
+	case string:
+		return e.string(t)
+	case []byte:
+		return e.string(string(t))
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(t)
+	case float32:
+		return strconv.FormatFloat(float64(t), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(t)
+	}
+	if s, err := e.stringify(k); err == nil {
+		return s
+	}
+	return e.string(fmt.Sprint(k))
+}
+
+func (e jsonEncoder) value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return e.string(t)
+	case []byte:
+		// prevent encoding to base64
+		return e.string(string(t))
+	case map[interface{}]interface{}:
+		return e.encode(t)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			m[e.string(k)] = e.value(item)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, item := range t {
+			a[i] = e.value(item)
+		}
+		return a
+	case float32:
+		return e.float(float64(t), v)
+	case float64:
+		return e.float(t, v)
+	case output.FLBTime:
+		return t.Format(time.RFC3339Nano)
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	case msgpack.RawExt:
+		return e.ext(&t)
+	case *msgpack.RawExt:
+		return e.ext(t)
+	}
+	return v
+}
+
+// float keeps v unless it is NaN or infinity, which JSON cannot represent.
+func (e jsonEncoder) float(f float64, v interface{}) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return v
+}
+
+// ext converts msgpack extension types other than the event time of Fluent Bit.
+func (e jsonEncoder) ext(x *msgpack.RawExt) interface{} {
+	if x == nil {
+		return nil
+	}
+	m := map[string]interface{}{"type": x.Tag}
+	if x.Data != nil {
+		m["data"] = base64.StdEncoding.EncodeToString(x.Data)
+	} else {
+		m["value"] = e.value(x.Value)
+	}
+	return m
+}
+
+func (e jsonEncoder) string(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	if e.invalidUTF8 == base64InvalidUTF8 {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			if e.invalidUTF8 == escapeInvalidUTF8 {
+				b = append(b, fmt.Sprintf(`\x%02x`, s[i])...)
+			} else {
+				b = append(b, "\uFFFD"...)
+			}
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	return string(b)
+}
@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"testing"
+
+	msgpack "github.com/ugorji/go/codec"
+)
+
+// FuzzEncodeJSON decodes arbitrary msgpack like Fluent Bit and checks that every
+// record is encoded as valid JSON. Run it with `go test -fuzz FuzzEncodeJSON`.
+func FuzzEncodeJSON(f *testing.F) {
+	f.Add(appendMsgpack(nil, msgpackMap{{"log", []byte("hello")}}))
+	f.Add(appendMsgpack(nil, msgpackMap{{1, true}, {nil, 1.5}, {[]byte("\xff"), []byte("caf\xe9")}}))
+	f.Add(appendMsgpack(nil, msgpackMap{{"items", []interface{}{msgpackMap{{"k", []byte("v")}}, []interface{}{nil}}}}))
+	f.Add(appendMsgpack(nil, msgpackMap{{"ext", msgpack.RawExt{Tag: 9, Data: []byte{1, 2}}}}))
+	f.Add(appendMsgpack(nil, msgpackMap{{"time", msgpack.RawExt{Tag: 0, Data: []byte{0, 0, 0, 1, 0, 0, 0, 2}}}}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		record, ok := decodeFuzzRecord(data)
+		if !ok {
+			return
+		}
+		checkEncodedJSON(t, record)
+	})
+}
+
+func decodeFuzzRecord(data []byte) (record map[interface{}]interface{}, ok bool) {
+	// The decoder of Fluent Bit panics on some malformed input, which is not the
+	// subject of this test.
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	var decoded interface{}
+	if err := msgpack.NewDecoderBytes(data, newFluentBitHandle()).Decode(&decoded); err != nil {
+		return nil, false
+	}
+	record, ok = decoded.(map[interface{}]interface{})
+	return record, ok
+}
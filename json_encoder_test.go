@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+	msgpack "github.com/ugorji/go/codec"
+)
+
+// newFluentBitHandle returns a msgpack handle which decodes like output.NewDecoder.
+func newFluentBitHandle() *msgpack.MsgpackHandle {
+	h := new(msgpack.MsgpackHandle)
+	h.SetExt(reflect.TypeOf(output.FLBTime{}), 0, &output.FLBTime{})
+	return h
+}
+
+// msgpackMap keeps the order of entries, and allows keys which Go maps do not.
+type msgpackMap [][2]interface{}
+
+// appendMsgpack encodes v in the way Fluent Bit does for the types of the tests.
+func appendMsgpack(b []byte, v interface{}) []byte {
+	switch t := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if t {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case int:
+		b = append(b, 0xd3)
+		return appendUint(b, uint64(t), 8)
+	case float64:
+		b = append(b, 0xcb)
+		return appendUint(b, math.Float64bits(t), 8)
+	case string:
+		b = append(b, 0xda)
+		return append(appendUint(b, uint64(len(t)), 2), t...)
+	case []byte:
+		b = append(b, 0xc5)
+		return append(appendUint(b, uint64(len(t)), 2), t...)
+	case []interface{}:
+		b = append(b, 0xdc)
+		b = appendUint(b, uint64(len(t)), 2)
+		for _, item := range t {
+			b = appendMsgpack(b, item)
+		}
+		return b
+	case msgpackMap:
+		b = append(b, 0xde)
+		b = appendUint(b, uint64(len(t)), 2)
+		for _, kv := range t {
+			b = appendMsgpack(appendMsgpack(b, kv[0]), kv[1])
+		}
+		return b
+	case msgpack.RawExt:
+		b = append(b, 0xc7, byte(len(t.Data)), byte(t.Tag))
+		return append(b, t.Data...)
+	}
+	panic(fmt.Sprintf("unsupported type %T", v))
+}
+
+func appendUint(b []byte, n uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(n>>(8*uint(i))))
+	}
+	return b
+}
+
+// decodeTestRecord decodes m like output.GetRecord, so that the record has the
+// types which Fluent Bit passes to the plugin.
+func decodeTestRecord(t *testing.T, m msgpackMap) map[interface{}]interface{} {
+	var decoded interface{}
+	if err := msgpack.NewDecoderBytes(appendMsgpack(nil, m), newFluentBitHandle()).Decode(&decoded); err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	return decoded.(map[interface{}]interface{})
+}
+
+func TestGetInvalidUTF8Mode(t *testing.T) {
+	for s, expected := range map[string]invalidUTF8Mode{
+		"":        replaceInvalidUTF8,
+		"replace": replaceInvalidUTF8,
+		"escape":  escapeInvalidUTF8,
+		"base64":  base64InvalidUTF8,
+	} {
+		mode, err := getInvalidUTF8Mode(s)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		assert.Equal(t, expected, mode)
+	}
+
+	_, err := getInvalidUTF8Mode("drop")
+	assert.Equal(t, errors.New("invalid invalidUTF8: drop (replace, escape or base64)"), err)
+}
+
+func TestEncodeJSONWithNonStringKeys(t *testing.T) {
+	record := decodeTestRecord(t, msgpackMap{
+		{1, "one"},
+		{true, "yes"},
+		{1.5, "one and a half"},
+		{[]byte("bytes"), []byte("binary key")},
+		{"nested", msgpackMap{{nil, "nil"}, {-2, []byte("value")}}},
+	})
+
+	line, err := createJSON(record)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.JSONEq(t, `{"1":"one","true":"yes","1.5":"one and a half","bytes":"binary key","nested":{"null":"nil","-2":"value"}}`, line)
+}
+
+func TestEncodeJSONWithArraysOfMaps(t *testing.T) {
+	record := decodeTestRecord(t, msgpackMap{
+		{"items", []interface{}{
+			msgpackMap{{"name", []byte("first")}, {"tags", []interface{}{[]byte("a"), 1}}},
+			[]interface{}{msgpackMap{{"deep", []byte("value")}}},
+			[]byte("plain"),
+		}},
+	})
+
+	line, err := createJSON(record)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.JSONEq(t, `{"items":[{"name":"first","tags":["a",1]},[{"deep":"value"}],"plain"]}`, line, "[]byte values in arrays are not base64")
+}
+
+func TestEncodeJSONWithExtAndTime(t *testing.T) {
+	ts := time.Date(2019, time.March, 10, 10, 11, 12, 500, time.UTC)
+	record := map[interface{}]interface{}{
+		"ext":     msgpack.RawExt{Tag: 5, Data: []byte{1, 2, 3}},
+		"flbtime": output.FLBTime{Time: ts},
+		"time":    ts,
+		"nan":     math.NaN(),
+		"inf":     math.Inf(-1),
+	}
+
+	line, err := createJSON(record)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.JSONEq(t, `{"ext":{"type":5,"data":"AQID"},"flbtime":"2019-03-10T10:11:12.0000005Z","time":"2019-03-10T10:11:12.0000005Z","nan":"NaN","inf":"-Inf"}`, line)
+
+	line, err = createJSON(decodeTestRecord(t, msgpackMap{
+		{"ext", msgpack.RawExt{Tag: 7, Data: []byte("data")}},
+		{"time", msgpack.RawExt{Tag: 0, Data: []byte{0x5c, 0x84, 0xe2, 0x58, 0, 0, 0, 0}}},
+	}))
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.JSONEq(t, `{"ext":{"type":7,"data":"ZGF0YQ=="},"time":"`+time.Unix(0x5c84e258, 0).Format(time.RFC3339Nano)+`"}`, line, "unknown ext types are decoded as RawExt")
+}
+
+func TestEncodeJSONWithInvalidUTF8(t *testing.T) {
+	record := map[interface{}]interface{}{
+		"log":     []byte("caf\xe9 \xff"),
+		"caf\xe9": "key",
+		"valid é": "kept as it is",
+	}
+
+	line, err := jsonEncoder{}.marshal(record)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.JSONEq(t, `{"log":"caf� �","caf�":"key","valid é":"kept as it is"}`, line)
+
+	line, err = jsonEncoder{invalidUTF8: escapeInvalidUTF8}.marshal(record)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.JSONEq(t, `{"log":"caf\\xe9 \\xff","caf\\xe9":"key","valid é":"kept as it is"}`, line)
+
+	line, err = jsonEncoder{invalidUTF8: base64InvalidUTF8}.marshal(record)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.JSONEq(t, `{"log":"Y2Fm6SD/","Y2Fm6Q==":"key","valid é":"kept as it is"}`, line)
+}
+
+func TestFormattersWithInvalidUTF8(t *testing.T) {
+	encoder := jsonEncoder{invalidUTF8: escapeInvalidUTF8}
+	record := map[interface{}]interface{}{"log": []byte("\xff"), 1: "one"}
+
+	line, err := newRecordFormatter(singleValueOutputFormat, "log", nil, encoder).Format(record)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, `\xff`, line)
+
+	line, err = newRecordFormatter(ltsvOutputFormat, "", nil, encoder).Format(record)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "1:one\tlog:\\xff", line)
+}
+
+// randomValue generates the values which the msgpack decoder returns.
+func randomValue(r *rand.Rand, depth int) interface{} {
+	n := 9
+	if depth > 3 {
+		n = 6
+	}
+	switch r.Intn(n) {
+	case 0:
+		return nil
+	case 1:
+		return r.Int63() - r.Int63()
+	case 2:
+		return r.NormFloat64()
+	case 3:
+		return r.Intn(2) == 0
+	case 4, 5:
+		b := make([]byte, r.Intn(8))
+		r.Read(b)
+		return b
+	case 6:
+		m := make(map[interface{}]interface{})
+		for i := r.Intn(4); i > 0; i-- {
+			m[randomKey(r)] = randomValue(r, depth+1)
+		}
+		return m
+	case 7:
+		a := make([]interface{}, r.Intn(4))
+		for i := range a {
+			a[i] = randomValue(r, depth+1)
+		}
+		return a
+	default:
+		b := make([]byte, r.Intn(4))
+		r.Read(b)
+		return msgpack.RawExt{Tag: uint64(r.Intn(128)), Data: b}
+	}
+}
+
+func randomKey(r *rand.Rand) interface{} {
+	switch r.Intn(4) {
+	case 0:
+		return r.Int63()
+	case 1:
+		return r.Intn(2) == 0
+	default:
+		b := make([]byte, r.Intn(6))
+		r.Read(b)
+		return string(b)
+	}
+}
+
+func checkEncodedJSON(t *testing.T, record map[interface{}]interface{}) {
+	for _, mode := range []invalidUTF8Mode{replaceInvalidUTF8, escapeInvalidUTF8, base64InvalidUTF8} {
+		line, err := jsonEncoder{invalidUTF8: mode}.marshal(record)
+		if err != nil {
+			t.Fatalf("cannot encode %#v: %v", record, err)
+		}
+		if !json.Valid([]byte(line)) || !utf8.ValidString(line) {
+			t.Fatalf("invalid JSON of %#v: %q", record, line)
+		}
+	}
+}
+
+func TestEncodeJSONWithRandomRecords(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		record := make(map[interface{}]interface{})
+		for j := r.Intn(6); j > 0; j-- {
+			record[randomKey(r)] = randomValue(r, 0)
+		}
+		checkEncodedJSON(t, record)
+	}
+}
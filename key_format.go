@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// objectKeyFormatter renders ObjectKeyFormat, which follows s3_object_key_format of fluent-plugin-s3.
+// e.g.) %{path}/tag=%{tag}/dt=%Y-%m-%d/hour=%H/%{uuid}.%{file_extension}
+type objectKeyFormatter struct {
+	format   string
+	hostname string
+	usesTag  bool
+	// recordKeys are the record accessors such as $.kubernetes.namespace_name used in format.
+	recordKeys []string
+
+	mu      sync.Mutex
+	indexes map[string]*objectKeyIndex
+}
+
+// partition groups records which are uploaded into the same object.
+type partition struct {
+	tag string
+	// values are the values of recordKeys joined by partitionValueSeparator.
+	values string
+	// slice is the time part of the key when objects are partitioned by event time.
+	slice string
+}
+
+const partitionValueSeparator = "\x00"
+
+type objectKeyIndex struct {
+	next     int
+	lastUsed time.Time
+}
+
+const (
+	objectKeyIndexMarker = "\x00index\x00"
+	// indexes which are not used for a day are dropped once there are this many of them.
+	maxObjectKeyIndexes = 1024
+)
+
+var objectKeyPlaceholders = map[string]bool{
+	"path":           true,
+	"tag":            true,
+	"time_slice":     true,
+	"timestamp":      true,
+	"index":          true,
+	"hostname":       true,
+	"uuid":           true,
+	"hash":           true,
+	"file_extension": true,
+}
+
+var strftimeDirectives = "YmdHMSyjbsLzZ%"
+
+func newObjectKeyFormatter(format string) (*objectKeyFormatter, error) {
+	f := &objectKeyFormatter{
+		format:  format,
+		indexes: make(map[string]*objectKeyIndex),
+	}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		if i+1 >= len(format) {
+			return nil, fmt.Errorf("invalid objectKeyFormat: trailing %%")
+		}
+		if format[i+1] != '{' {
+			if !strings.ContainsRune(strftimeDirectives, rune(format[i+1])) {
+				return nil, fmt.Errorf("invalid objectKeyFormat: unknown directive %%%c", format[i+1])
+			}
+			i++
+			continue
+		}
+		end := strings.IndexByte(format[i:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("invalid objectKeyFormat: unclosed placeholder")
+		}
+		name := format[i+2 : i+end]
+		switch {
+		case objectKeyPlaceholders[name]:
+			if name == "tag" {
+				f.usesTag = true
+			}
+		case isTagPartPlaceholder(name):
+			if _, ok := tagPartIndex(name); !ok {
+				return nil, fmt.Errorf("invalid objectKeyFormat: invalid tag index %%{%s}", name)
+			}
+			f.usesTag = true
+		case strings.HasPrefix(name, "$."):
+			if len(recordKeyPath(name)) == 0 {
+				return nil, fmt.Errorf("invalid objectKeyFormat: empty record accessor %%{%s}", name)
+			}
+			if f.recordKeyIndex(name) < 0 {
+				f.recordKeys = append(f.recordKeys, name)
+			}
+		default:
+			return nil, fmt.Errorf("invalid objectKeyFormat: unknown placeholder %%{%s}", name)
+		}
+		i += end
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	f.hostname = hostname
+
+	return f, nil
+}
+
+func (f *objectKeyFormatter) render(s3operator *s3operator, p partition, t time.Time, lines string) string {
+	if s3operator.location != nil {
+		t = t.In(s3operator.location)
+	}
+
+	var b strings.Builder
+	format := f.format
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		if format[i+1] != '{' {
+			b.WriteString(strftime(format[i+1], t))
+			i++
+			continue
+		}
+		end := strings.IndexByte(format[i:], '}')
+		name := format[i+2 : i+end]
+		i += end
+
+		switch name {
+		case "path":
+			b.WriteString(s3operator.prefix)
+		case "tag":
+			b.WriteString(p.tag)
+		case "time_slice":
+			b.WriteString(t.Format(s3operator.timeFormat))
+		case "timestamp":
+			b.WriteString(t.Format("20060102150405"))
+		case "index":
+			b.WriteString(objectKeyIndexMarker)
+		case "hostname":
+			b.WriteString(f.hostname)
+		case "uuid":
+			b.WriteString(newUUID())
+		case "hash":
+			b.WriteString(sha256Hex([]byte(lines)))
+		case "file_extension":
+			b.WriteString(strings.TrimPrefix(objectExtension(s3operator), "."))
+		default:
+			if isTagPartPlaceholder(name) {
+				b.WriteString(tagPart(p.tag, name))
+			} else if n := f.recordKeyIndex(name); n >= 0 {
+				// Batches staged before the format was changed may not hold the value.
+				if values := strings.Split(p.values, partitionValueSeparator); n < len(values) {
+					b.WriteString(values[n])
+				}
+			}
+		}
+	}
+
+	objectKey := strings.TrimLeft(b.String(), "/")
+	if strings.Contains(objectKey, objectKeyIndexMarker) {
+		objectKey = f.renderIndex(s3operator, objectKey)
+	}
+	return objectKey
+}
+
+// renderIndex replaces %{index} in key with the next sequence number. As fluent-plugin-s3
+// does, numbers whose object already exists in the bucket are skipped, so that objects
+// uploaded before a restart are not overwritten. If the bucket cannot be checked, the
+// number is used as is.
+func (f *objectKeyFormatter) renderIndex(s3operator *s3operator, key string) string {
+	for {
+		objectKey := strings.Replace(key, objectKeyIndexMarker, strconv.Itoa(f.nextIndex(key)), -1)
+		exists, err := s3operator.objectExists(objectKey)
+		if err != nil {
+			s3operator.logger.Warnf("[s3operator] cannot check whether %s exists: %v", objectKey, err)
+			return objectKey
+		}
+		if !exists {
+			return objectKey
+		}
+	}
+}
+
+// timeSlice renders only the time dependent placeholders of the format except
+// %{timestamp}, so that records sharing a time slice share an object.
+func (f *objectKeyFormatter) timeSlice(s3operator *s3operator, t time.Time) string {
+	if s3operator.location != nil {
+		t = t.In(s3operator.location)
+	}
+
+	var b strings.Builder
+	format := f.format
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		if format[i+1] != '{' {
+			b.WriteString(strftime(format[i+1], t))
+			i++
+			continue
+		}
+		end := strings.IndexByte(format[i:], '}')
+		if format[i+2:i+end] == "time_slice" {
+			b.WriteString(t.Format(s3operator.timeFormat))
+		}
+		b.WriteByte('/')
+		i += end
+	}
+	return b.String()
+}
+
+// partitionOf returns the partition of a record with tag. It only holds what the
+// format refers to, so records which differ in anything else share an object.
+// Values of record keys are redacted by r as the record is, after filter renames its keys.
+func (f *objectKeyFormatter) partitionOf(tag string, record map[interface{}]interface{}, filter *recordFilter, r *redactor) partition {
+	var p partition
+	if f == nil {
+		return p
+	}
+	if f.usesTag {
+		p.tag = tag
+	}
+	if len(f.recordKeys) > 0 {
+		values := make([]string, len(f.recordKeys))
+		for i, key := range f.recordKeys {
+			path := recordKeyPath(key)
+			values[i] = r.redactKeyValue(filter.keyPaths(path), recordKeyValue(record, path))
+		}
+		p.values = strings.Join(values, partitionValueSeparator)
+	}
+	return p
+}
+
+func (f *objectKeyFormatter) recordKeyIndex(name string) int {
+	for i, key := range f.recordKeys {
+		if key == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordKeyPath splits a record accessor such as $.kubernetes.namespace_name into its keys.
+func recordKeyPath(name string) []string {
+	var path []string
+	for _, key := range strings.Split(strings.TrimPrefix(name, "$."), ".") {
+		if key == "" {
+			return nil
+		}
+		path = append(path, key)
+	}
+	return path
+}
+
+// recordKeyValue returns the value at path in record, or an empty string when the
+// value is missing or is not a scalar.
+func recordKeyValue(record map[interface{}]interface{}, path []string) string {
+	value, ok := recordValue(record, path)
+	if !ok {
+		return ""
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case map[interface{}]interface{}, []interface{}, nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// isTagPartPlaceholder reports whether name is tag[N] or tag_parts[N] of fluent-plugin-s3.
+func isTagPartPlaceholder(name string) bool {
+	return (strings.HasPrefix(name, "tag[") || strings.HasPrefix(name, "tag_parts[")) && strings.HasSuffix(name, "]")
+}
+
+func tagPartIndex(name string) (int, bool) {
+	n, err := strconv.Atoi(name[strings.IndexByte(name, '[')+1 : len(name)-1])
+	return n, err == nil
+}
+
+// tagPart returns the part of tag split by dots. Negative indexes count from the end.
+func tagPart(tag, name string) string {
+	n, _ := tagPartIndex(name)
+	parts := strings.Split(tag, ".")
+	if n < 0 {
+		n += len(parts)
+	}
+	if n < 0 || n >= len(parts) {
+		return ""
+	}
+	return parts[n]
+}
+
+// objectExists reports whether objectKey exists in the bucket. Without a client,
+// as in tests of the formatter, nothing exists.
+func (s3operator *s3operator) objectExists(objectKey string) (bool, error) {
+	if s3operator.client == nil {
+		return false, nil
+	}
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s3operator.bucket),
+		Key:    aws.String(objectKey),
+	}
+	s3operator.sse.applyHead(input)
+	_, err := s3operator.client.HeadObjectWithContext(aws.BackgroundContext(), input)
+	if err == nil {
+		return true, nil
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+		return false, nil
+	}
+	return false, err
+}
+
+// nextIndex returns a sequence number which is unique among objects sharing the same key
+// other than %{index}. The sequence is kept in memory and starts over from 0 on restart.
+// renderIndex skips the numbers which were used before the restart.
+func (f *objectKeyFormatter) nextIndex(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if len(f.indexes) >= maxObjectKeyIndexes {
+		for k, index := range f.indexes {
+			if now.Sub(index.lastUsed) > 24*time.Hour {
+				delete(f.indexes, k)
+			}
+		}
+	}
+
+	index, ok := f.indexes[key]
+	if !ok {
+		index = &objectKeyIndex{}
+		f.indexes[key] = index
+	}
+	n := index.next
+	index.next++
+	index.lastUsed = now
+	return n
+}
+
+func strftime(directive byte, t time.Time) string {
+	switch directive {
+	case 'Y':
+		return fmt.Sprintf("%04d", t.Year())
+	case 'm':
+		return fmt.Sprintf("%02d", int(t.Month()))
+	case 'd':
+		return fmt.Sprintf("%02d", t.Day())
+	case 'H':
+		return fmt.Sprintf("%02d", t.Hour())
+	case 'M':
+		return fmt.Sprintf("%02d", t.Minute())
+	case 'S':
+		return fmt.Sprintf("%02d", t.Second())
+	case 'y':
+		return fmt.Sprintf("%02d", t.Year()%100)
+	case 'j':
+		return fmt.Sprintf("%03d", t.YearDay())
+	case 'b':
+		return t.Format("Jan")
+	case 's':
+		return strconv.FormatInt(t.Unix(), 10)
+	case 'L':
+		return fmt.Sprintf("%03d", t.Nanosecond()/int(time.Millisecond))
+	case 'z':
+		return t.Format("-0700")
+	case 'Z':
+		return t.Format("MST")
+	}
+	return "%"
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		// crypto/rand does not fail on supported platforms.
+		panic(err)
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewObjectKeyFormatterWithInvalidFormat(t *testing.T) {
+	for _, format := range []string{
+		"%{path}/%{unknown}",
+		"%{path}/%{tag",
+		"%{path}/%Q",
+		"%{path}/%",
+		"%{tag[x]}",
+		"%{tag_parts[]}",
+		"%{$.}",
+		"%{$.kubernetes..namespace_name}",
+	} {
+		_, err := newObjectKeyFormatter(format)
+		assert.NotNil(t, err, "%s is invalid", format)
+	}
+}
+
+func TestObjectKeyFormatterRender(t *testing.T) {
+	f, err := newObjectKeyFormatter("%{path}/tag=%{tag}/dt=%Y-%m-%d/hour=%H/%{index}.%{file_extension}")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.True(t, f.usesTag)
+
+	s3mock := &s3operator{
+		prefix:         "logs",
+		compressFormat: gzipFormat,
+		location:       time.UTC,
+	}
+	ts := time.Date(2019, time.March, 10, 10, 11, 12, 0, time.UTC)
+	p := partition{tag: "app.access"}
+
+	assert.Equal(t, "logs/tag=app.access/dt=2019-03-10/hour=10/0.log.gz", f.render(s3mock, p, ts, "exampletext"))
+	assert.Equal(t, "logs/tag=app.access/dt=2019-03-10/hour=10/1.log.gz", f.render(s3mock, p, ts, "exampletext"))
+	assert.Equal(t, "logs/tag=app.error/dt=2019-03-10/hour=10/0.log.gz", f.render(s3mock, partition{tag: "app.error"}, ts, "exampletext"),
+		"index is counted for each key")
+}
+
+func TestObjectKeyFormatterRenderSkipsExistingIndexes(t *testing.T) {
+	f, err := newObjectKeyFormatter("%{path}/%{tag}/%{index}.log")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+
+	svc := newFakeS3()
+	svc.objects["logs/app/0.log"] = []byte("uploaded before the restart")
+	svc.objects["logs/app/1.log"] = []byte("uploaded before the restart")
+	s3mock := &s3operator{
+		bucket:   "examplebucket",
+		prefix:   "logs",
+		location: time.UTC,
+		client:   svc,
+	}
+	ts := time.Date(2019, time.March, 10, 10, 11, 12, 0, time.UTC)
+
+	assert.Equal(t, "logs/app/2.log", f.render(s3mock, partition{tag: "app"}, ts, "exampletext"))
+	assert.Equal(t, "logs/app/3.log", f.render(s3mock, partition{tag: "app"}, ts, "exampletext"))
+	assert.Equal(t, "logs/web/0.log", f.render(s3mock, partition{tag: "web"}, ts, "exampletext"))
+}
+
+func TestObjectKeyFormatterRenderPlaceholders(t *testing.T) {
+	f, err := newObjectKeyFormatter("%{hostname}/%{time_slice}/%{timestamp}-%{hash}/%{uuid}%%")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.False(t, f.usesTag)
+
+	loc, _ := time.LoadLocation("Asia/Tokyo")
+	s3mock := &s3operator{
+		timeFormat: "20060102/15",
+		location:   loc,
+	}
+	ts := time.Date(2019, time.March, 10, 10, 11, 12, 0, time.UTC)
+	hostname, _ := os.Hostname()
+
+	objectKey := f.render(s3mock, partition{}, ts, "exampletext")
+	expected := regexp.MustCompile("^" + regexp.QuoteMeta(hostname) +
+		"/20190310/19/20190310191112-c675f9cd0e59479e5ccca3ea8a03beccd80f662f6a56662bfc9dd0b61d4f73c3/" +
+		"[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}%$")
+	assert.Regexp(t, expected, objectKey)
+}
+
+func TestGenerateObjectKeyWithObjectKeyFormat(t *testing.T) {
+	f, err := newObjectKeyFormatter("%{path}/%Y/%{tag}.%{file_extension}")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	s3mock := &s3operator{
+		prefix:       "/logs",
+		location:     time.UTC,
+		outputFormat: parquetOutputFormat,
+		keyFormatter: f,
+	}
+	ts := time.Date(2019, time.March, 10, 10, 11, 12, 0, time.UTC)
+
+	objectKey := GenerateObjectKey(s3mock, partition{tag: "app"}, ts, "exampletext")
+	assert.Equal(t, "logs/2019/app.parquet", objectKey, "leading slashes are trimmed")
+}
+
+func TestObjectKeyFormatterRenderTagParts(t *testing.T) {
+	f, err := newObjectKeyFormatter("%{tag[0]}/%{tag_parts[1]}/%{tag[-1]}/%{tag[5]}")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.True(t, f.usesTag)
+
+	s3mock := &s3operator{location: time.UTC}
+	p := f.partitionOf("kube.var.log.containers", nil, nil, nil)
+	assert.Equal(t, "kube/var/containers/", f.render(s3mock, p, time.Now(), "exampletext"))
+}
+
+func TestObjectKeyFormatterPartitionOf(t *testing.T) {
+	f, err := newObjectKeyFormatter("%{path}/%{$.kubernetes.namespace_name}/%{$.kubernetes.labels.app}/%{$.status}/%{$.kubernetes.namespace_name}.log")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.False(t, f.usesTag)
+	assert.Equal(t, []string{"$.kubernetes.namespace_name", "$.kubernetes.labels.app", "$.status"}, f.recordKeys)
+
+	record := map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{
+			"namespace_name": []byte("default"),
+			"labels":         map[interface{}]interface{}{"app": "nginx"},
+		},
+		"status": 200,
+	}
+	p := f.partitionOf("kube.var.log", record, nil, nil)
+	assert.Equal(t, "", p.tag, "tag is not a part of the partition unless the format refers to it")
+
+	s3mock := &s3operator{prefix: "logs", location: time.UTC}
+	assert.Equal(t, "logs/default/nginx/200/default.log", f.render(s3mock, p, time.Now(), "exampletext"))
+
+	missing := f.partitionOf("kube.var.log", map[interface{}]interface{}{"kubernetes": "flat"}, nil, nil)
+	assert.NotEqual(t, p, missing)
+	assert.Equal(t, "logs////.log", f.render(s3mock, missing, time.Now(), "exampletext"))
+
+	var nilFormatter *objectKeyFormatter
+	assert.Equal(t, partition{}, nilFormatter.partitionOf("kube.var.log", record, nil, nil))
+}
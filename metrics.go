@@ -0,0 +1,300 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+const metricsNamespace = "fluentbit_go_s3"
+
+var metricsLabels = []string{"operator", "bucket"}
+
+var (
+	recordsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_total",
+		Help:      "Number of records formatted for S3.",
+	}, metricsLabels)
+	recordsDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_dropped_total",
+		Help:      "Number of records dropped by IncludeRecords and ExcludeRecords.",
+	}, metricsLabels)
+	redactionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redactions_total",
+		Help:      "Number of values masked or hashed by rule.",
+	}, append(metricsLabels, "rule"))
+	uncompressedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uncompressed_bytes_total",
+		Help:      "Bytes of uploaded objects before compression.",
+	}, metricsLabels)
+	compressedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "compressed_bytes_total",
+		Help:      "Bytes of uploaded objects after compression.",
+	}, metricsLabels)
+	objectsUploadedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "objects_uploaded_total",
+		Help:      "Number of objects uploaded to S3.",
+	}, metricsLabels)
+	uploadDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Latency of each attempt to upload an object or a part.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, metricsLabels)
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retries_total",
+		Help:      "Number of uploads retried in the plugin.",
+	}, metricsLabels)
+	uploadFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_failures_total",
+		Help:      "Number of failed upload attempts by AWS error code.",
+	}, append(metricsLabels, "code"))
+	multipartUploadsAbortedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "multipart_uploads_aborted_total",
+		Help:      "Number of incomplete multipart uploads aborted by the plugin.",
+	}, metricsLabels)
+	queueDepthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "queue_depth"),
+		"Number of batches waiting for upload workers.",
+		metricsLabels, nil,
+	)
+)
+
+// metricsRegistry holds the metrics of all s3operators. It is served on MetricsAddress.
+var metricsRegistry = newMetricsRegistry()
+
+func newMetricsRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		recordsTotal,
+		recordsDroppedTotal,
+		redactionsTotal,
+		uncompressedBytesTotal,
+		compressedBytesTotal,
+		objectsUploadedTotal,
+		uploadDurationSeconds,
+		retriesTotal,
+		uploadFailuresTotal,
+		multipartUploadsAbortedTotal,
+		operatorCollector{},
+	)
+	return r
+}
+
+// operatorMetrics are the metrics of an s3operator. A nil operatorMetrics records nothing.
+type operatorMetrics struct {
+	labels       []string
+	records      prometheus.Counter
+	drops        prometheus.Counter
+	uncompressed prometheus.Counter
+	compressed   prometheus.Counter
+	objects      prometheus.Counter
+	duration     prometheus.Observer
+	retries      prometheus.Counter
+	aborted      prometheus.Counter
+}
+
+func newOperatorMetrics(operatorID int, bucket string) *operatorMetrics {
+	labels := []string{strconv.Itoa(operatorID), bucket}
+	return &operatorMetrics{
+		labels:       labels,
+		records:      recordsTotal.WithLabelValues(labels...),
+		drops:        recordsDroppedTotal.WithLabelValues(labels...),
+		uncompressed: uncompressedBytesTotal.WithLabelValues(labels...),
+		compressed:   compressedBytesTotal.WithLabelValues(labels...),
+		objects:      objectsUploadedTotal.WithLabelValues(labels...),
+		duration:     uploadDurationSeconds.WithLabelValues(labels...),
+		retries:      retriesTotal.WithLabelValues(labels...),
+		aborted:      multipartUploadsAbortedTotal.WithLabelValues(labels...),
+	}
+}
+
+func (m *operatorMetrics) formatted(records int) {
+	if m == nil {
+		return
+	}
+	m.records.Add(float64(records))
+}
+
+// dropped records the records which the record filter dropped.
+func (m *operatorMetrics) dropped(records int) {
+	if m == nil {
+		return
+	}
+	m.drops.Add(float64(records))
+}
+
+// redacted records the redactions of records by rule.
+func (m *operatorMetrics) redacted(counts map[string]int) {
+	if m == nil {
+		return
+	}
+	for rule, n := range counts {
+		redactionsTotal.WithLabelValues(append(append([]string{}, m.labels...), rule)...).Add(float64(n))
+	}
+}
+
+// attempted records an attempt to upload lines which took d.
+func (m *operatorMetrics) attempted(lines string, d time.Duration, err error) {
+	m.requested(d, err)
+	if err == nil {
+		m.uploaded(len(lines))
+	}
+}
+
+// requested records an attempt to upload an object or a part which took d.
+func (m *operatorMetrics) requested(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.duration.Observe(d.Seconds())
+	if err != nil {
+		uploadFailuresTotal.WithLabelValues(append(append([]string{}, m.labels...), errorCode(err))...).Inc()
+	}
+}
+
+// errorCode returns the code of the innermost AWS error which caused err, so that a
+// failed part of a multipart upload is counted by its own code instead of MultipartUpload.
+func errorCode(err error) string {
+	code := "Unknown"
+	for _, cause := range errorCauses(err) {
+		if aerr, ok := cause.(awserr.Error); ok {
+			code = aerr.Code()
+		}
+	}
+	return code
+}
+
+// uploaded records an object of size bytes before compression.
+func (m *operatorMetrics) uploaded(size int) {
+	if m == nil {
+		return
+	}
+	m.objects.Inc()
+	m.uncompressed.Add(float64(size))
+}
+
+// compressedBody records the size of an uploaded object body.
+func (m *operatorMetrics) compressedBody(size int) {
+	if m == nil {
+		return
+	}
+	m.compressed.Add(float64(size))
+}
+
+func (m *operatorMetrics) retried() {
+	if m == nil {
+		return
+	}
+	m.retries.Inc()
+}
+
+func (m *operatorMetrics) abortedUpload() {
+	if m == nil {
+		return
+	}
+	m.aborted.Inc()
+}
+
+// operatorCollector reports the metrics which are read from s3operators on each scrape.
+type operatorCollector struct{}
+
+func (c operatorCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (c operatorCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s3operator := range s3operators {
+		if s3operator.metrics == nil || s3operator.workers == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(s3operator.workers.pending()), s3operator.metrics.labels...)
+	}
+}
+
+// metricsHandler serves the metrics in the text format of Prometheus.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	encoder := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return
+		}
+	}
+}
+
+// httpServer is a listener shared by the endpoints of s3operators which specify the same address.
+type httpServer struct {
+	server   *http.Server
+	mux      *http.ServeMux
+	patterns map[string]bool
+}
+
+var (
+	httpServersMutex sync.Mutex
+	httpServers      = make(map[string]*httpServer)
+)
+
+// serveHTTP starts to serve handler for pattern on address. Endpoints are served
+// once per address even if several s3operators specify them.
+func serveHTTP(address, pattern string, handler http.HandlerFunc) error {
+	httpServersMutex.Lock()
+	defer httpServersMutex.Unlock()
+
+	s, ok := httpServers[address]
+	if !ok {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		s = &httpServer{
+			server:   &http.Server{Handler: mux},
+			mux:      mux,
+			patterns: make(map[string]bool),
+		}
+		httpServers[address] = s
+		go s.server.Serve(listener)
+	}
+	if !s.patterns[pattern] {
+		s.mux.HandleFunc(pattern, handler)
+		s.patterns[pattern] = true
+	}
+	return nil
+}
+
+// serveMetrics starts to serve /metrics on address.
+func serveMetrics(address string) error {
+	return serveHTTP(address, "/metrics", metricsHandler)
+}
+
+// closeHTTPServers stops the listeners started by serveHTTP.
+func closeHTTPServers() {
+	httpServersMutex.Lock()
+	defer httpServersMutex.Unlock()
+
+	for address, s := range httpServers {
+		s.server.Close()
+		delete(httpServers, address)
+	}
+}
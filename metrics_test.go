@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/fluent/fluent-bit-go/output"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeMetrics(t *testing.T) string {
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	return recorder.Body.String()
+}
+
+// metricValue returns the value of the counter, the gauge or the count of the histogram
+// name in metricsRegistry whose labels include labels. Metrics are shared by the tests
+// of the package, so that tests compare the values before and after they record them.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			matched := 0
+			for _, pair := range m.GetLabel() {
+				if value, ok := labels[pair.GetName()]; ok && value == pair.GetValue() {
+					matched++
+				}
+			}
+			if matched != len(labels) {
+				continue
+			}
+			switch {
+			case m.Counter != nil:
+				return m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				return m.GetGauge().GetValue()
+			case m.Histogram != nil:
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestPluginFlusherRecordsMetrics(t *testing.T) {
+	testplugin := &failingPlugin{
+		testFluentPlugin: &testFluentPlugin{},
+		errs: []error{
+			awserr.New("SlowDown", "Please reduce your request rate.", nil),
+		},
+	}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"mykey": "myvalue"})
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"mykey": "myvalue"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3operators = []*s3operator{{
+		bucket:    "metricsbucket",
+		logger:    newLogger(log.InfoLevel),
+		location:  time.UTC,
+		formatter: &jsonFormatter{},
+		retry:     &retryConfig{maxRetries: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond},
+		metrics:   newOperatorMetrics(0, "metricsbucket"),
+	}}
+
+	labels := map[string]string{"operator": "0", "bucket": "metricsbucket"}
+	failureLabels := map[string]string{"operator": "0", "bucket": "metricsbucket", "code": "SlowDown"}
+	expected := map[string]float64{
+		"fluentbit_go_s3_records_total":            2,
+		"fluentbit_go_s3_objects_uploaded_total":   1,
+		"fluentbit_go_s3_uncompressed_bytes_total": 40,
+		"fluentbit_go_s3_retries_total":            1,
+		"fluentbit_go_s3_upload_duration_seconds":  2,
+	}
+	before := make(map[string]float64)
+	for name := range expected {
+		before[name] = metricValue(t, name, labels)
+	}
+	failuresBefore := metricValue(t, "fluentbit_go_s3_upload_failures_total", failureLabels)
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+
+	for name, delta := range expected {
+		assert.Equal(t, delta, metricValue(t, name, labels)-before[name], name)
+	}
+	assert.Equal(t, float64(1), metricValue(t, "fluentbit_go_s3_upload_failures_total", failureLabels)-failuresBefore)
+
+	metrics := scrapeMetrics(t)
+	assert.Contains(t, metrics, `fluentbit_go_s3_records_total{bucket="metricsbucket",operator="0"} `)
+	assert.Contains(t, metrics, `fluentbit_go_s3_upload_duration_seconds_count{bucket="metricsbucket",operator="0"} `)
+}
+
+func TestMetricsErrorCode(t *testing.T) {
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "id")
+	assert.Equal(t, "SlowDown", errorCode(slowDown))
+	assert.Equal(t, "SlowDown", errorCode(multipartUploadError(t, slowDown)), "the failed part is counted by its own code")
+	assert.Equal(t, "Unknown", errorCode(errors.New("connection reset")))
+
+	m := newOperatorMetrics(0, "errorcodebucket")
+	failureLabels := map[string]string{"bucket": "errorcodebucket", "code": "SlowDown"}
+	failuresBefore := metricValue(t, "fluentbit_go_s3_upload_failures_total", failureLabels)
+	m.requested(time.Second, multipartUploadError(t, slowDown))
+	assert.Equal(t, float64(1), metricValue(t, "fluentbit_go_s3_upload_failures_total", failureLabels)-failuresBefore)
+}
+
+func TestMetricsQueueDepth(t *testing.T) {
+	uploads := newBlockingUploads()
+	workers := newUploadWorkers(&workerConfig{workers: 1, queueSize: 4}, uploads.upload, isPermanentError, func(*batch, error, bool) {})
+	s3operators = []*s3operator{{
+		bucket:  "queuebucket",
+		workers: workers,
+		metrics: newOperatorMetrics(0, "queuebucket"),
+	}}
+
+	workers.offer(&batch{lines: "line1\n"})
+	<-uploads.started
+	workers.offer(&batch{lines: "line2\n"}, &batch{lines: "line3\n"})
+	assert.Contains(t, scrapeMetrics(t), `fluentbit_go_s3_queue_depth{bucket="queuebucket",operator="0"} 2`)
+
+	close(uploads.release)
+	workers.close()
+	assert.Contains(t, scrapeMetrics(t), `fluentbit_go_s3_queue_depth{bucket="queuebucket",operator="0"} 0`)
+}
+
+func TestServeMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	defer closeHTTPServers()
+	if err := serveMetrics(address); err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, serveMetrics(address), "operators share the listener of an address")
+
+	s3operators = nil
+	newOperatorMetrics(0, "servebucket")
+	res, err := http.Get("http://" + address + "/metrics")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, string(body), "# TYPE fluentbit_go_s3_records_total counter")
+}
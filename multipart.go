@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// maxPartSize is the largest part which S3 accepts.
+const maxPartSize = 5 * 1024 * 1024 * 1024
+
+// multipartConfig describes how large objects are uploaded in parts.
+type multipartConfig struct {
+	partSize int64
+	// concurrency is the number of parts which the uploader sends at once.
+	concurrency int
+	// streaming uploads buffered records as parts while they arrive.
+	streaming bool
+}
+
+func getMultipartConfig(partSize, uploadConcurrency, streaming string) (*multipartConfig, error) {
+	conf := &multipartConfig{
+		partSize:    s3manager.DefaultUploadPartSize,
+		concurrency: s3manager.DefaultUploadConcurrency,
+	}
+
+	if partSize != "" {
+		size, err := parseSize(partSize)
+		if err != nil || size < s3manager.MinUploadPartSize || size > maxPartSize {
+			return nil, fmt.Errorf("invalid partSize: %v (5M-5G)", partSize)
+		}
+		conf.partSize = size
+	}
+
+	if uploadConcurrency != "" {
+		n, err := strconv.Atoi(uploadConcurrency)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid uploadConcurrency: %v", uploadConcurrency)
+		}
+		conf.concurrency = n
+	}
+
+	if streaming != "" {
+		isStreaming, err := strconv.ParseBool(streaming)
+		if err != nil {
+			return nil, fmt.Errorf("invalid streaming: %v", streaming)
+		}
+		conf.streaming = isStreaming
+	}
+
+	return conf, nil
+}
+
+// multipartStream uploads the records of a partition as the parts of a multipart
+// upload while they arrive, so that at most one part is held in memory.
+type multipartStream struct {
+	partition partition
+	eventTime time.Time
+	objectKey string
+	uploadID  string
+	createdAt time.Time
+	// writer compresses records into part.
+	writer  io.WriteCloser
+	part    bytes.Buffer
+	parts   []*s3.CompletedPart
+	records int
+	size    int
+	// closed is set once the writer is closed and only the completion is left.
+	closed bool
+	// file and files are the staging files holding the records when StoreDir is specified.
+	file    *os.File
+	files   []string
+	journal string
+}
+
+func (s3operator *s3operator) streaming() bool {
+	return s3operator.streams != nil
+}
+
+// streamBatch writes b into the stream of its partition and returns the number of
+// bytes written into the stream before compression.
+func (s3operator *s3operator) streamBatch(b *batch) (int, error) {
+	s3operator.uploadMutex.Lock()
+	defer s3operator.uploadMutex.Unlock()
+
+	s := s3operator.streams[b.partition]
+	if s != nil && s.closed {
+		// The previous object of the partition must be completed before the next one starts.
+		if err := s3operator.completeStream(s); err != nil {
+			return 0, err
+		}
+		s = nil
+	}
+	if s == nil {
+		var err error
+		if s, err = s3operator.startStream(b); err != nil {
+			return 0, err
+		}
+		s3operator.streams[b.partition] = s
+	}
+
+	if s3operator.store != nil {
+		if s.file == nil {
+			f, err := s3operator.store.create(s.partition, s.eventTime)
+			if err != nil {
+				return s.size, err
+			}
+			s.file = f
+			s.files = append(s.files, f.Name())
+		}
+		if err := s3operator.store.write(s.file, b.lines); err != nil {
+			return s.size, err
+		}
+	}
+	if _, err := io.WriteString(s.writer, b.lines); err != nil {
+		return s.size, err
+	}
+	s.records += b.records
+	s.size += len(b.lines)
+
+	if int64(s.part.Len()) < s3operator.multipart.partSize {
+		return s.size, nil
+	}
+	if err := s3operator.uploadPart(s); err != nil {
+		if s3operator.givesUp(err) {
+			s3operator.abandonStream(s, err)
+			return 0, nil
+		}
+		// The records were accepted, so the part is kept and sent with the next records.
+		s3operator.logger.Warnf("error uploading part %d of %s, retrying with the next records: %v", len(s.parts)+1, s.objectKey, err)
+		return s.size, nil
+	}
+	if len(s.parts) >= s3manager.MaxUploadParts-1 {
+		// The last part is left for the rest of the records.
+		return s.size, s3operator.completeStream(s)
+	}
+	return s.size, nil
+}
+
+// startStream starts the multipart upload of the object which b begins.
+func (s3operator *s3operator) startStream(b *batch) (*multipartStream, error) {
+	s := &multipartStream{
+		partition: b.partition,
+		eventTime: b.eventTime,
+		objectKey: GenerateObjectKey(s3operator, b.partition, s3operator.objectTime(b), b.lines),
+		createdAt: time.Now(),
+	}
+	writer, err := codecs[s3operator.compressFormat].newWriter(&s.part, s3operator.compressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	s.writer = writer
+
+	// Uploads of s3manager copy the attributes from UploadInput in the same way.
+	input := &s3.CreateMultipartUploadInput{}
+	awsutil.Copy(input, newUploadInput(s3operator, s.objectKey, nil))
+	err = s3operator.withRetries(func() error {
+		output, err := s3operator.client.CreateMultipartUploadWithContext(aws.BackgroundContext(), input, s3operator.sse.requestOptions()...)
+		if err == nil {
+			s.uploadID = aws.StringValue(output.UploadId)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s3operator.uploads.started(s.uploadID, s.objectKey)
+
+	if s3operator.store != nil {
+		journal, err := s3operator.store.journal(&multipartUpload{Key: s.objectKey, UploadID: s.uploadID})
+		if err != nil {
+			s3operator.abortUpload(s.objectKey, s.uploadID)
+			return nil, err
+		}
+		s.journal = journal
+	}
+	return s, nil
+}
+
+// uploadPart uploads the compressed data of s as its next part.
+func (s3operator *s3operator) uploadPart(s *multipartStream) error {
+	body := s.part.Bytes()
+	input := &s3.UploadPartInput{
+		Bucket:     aws.String(s3operator.bucket),
+		Key:        aws.String(s.objectKey),
+		UploadId:   aws.String(s.uploadID),
+		PartNumber: aws.Int64(int64(len(s.parts) + 1)),
+	}
+	s3operator.sse.applyPart(input)
+
+	var etag *string
+	err := s3operator.withRetries(func() error {
+		input.Body = bytes.NewReader(body)
+		started := time.Now()
+		output, err := s3operator.client.UploadPartWithContext(aws.BackgroundContext(), input, s3operator.integrity.requestOptions()...)
+		s3operator.metrics.requested(time.Since(started), err)
+		if err != nil {
+			return err
+		}
+		etag = output.ETag
+		return s3operator.verifyPart(s.objectKey, *input.PartNumber, body, output)
+	})
+	if err != nil {
+		return err
+	}
+	s.parts = append(s.parts, &s3.CompletedPart{ETag: etag, PartNumber: input.PartNumber})
+	s3operator.metrics.compressedBody(len(body))
+	s.part.Reset()
+	return nil
+}
+
+// completeStream uploads the rest of s and completes its object. When it fails
+// and the error is not given up, s is kept to complete it later.
+func (s3operator *s3operator) completeStream(s *multipartStream) error {
+	if !s.closed {
+		if err := s.writer.Close(); err != nil {
+			return err
+		}
+		s.closed = true
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+	}
+
+	if s.part.Len() > 0 || len(s.parts) == 0 {
+		if err := s3operator.uploadPart(s); err != nil {
+			return s3operator.streamFailed(s, err)
+		}
+	}
+	err := s3operator.withRetries(func() error {
+		_, err := s3operator.client.CompleteMultipartUploadWithContext(aws.BackgroundContext(), &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s3operator.bucket),
+			Key:             aws.String(s.objectKey),
+			UploadId:        aws.String(s.uploadID),
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: s.parts},
+		})
+		return err
+	})
+	if err != nil {
+		return s3operator.streamFailed(s, err)
+	}
+
+	delete(s3operator.streams, s.partition)
+	s3operator.uploads.finished(s.uploadID)
+	s3operator.metrics.uploaded(s.size)
+	s3operator.logger.Debugf("[s3operator] uploaded %d records (%d bytes) to %s in %d parts", s.records, s.size, s.objectKey, len(s.parts))
+	if s3operator.store != nil {
+		return s3operator.store.remove(append(s.files, s.journal))
+	}
+	return nil
+}
+
+func (s3operator *s3operator) streamFailed(s *multipartStream, err error) error {
+	if !s3operator.givesUp(err) {
+		return err
+	}
+	s3operator.abandonStream(s, err)
+	return nil
+}
+
+// abandonStream aborts the multipart upload of s. When StoreDir is specified, its
+// records are read from the staging files and uploaded as a batch instead.
+func (s3operator *s3operator) abandonStream(s *multipartStream, cause error) {
+	delete(s3operator.streams, s.partition)
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err := s3operator.abortUpload(s.objectKey, s.uploadID); err != nil {
+		s3operator.logger.Warnf("error aborting multipart upload %s of %s: %v", s.uploadID, s.objectKey, err)
+	} else if s.journal != "" {
+		s3operator.store.remove([]string{s.journal})
+	}
+
+	b := &batch{
+		partition: s.partition,
+		eventTime: s.eventTime,
+		records:   s.records,
+		createdAt: s.createdAt,
+		files:     s.files,
+		objectKey: s.objectKey,
+	}
+	if len(b.files) > 0 {
+		lines, err := s3operator.store.read(b.files)
+		if err != nil {
+			s3operator.logger.Errorf("error sending message for S3, %d records are kept in %s for the next start: %v", b.records, s3operator.store.dir, cause)
+			return
+		}
+		b.lines = lines
+	}
+	if b.lines == "" {
+		s3operator.logger.Errorf("error sending message for S3, %d records are dropped: %v", b.records, cause)
+		return
+	}
+	if err := s3operator.uploadBatch(b); err != nil {
+		s3operator.uploadFailed(b, err, false)
+	}
+}
+
+// flushStream completes the stream of p.
+func (s3operator *s3operator) flushStream(p partition) error {
+	s3operator.uploadMutex.Lock()
+	defer s3operator.uploadMutex.Unlock()
+
+	s, ok := s3operator.streams[p]
+	if !ok {
+		return nil
+	}
+	return s3operator.completeStream(s)
+}
+
+// flushStreams completes the streams which are older than UploadTimeout, and the
+// streams which failed to be completed before.
+func (s3operator *s3operator) flushStreams(now time.Time) {
+	s3operator.uploadMutex.Lock()
+	defer s3operator.uploadMutex.Unlock()
+
+	for _, s := range s3operator.streams {
+		if !s.closed && now.Sub(s.createdAt) < s3operator.uploadTimeout {
+			continue
+		}
+		if err := s3operator.completeStream(s); err != nil {
+			s3operator.logger.Warnf("error sending message for S3: %v", err)
+		}
+	}
+}
+
+// closeStreams completes every stream on exit. Streams which cannot be completed
+// are abandoned, so that no multipart upload is left behind.
+func (s3operator *s3operator) closeStreams() {
+	s3operator.uploadMutex.Lock()
+	defer s3operator.uploadMutex.Unlock()
+
+	for _, s := range s3operator.streams {
+		if err := s3operator.completeStream(s); err != nil {
+			s3operator.abandonStream(s, err)
+		}
+	}
+}
+
+func (s3operator *s3operator) abortUpload(objectKey, uploadID string) error {
+	_, err := s3operator.client.AbortMultipartUploadWithContext(aws.BackgroundContext(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s3operator.bucket),
+		Key:      aws.String(objectKey),
+		UploadId: aws.String(uploadID),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		// It was completed or aborted already.
+		s3operator.uploads.finished(uploadID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s3operator.uploads.finished(uploadID)
+	s3operator.metrics.abortedUpload()
+	return nil
+}
+
+// abortJournaledUploads aborts the multipart uploads which streams left behind at
+// the previous shutdown. Their records are still in staging files, so they are
+// uploaded again by uploadPending. Uploads which cannot be aborted are kept in
+// the journal for the next start.
+func (s3operator *s3operator) abortJournaledUploads() error {
+	paths, err := s3operator.store.journaled()
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		u := &multipartUpload{}
+		if err := json.Unmarshal(data, u); err != nil {
+			s3operator.logger.Warnf("[s3operator] removing broken multipart upload journal %s: %v", path, err)
+			s3operator.store.remove([]string{path})
+			continue
+		}
+		if err := s3operator.abortUpload(u.Key, u.UploadID); err != nil {
+			lastErr = err
+			continue
+		}
+		if err := s3operator.store.remove([]string{path}); err != nil {
+			lastErr = err
+			continue
+		}
+		s3operator.logger.Infof("[s3operator] aborted multipart upload %s of %s left by the previous run", u.UploadID, u.Key)
+	}
+	return lastErr
+}
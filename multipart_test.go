@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/fluent/fluent-bit-go/output"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// multipartS3 keeps multipart uploads in memory.
+type multipartS3 struct {
+	s3iface.S3API
+	uploads   map[string]map[int64][]byte
+	keys      map[string]string
+	objects   map[string][]byte
+	aborted   []string
+	partErrs  []error
+	createIns []*s3.CreateMultipartUploadInput
+}
+
+func newMultipartS3() *multipartS3 {
+	return &multipartS3{
+		uploads: make(map[string]map[int64][]byte),
+		keys:    make(map[string]string),
+		objects: make(map[string][]byte),
+	}
+}
+
+func (m *multipartS3) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	id := fmt.Sprintf("upload-%d", len(m.createIns))
+	m.createIns = append(m.createIns, input)
+	m.uploads[id] = make(map[int64][]byte)
+	m.keys[id] = *input.Key
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (m *multipartS3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	if len(m.partErrs) > 0 {
+		err := m.partErrs[0]
+		m.partErrs = m.partErrs[1:]
+		return nil, err
+	}
+	parts, ok := m.uploads[*input.UploadId]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.", nil)
+	}
+	data, _ := ioutil.ReadAll(input.Body)
+	parts[*input.PartNumber] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", *input.PartNumber))}, nil
+}
+
+func (m *multipartS3) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	parts, ok := m.uploads[*input.UploadId]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.", nil)
+	}
+	var object []byte
+	for _, part := range input.MultipartUpload.Parts {
+		object = append(object, parts[*part.PartNumber]...)
+	}
+	m.objects[*input.Key] = object
+	delete(m.uploads, *input.UploadId)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *multipartS3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	m.aborted = append(m.aborted, *input.UploadId)
+	if _, ok := m.uploads[*input.UploadId]; !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.", nil)
+	}
+	delete(m.uploads, *input.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestGetMultipartConfig(t *testing.T) {
+	conf, err := getMultipartConfig("", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &multipartConfig{partSize: 5 * 1024 * 1024, concurrency: 5}, conf)
+
+	conf, err = getMultipartConfig("64M", "10", "true")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &multipartConfig{partSize: 64 * 1024 * 1024, concurrency: 10, streaming: true}, conf)
+
+	_, err = getMultipartConfig("1M", "", "")
+	assert.Equal(t, errors.New("invalid partSize: 1M (5M-5G)"), err)
+	_, err = getMultipartConfig("6G", "", "")
+	assert.Equal(t, errors.New("invalid partSize: 6G (5M-5G)"), err)
+	_, err = getMultipartConfig("", "0", "")
+	assert.Equal(t, errors.New("invalid uploadConcurrency: 0"), err)
+	_, err = getMultipartConfig("", "", "sometimes")
+	assert.Equal(t, errors.New("invalid streaming: sometimes"), err)
+}
+
+func newStreamingOperator(svc s3iface.S3API, compressFormat format) *s3operator {
+	return &s3operator{
+		bucket:         "examplebucket",
+		prefix:         "exampleprefix",
+		logger:         newLogger(log.InfoLevel),
+		location:       time.UTC,
+		formatter:      &jsonFormatter{},
+		compressFormat: compressFormat,
+		// Parts are far smaller than S3 accepts, so that a few records fill them.
+		multipart:     &multipartConfig{partSize: 64, concurrency: 1, streaming: true},
+		streams:       make(map[partition]*multipartStream),
+		totalFileSize: 1024 * 1024,
+		uploadTimeout: time.Hour,
+		done:          make(chan struct{}),
+		client:        svc,
+	}
+}
+
+func TestPluginFlusherStreamsParts(t *testing.T) {
+	svc := newMultipartS3()
+	testplugin := &testFluentPlugin{}
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3mock := newStreamingOperator(svc, plainTextFormat)
+	s3operators = []*s3operator{s3mock}
+	// Later tests flush into the first operator, which must not be streaming.
+	defer func() { s3operators = nil }()
+
+	var expected bytes.Buffer
+	for i := 0; i < 10; i++ {
+		record := map[interface{}]interface{}{"mykey": fmt.Sprintf("myvalue%d", i)}
+		testplugin.addrecord(0, 0, record)
+		res := FLBPluginFlushCtx(nil, nil, 0, nil)
+		assert.Equal(t, output.FLB_OK, res)
+		fmt.Fprintf(&expected, "{\"mykey\":\"myvalue%d\"}\n", i)
+	}
+
+	assert.Len(t, svc.createIns, 1, "records of a partition are streamed into one object")
+	assert.Len(t, svc.uploads["upload-0"], 2, "parts are uploaded while records arrive")
+	assert.Len(t, svc.objects, 0)
+	assert.True(t, s3mock.streams[partition{}].part.Len() < 64, "only the last part is held in memory")
+
+	assert.Equal(t, output.FLB_OK, FLBPluginExit())
+	assert.Len(t, svc.objects, 1)
+	objectKey := *svc.createIns[0].Key
+	assert.Equal(t, expected.String(), string(svc.objects[objectKey]))
+	assert.Len(t, testplugin.events, 0, "streams do not go through Put")
+	assert.Len(t, s3mock.streams, 0)
+}
+
+func TestStreamCompressesParts(t *testing.T) {
+	svc := newMultipartS3()
+	s3mock := newStreamingOperator(svc, gzipFormat)
+	s3mock.compressionLevel = gzip.DefaultCompression
+	s3mock.totalFileSize = 64 * 1024
+
+	var expected bytes.Buffer
+	for i := 0; expected.Len() < 64*1024; i++ {
+		line := fmt.Sprintf("{\"log\":\"line %d\"}\n", i)
+		expected.WriteString(line)
+		size, err := s3mock.streamBatch(&batch{lines: line, records: 1})
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		if int64(size) >= s3mock.totalFileSize {
+			assert.Nil(t, s3mock.flushStream(partition{}))
+		}
+	}
+
+	assert.Equal(t, "gzip", *svc.createIns[0].ContentEncoding)
+	assert.Len(t, svc.objects, 1)
+	r, err := gzip.NewReader(bytes.NewReader(svc.objects[*svc.createIns[0].Key]))
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	decompressed, _ := ioutil.ReadAll(r)
+	assert.Equal(t, expected.String(), string(decompressed))
+}
+
+func TestStreamKeepsPartOnTransientError(t *testing.T) {
+	svc := newMultipartS3()
+	svc.partErrs = []error{awserr.New("SlowDown", "Please reduce your request rate.", nil)}
+	s3mock := newStreamingOperator(svc, plainTextFormat)
+
+	line := fmt.Sprintf("%064d\n", 0)
+	_, err := s3mock.streamBatch(&batch{lines: line, records: 1})
+	assert.Nil(t, err, "records are accepted even though the part is not uploaded")
+	assert.Len(t, svc.uploads["upload-0"], 0)
+
+	_, err = s3mock.streamBatch(&batch{lines: line, records: 1})
+	assert.Nil(t, err)
+	assert.Len(t, svc.uploads["upload-0"], 1)
+	assert.Len(t, svc.uploads["upload-0"][1], 2*len(line), "the kept part is sent with the next records")
+
+	s3mock.closeStreams()
+	assert.Equal(t, line+line, string(svc.objects[*svc.createIns[0].Key]))
+}
+
+func TestStreamFallsBackToStagingFiles(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	svc := newMultipartS3()
+	svc.partErrs = []error{awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id")}
+	testplugin := &testFluentPlugin{}
+	plugin = testplugin
+	s3mock := newStreamingOperator(svc, plainTextFormat)
+	s3mock.store = store
+
+	line := fmt.Sprintf("%064d\n", 0)
+	_, err := s3mock.streamBatch(&batch{lines: line, records: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"upload-0"}, svc.aborted, "the multipart upload is aborted")
+	assert.Len(t, s3mock.streams, 0)
+
+	assert.Len(t, testplugin.events, 1, "the staged records are uploaded as one object")
+	assert.Equal(t, *svc.createIns[0].Key, testplugin.events[0].objectKey)
+	assert.Equal(t, line, string(testplugin.events[0].data))
+	pending, _ := store.pending()
+	assert.Len(t, pending, 0)
+	journaled, _ := store.journaled()
+	assert.Len(t, journaled, 0)
+}
+
+func TestAbortJournaledUploads(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	svc := newMultipartS3()
+	s3mock := newStreamingOperator(svc, plainTextFormat)
+	s3mock.store = store
+	if _, err := s3mock.streamBatch(&batch{lines: "line1\n", records: 1}); err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	journaled, _ := store.journaled()
+	assert.Len(t, journaled, 1, "streams are journaled while they are uploaded")
+
+	// The previous run crashed, and the next run starts with the same store.
+	testplugin := &testFluentPlugin{}
+	plugin = testplugin
+	restarted := newStreamingOperator(svc, plainTextFormat)
+	restarted.store = store
+	assert.Nil(t, restarted.abortJournaledUploads())
+	assert.Equal(t, []string{"upload-0"}, svc.aborted)
+	journaled, _ = store.journaled()
+	assert.Len(t, journaled, 0)
+
+	pending, _ := store.pending()
+	restarted.uploadPending(pending)
+	assert.Len(t, testplugin.events, 1, "the streamed records are uploaded again")
+	assert.Equal(t, "line1\n", string(testplugin.events[0].data))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// objectConfig holds the attributes which are set on every uploaded object.
+type objectConfig struct {
+	storageClass string
+	acl          string
+	contentType  string
+	// tagging is URL query encoded as x-amz-tagging expects.
+	tagging  string
+	metadata map[string]*string
+}
+
+const (
+	maxObjectTags        = 10
+	maxObjectTagKeyLen   = 128
+	maxObjectTagValueLen = 256
+)
+
+// storageClasses also contains classes which are newer than the vendored aws-sdk-go.
+var storageClasses = []string{
+	s3.StorageClassStandard,
+	s3.StorageClassReducedRedundancy,
+	s3.StorageClassStandardIa,
+	s3.StorageClassOnezoneIa,
+	s3.StorageClassIntelligentTiering,
+	s3.StorageClassGlacier,
+	s3.StorageClassDeepArchive,
+	"GLACIER_IR",
+	"OUTPOSTS",
+}
+
+var cannedACLs = []string{
+	s3.ObjectCannedACLPrivate,
+	s3.ObjectCannedACLPublicRead,
+	s3.ObjectCannedACLPublicReadWrite,
+	s3.ObjectCannedACLAuthenticatedRead,
+	s3.ObjectCannedACLAwsExecRead,
+	s3.ObjectCannedACLBucketOwnerRead,
+	s3.ObjectCannedACLBucketOwnerFullControl,
+}
+
+var outputContentTypes = map[outputFormat]string{
+	jsonOutputFormat:        "application/x-ndjson",
+	singleValueOutputFormat: "text/plain",
+	csvOutputFormat:         "text/csv",
+	tsvOutputFormat:         "text/tab-separated-values",
+	ltsvOutputFormat:        "text/plain",
+	parquetOutputFormat:     "application/vnd.apache.parquet",
+}
+
+func getObjectConfig(storageClass, acl, contentType, tags, metadata string) (*objectConfig, error) {
+	conf := &objectConfig{contentType: contentType}
+
+	if storageClass != "" {
+		if !containsString(storageClasses, storageClass) {
+			return nil, fmt.Errorf("invalid storageClass: %v", storageClass)
+		}
+		conf.storageClass = storageClass
+	}
+
+	if acl != "" {
+		if !containsString(cannedACLs, acl) {
+			return nil, fmt.Errorf("invalid acl: %v", acl)
+		}
+		conf.acl = acl
+	}
+
+	if tags != "" {
+		pairs, err := parseKeyValuePairs(tags)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tags: %v", err)
+		}
+		if len(pairs) > maxObjectTags {
+			return nil, fmt.Errorf("invalid tags: up to %d tags are allowed", maxObjectTags)
+		}
+		values := url.Values{}
+		for _, pair := range pairs {
+			if len(pair[0]) > maxObjectTagKeyLen || len(pair[1]) > maxObjectTagValueLen {
+				return nil, fmt.Errorf("invalid tags: %s is too long", pair[0])
+			}
+			values.Set(pair[0], pair[1])
+		}
+		conf.tagging = values.Encode()
+	}
+
+	if metadata != "" {
+		pairs, err := parseKeyValuePairs(metadata)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata: %v", err)
+		}
+		conf.metadata = make(map[string]*string)
+		for _, pair := range pairs {
+			key := strings.TrimPrefix(strings.ToLower(pair[0]), "x-amz-meta-")
+			conf.metadata[key] = aws.String(pair[1])
+		}
+	}
+
+	return conf, nil
+}
+
+// parseKeyValuePairs parses comma separated key=value pairs such as "team=sre,env=prod".
+func parseKeyValuePairs(s string) ([][2]string, error) {
+	var pairs [][2]string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.IndexByte(item, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s is not key=value", item)
+		}
+		pairs = append(pairs, [2]string{strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])})
+	}
+	return pairs, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the attributes of an upload. Content-Type is derived from the format
+// and the codec unless ContentType is specified.
+func (c *objectConfig) apply(s3operator *s3operator, input *s3manager.UploadInput) {
+	contentType := outputContentTypes[s3operator.outputFormat]
+	// Parquet compresses each column page instead of the whole object.
+	if s3operator.outputFormat != parquetOutputFormat {
+		codec := codecs[s3operator.compressFormat]
+		if codec.contentType != "" {
+			contentType = codec.contentType
+		}
+		if codec.contentEncoding != "" {
+			input.ContentEncoding = aws.String(codec.contentEncoding)
+		}
+	}
+
+	if c != nil {
+		if c.contentType != "" {
+			contentType = c.contentType
+		}
+		if c.storageClass != "" {
+			input.StorageClass = aws.String(c.storageClass)
+		}
+		if c.acl != "" {
+			input.ACL = aws.String(c.acl)
+		}
+		if c.tagging != "" {
+			input.Tagging = aws.String(c.tagging)
+		}
+		if len(c.metadata) > 0 {
+			input.Metadata = c.metadata
+		}
+	}
+
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+}
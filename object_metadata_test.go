@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetObjectConfig(t *testing.T) {
+	conf, err := getObjectConfig("GLACIER_IR", "bucket-owner-full-control", "", "team=sre, env=prod&dev", "X-Amz-Meta-Owner=sre,cluster=tokyo")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "GLACIER_IR", conf.storageClass)
+	assert.Equal(t, "bucket-owner-full-control", conf.acl)
+	assert.Equal(t, "env=prod%26dev&team=sre", conf.tagging)
+	assert.Equal(t, "sre", *conf.metadata["owner"])
+	assert.Equal(t, "tokyo", *conf.metadata["cluster"])
+}
+
+func TestGetObjectConfigInvalid(t *testing.T) {
+	_, err := getObjectConfig("COLD", "", "", "", "")
+	assert.Equal(t, errors.New("invalid storageClass: COLD"), err)
+
+	_, err = getObjectConfig("", "public", "", "", "")
+	assert.Equal(t, errors.New("invalid acl: public"), err)
+
+	_, err = getObjectConfig("", "", "", "team", "")
+	assert.Equal(t, errors.New("invalid tags: team is not key=value"), err)
+
+	_, err = getObjectConfig("", "", "", "a=1,b=2,c=3,d=4,e=5,f=6,g=7,h=8,i=9,j=10,k=11", "")
+	assert.Equal(t, errors.New("invalid tags: up to 10 tags are allowed"), err)
+
+	_, err = getObjectConfig("", "", "", "", "=value")
+	assert.Equal(t, errors.New("invalid metadata: =value is not key=value"), err)
+}
+
+func TestNewUploadInput(t *testing.T) {
+	for _, c := range []struct {
+		outputFormat    outputFormat
+		compressFormat  format
+		contentType     string
+		contentEncoding string
+	}{
+		{jsonOutputFormat, plainTextFormat, "application/x-ndjson", ""},
+		{jsonOutputFormat, gzipFormat, "application/x-ndjson", "gzip"},
+		{csvOutputFormat, snappyFormat, "application/x-snappy-framed", ""},
+		{tsvOutputFormat, lz4Format, "application/x-lz4", ""},
+		{ltsvOutputFormat, zstdFormat, "application/zstd", ""},
+		{jsonOutputFormat, bzip2Format, "application/x-bzip2", ""},
+		{parquetOutputFormat, gzipFormat, "application/vnd.apache.parquet", ""},
+	} {
+		s3mock := &s3operator{
+			bucket:         "examplebucket",
+			outputFormat:   c.outputFormat,
+			compressFormat: c.compressFormat,
+		}
+		input := newUploadInput(s3mock, "exampleprefix/example.log", []byte("exampletext"))
+		assert.Equal(t, "examplebucket", *input.Bucket)
+		assert.Equal(t, "exampleprefix/example.log", *input.Key)
+		assert.Equal(t, c.contentType, *input.ContentType)
+		if c.contentEncoding == "" {
+			assert.Nil(t, input.ContentEncoding)
+		} else {
+			assert.Equal(t, c.contentEncoding, *input.ContentEncoding)
+		}
+		assert.Nil(t, input.StorageClass)
+	}
+
+	conf, _ := getObjectConfig("STANDARD_IA", "private", "text/plain; charset=utf-8", "team=sre", "owner=sre")
+	s3mock := &s3operator{
+		bucket:         "examplebucket",
+		compressFormat: gzipFormat,
+		object:         conf,
+	}
+	input := newUploadInput(s3mock, "exampleprefix/example.log.gz", []byte("exampletext"))
+	assert.Equal(t, "text/plain; charset=utf-8", *input.ContentType)
+	assert.Equal(t, "gzip", *input.ContentEncoding)
+	assert.Equal(t, "STANDARD_IA", *input.StorageClass)
+	assert.Equal(t, "private", *input.ACL)
+	assert.Equal(t, "team=sre", *input.Tagging)
+	assert.Equal(t, "sre", *input.Metadata["owner"])
+}
@@ -1,27 +1,26 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"github.com/fluent/fluent-bit-go/output"
 )
-import "github.com/json-iterator/go"
 import "github.com/aws/aws-sdk-go/aws"
 import "github.com/aws/aws-sdk-go/aws/awserr"
 import "github.com/aws/aws-sdk-go/aws/session"
 import "github.com/aws/aws-sdk-go/service/s3"
+import "github.com/aws/aws-sdk-go/service/s3/s3iface"
 import "github.com/aws/aws-sdk-go/service/s3/s3manager"
+import "github.com/aws/aws-sdk-go/service/sts"
 import log "github.com/sirupsen/logrus"
 import "github.com/prometheus/common/version"
 
 import (
 	"C"
 	"bytes"
-	"compress/gzip"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -37,14 +36,45 @@ func init() {
 }
 
 type s3operator struct {
-	bucket          string
-	prefix          string
-	suffixAlgorithm algorithm
-	uploader        *s3manager.Uploader
-	compressFormat  format
-	logger          *log.Logger
-	timeFormat      string
-	location        *time.Location
+	bucket           string
+	prefix           string
+	suffixAlgorithm  algorithm
+	uploader         *s3manager.Uploader
+	compressFormat   format
+	compressionLevel int
+	outputFormat     outputFormat
+	formatter        recordFormatter
+	filter           *recordFilter
+	redactor         *redactor
+	parquetColumns   []parquetColumn
+	logger           *log.Logger
+	timeFormat       string
+	location         *time.Location
+	keyFormatter     *objectKeyFormatter
+	useEventTime     bool
+	timeKey          string
+	timeKeyFormat    string
+	sse              *sseConfig
+	cse              *cseConfig
+	integrity        *integrityConfig
+	object           *objectConfig
+	buffer           *recordBuffers
+	workers          *uploadWorkers
+	retry            *retryConfig
+	deadLetters      deadLetterStore
+	metrics          *operatorMetrics
+	health           *uploadHealth
+	multipart        *multipartConfig
+	streams          map[partition]*multipartStream
+	uploads          *multipartUploads
+	progress         *flushProgress
+	client           s3iface.S3API
+	store            *fileStore
+	totalFileSize    int64
+	uploadTimeout    time.Duration
+	uploadMutex      sync.Mutex
+	done             chan struct{}
+	wg               sync.WaitGroup
 }
 
 type GoOutputPlugin interface {
@@ -79,32 +109,57 @@ func (p *fluentPlugin) Exit(code int) {
 }
 
 func (p *fluentPlugin) Put(s3operator *s3operator, objectKey string, timestamp time.Time, line string) error {
-	switch s3operator.compressFormat {
-	case plainTextFormat:
-		s3operator.logger.Tracef("[s3operator] objectKey = %s, rows = %d, byte = %d", objectKey, len(strings.Split(line, "\n")), len(line))
-		_, err := s3operator.uploader.Upload(&s3manager.UploadInput{
-			Bucket: aws.String(s3operator.bucket),
-			Key:    aws.String(objectKey),
-			Body:   strings.NewReader(line),
-		})
+	body, err := makeObjectBody(s3operator, line)
+	s3operator.logger.Tracef("[s3operator] objectKey = %s, rows = %d, byte = %d", objectKey, len(strings.Split(line, "\n")), len(body))
+	if err != nil {
 		return err
-	case gzipFormat:
-		compressed, err := makeGzip([]byte(line))
-		s3operator.logger.Tracef("[s3operator] objectKey = %s, rows = %d, byte = %d", objectKey, len(strings.Split(line, "\n")), len(compressed))
-		if err != nil {
-			return err
+	}
+	if body == nil {
+		s3operator.logger.Debugf("[s3operator] objectKey = %s is not uploaded since records have no columns", objectKey)
+		return nil
+	}
+
+	input := newUploadInput(s3operator, objectKey, body)
+	uploaded, err := s3operator.cse.encrypt(input, body)
+	if err != nil {
+		return err
+	}
+	if _, err = s3operator.uploader.Upload(input); err != nil {
+		// LeavePartsOnError keeps the parts of a failed upload, so it is aborted here.
+		if failure, ok := err.(s3manager.MultiUploadFailure); ok {
+			if abortErr := s3operator.abortUpload(objectKey, failure.UploadID()); abortErr != nil {
+				s3operator.logger.Warnf("error aborting multipart upload %s of %s: %v", failure.UploadID(), objectKey, abortErr)
+			}
 		}
-		_, err = s3operator.uploader.Upload(&s3manager.UploadInput{
-			Bucket: aws.String(s3operator.bucket),
-			Key:    aws.String(objectKey),
-			Body:   bytes.NewReader(compressed),
-		})
 		return err
 	}
-
+	if err := s3operator.verifyUpload(objectKey, uploaded); err != nil {
+		return err
+	}
+	s3operator.metrics.compressedBody(len(body))
 	return nil
 }
 
+// newUploadInput returns the request to upload body with the configured attributes.
+func newUploadInput(s3operator *s3operator, objectKey string, body []byte) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s3operator.bucket),
+		Key:    aws.String(objectKey),
+		Body:   bytes.NewReader(body),
+	}
+	s3operator.object.apply(s3operator, input)
+	s3operator.sse.apply(input)
+	return input
+}
+
+// makeObjectBody encodes and compresses lines into the body of an S3 object.
+func makeObjectBody(s3operator *s3operator, line string) ([]byte, error) {
+	if s3operator.outputFormat == parquetOutputFormat {
+		return makeParquet([]byte(line), s3operator.parquetColumns, s3operator.compressFormat, s3operator.compressionLevel)
+	}
+	return codecs[s3operator.compressFormat].compress([]byte(line), s3operator.compressionLevel)
+}
+
 type pluginContext struct{}
 
 type GoPluginContext interface {
@@ -120,24 +175,6 @@ func (p *pluginContext) PluginSetContext(plugin unsafe.Pointer, ctx interface{})
 	output.FLBPluginSetContext(plugin, ctx)
 }
 
-// based on https://text.baldanders.info/golang/gzip-operation/
-func makeGzip(body []byte) ([]byte, error) {
-	var b bytes.Buffer
-	err := func() error {
-		gw := gzip.NewWriter(&b)
-		gw.Name = "fluent-bit-go-s3"
-		gw.ModTime = time.Now()
-
-		defer gw.Close()
-
-		if _, err := gw.Write(body); err != nil {
-			return err
-		}
-		return nil
-	}()
-	return b.Bytes(), err
-}
-
 //export FLBPluginRegister
 func FLBPluginRegister(ctx unsafe.Pointer) int {
 	return output.FLBPluginRegister(ctx, "s3", "S3 Output plugin written in GO!")
@@ -196,6 +233,8 @@ func newLogger(logLevel log.Level) *log.Logger {
 func newS3Output(ctx unsafe.Pointer, operatorID int) (*s3operator, error) {
 	// Example to retrieve an optional configuration parameter
 	credential := plugin.PluginConfigKey(ctx, "Credential")
+	profile := plugin.PluginConfigKey(ctx, "Profile")
+	credentialChain := plugin.PluginConfigKey(ctx, "CredentialChain")
 	accessKeyID := plugin.PluginConfigKey(ctx, "AccessKeyID")
 	secretAccessKey := plugin.PluginConfigKey(ctx, "SecretAccessKey")
 	bucket := plugin.PluginConfigKey(ctx, "Bucket")
@@ -203,21 +242,180 @@ func newS3Output(ctx unsafe.Pointer, operatorID int) (*s3operator, error) {
 	suffixAlgorithm := plugin.PluginConfigKey(ctx, "SuffixAlgorithm")
 	region := plugin.PluginConfigKey(ctx, "Region")
 	compress := plugin.PluginConfigKey(ctx, "Compress")
+	compressionLevel := plugin.PluginConfigKey(ctx, "CompressionLevel")
 	endpoint := plugin.PluginConfigKey(ctx, "Endpoint")
 	autoCreateBucket := plugin.PluginConfigKey(ctx, "AutoCreateBucket")
 	logLevel := plugin.PluginConfigKey(ctx, "LogLevel")
 	timeFormat := plugin.PluginConfigKey(ctx, "TimeFormat")
 	timeZone := plugin.PluginConfigKey(ctx, "TimeZone")
+	totalFileSize := plugin.PluginConfigKey(ctx, "TotalFileSize")
+	uploadTimeout := plugin.PluginConfigKey(ctx, "UploadTimeout")
+	storeDir := plugin.PluginConfigKey(ctx, "StoreDir")
+	objectFormat := plugin.PluginConfigKey(ctx, "Format")
+	parquetSchema := plugin.PluginConfigKey(ctx, "ParquetSchema")
+	messageKey := plugin.PluginConfigKey(ctx, "MessageKey")
+	fields := plugin.PluginConfigKey(ctx, "Fields")
+	invalidUTF8 := plugin.PluginConfigKey(ctx, "InvalidUTF8")
+	objectKeyFormat := plugin.PluginConfigKey(ctx, "ObjectKeyFormat")
+	useEventTime := plugin.PluginConfigKey(ctx, "UseEventTime")
+	timeKey := plugin.PluginConfigKey(ctx, "TimeKey")
+	timeKeyFormat := plugin.PluginConfigKey(ctx, "TimeKeyFormat")
+	serverSideEncryption := plugin.PluginConfigKey(ctx, "ServerSideEncryption")
+	sseKMSKeyID := plugin.PluginConfigKey(ctx, "SSEKMSKeyId")
+	sseBucketKeyEnabled := plugin.PluginConfigKey(ctx, "SSEBucketKeyEnabled")
+	sseCustomerKeyFile := plugin.PluginConfigKey(ctx, "SSECustomerKeyFile")
+	clientSideEncryption := plugin.PluginConfigKey(ctx, "ClientSideEncryption")
+	csePublicKeyFile := plugin.PluginConfigKey(ctx, "CSEPublicKeyFile")
+	cseKMSKeyID := plugin.PluginConfigKey(ctx, "CSEKMSKeyId")
+	checksum := plugin.PluginConfigKey(ctx, "Checksum")
+	verifyUpload := plugin.PluginConfigKey(ctx, "VerifyUpload")
+	storageClass := plugin.PluginConfigKey(ctx, "StorageClass")
+	acl := plugin.PluginConfigKey(ctx, "ACL")
+	contentType := plugin.PluginConfigKey(ctx, "ContentType")
+	tags := plugin.PluginConfigKey(ctx, "Tags")
+	metadata := plugin.PluginConfigKey(ctx, "Metadata")
+	roleARN := plugin.PluginConfigKey(ctx, "RoleARN")
+	externalID := plugin.PluginConfigKey(ctx, "ExternalID")
+	roleSessionName := plugin.PluginConfigKey(ctx, "RoleSessionName")
+	webIdentityTokenFile := plugin.PluginConfigKey(ctx, "WebIdentityTokenFile")
+	roleDuration := plugin.PluginConfigKey(ctx, "RoleDuration")
+	workers := plugin.PluginConfigKey(ctx, "Workers")
+	queueSize := plugin.PluginConfigKey(ctx, "QueueSize")
+	maxRetries := plugin.PluginConfigKey(ctx, "MaxRetries")
+	retryBaseDelay := plugin.PluginConfigKey(ctx, "RetryBaseDelay")
+	retryMaxDelay := plugin.PluginConfigKey(ctx, "RetryMaxDelay")
+	deadLetter := plugin.PluginConfigKey(ctx, "DeadLetter")
+	deadLetterRedrive := plugin.PluginConfigKey(ctx, "DeadLetterRedrive")
+	metricsAddress := plugin.PluginConfigKey(ctx, "MetricsAddress")
+	healthAddress := plugin.PluginConfigKey(ctx, "HealthAddress")
+	preflight := plugin.PluginConfigKey(ctx, "Preflight")
+	strict := plugin.PluginConfigKey(ctx, "Strict")
+	partSize := plugin.PluginConfigKey(ctx, "PartSize")
+	uploadConcurrency := plugin.PluginConfigKey(ctx, "UploadConcurrency")
+	streaming := plugin.PluginConfigKey(ctx, "Streaming")
+	abortIncompleteUploadsAfter := plugin.PluginConfigKey(ctx, "AbortIncompleteUploadsAfter")
+	sweepInterval := plugin.PluginConfigKey(ctx, "SweepInterval")
+	includeRecords := plugin.PluginConfigKey(ctx, "IncludeRecords")
+	excludeRecords := plugin.PluginConfigKey(ctx, "ExcludeRecords")
+	allowKeys := plugin.PluginConfigKey(ctx, "AllowKeys")
+	removeKeys := plugin.PluginConfigKey(ctx, "RemoveKeys")
+	renameKeys := plugin.PluginConfigKey(ctx, "RenameKeys")
+	redactPatterns := plugin.PluginConfigKey(ctx, "RedactPatterns")
+	redactDetectors := plugin.PluginConfigKey(ctx, "RedactDetectors")
+	redactMask := plugin.PluginConfigKey(ctx, "RedactMask")
+	hashKeys := plugin.PluginConfigKey(ctx, "HashKeys")
+	hashKeyFile := plugin.PluginConfigKey(ctx, "HashKeyFile")
+
+	config, err := getS3Config(accessKeyID, secretAccessKey, credential, profile, credentialChain, s3prefix, suffixAlgorithm, bucket, region, compress, endpoint, autoCreateBucket, logLevel, timeFormat, timeZone)
 
-	config, err := getS3Config(accessKeyID, secretAccessKey, credential, s3prefix, suffixAlgorithm, bucket, region, compress, endpoint, autoCreateBucket, logLevel, timeFormat, timeZone)
-
 	if err != nil {
 		return nil, err
 	}
+	level, err := getCompressionLevel(config.compress, compressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	bufferConf, err := getBufferConfig(totalFileSize, uploadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	formatConf, err := getFormatConfig(objectFormat, parquetSchema, messageKey, fields, invalidUTF8)
+	if err != nil {
+		return nil, err
+	}
+	timeConf, err := getTimeConfig(useEventTime, timeKey, timeKeyFormat)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := getRecordFilter(includeRecords, excludeRecords, allowKeys, removeKeys, renameKeys)
+	if err != nil {
+		return nil, err
+	}
+	redactor, err := getRedactor(redactPatterns, redactDetectors, redactMask, hashKeys, hashKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	sseConf, err := getSSEConfig(serverSideEncryption, sseKMSKeyID, sseBucketKeyEnabled, sseCustomerKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cseConf, err := getCSEConfig(clientSideEncryption, csePublicKeyFile, cseKMSKeyID)
+	if err != nil {
+		return nil, err
+	}
+	integrityConf, err := getIntegrityConfig(checksum, verifyUpload)
+	if err != nil {
+		return nil, err
+	}
+	objectConf, err := getObjectConfig(storageClass, acl, contentType, tags, metadata)
+	if err != nil {
+		return nil, err
+	}
+	roleConf, err := getRoleConfig(roleARN, externalID, roleSessionName, webIdentityTokenFile, roleDuration)
+	if err != nil {
+		return nil, err
+	}
+	workerConf, err := getWorkerConfig(workers, queueSize)
+	if err != nil {
+		return nil, err
+	}
+	retryConf, err := getRetryConfig(maxRetries, retryBaseDelay, retryMaxDelay)
+	if err != nil {
+		return nil, err
+	}
+	deadLetterConf, err := getDeadLetterConfig(deadLetter, deadLetterRedrive)
+	if err != nil {
+		return nil, err
+	}
+	preflightConf, err := getPreflightConfig(preflight, strict)
+	if err != nil {
+		return nil, err
+	}
+	multipartConf, err := getMultipartConfig(partSize, uploadConcurrency, streaming)
+	if err != nil {
+		return nil, err
+	}
+	sweepConf, err := getSweepConfig(abortIncompleteUploadsAfter, sweepInterval)
+	if err != nil {
+		return nil, err
+	}
+	if multipartConf.streaming {
+		switch {
+		case bufferConf == nil:
+			return nil, fmt.Errorf("streaming requires totalFileSize or uploadTimeout")
+		case workerConf != nil:
+			return nil, fmt.Errorf("streaming cannot be used with workers")
+		case formatConf.format == parquetOutputFormat:
+			return nil, fmt.Errorf("streaming is not available with format parquet")
+		}
+	}
+	if formatConf.format == parquetOutputFormat && config.compress == bzip2Format {
+		// Parquet defines no BZIP2 codec for its pages.
+		return nil, fmt.Errorf("compress bzip2 is not available with format parquet")
+	}
+	if cseConf != nil {
+		// Parts of streamed uploads cannot be encrypted as a single envelope, and
+		// dead letters keep the records in plaintext.
+		switch {
+		case multipartConf.streaming:
+			return nil, fmt.Errorf("clientSideEncryption cannot be used with streaming")
+		case deadLetterConf != nil && deadLetterConf.bucket != "":
+			return nil, fmt.Errorf("clientSideEncryption cannot be used with deadLetter on S3")
+		}
+	}
+	var keyFormatter *objectKeyFormatter
+	if objectKeyFormat != "" {
+		keyFormatter, err = newObjectKeyFormatter(objectKeyFormat)
+		if err != nil {
+			return nil, err
+		}
+	}
 	logger := newLogger(config.logLevel)
 
 	logger.Infof("[flb-go %d] Starting fluent-bit-go-s3: %v", operatorID, version.Info())
 	logger.Infof("[flb-go %d] plugin credential parameter = '%s'", operatorID, credential)
+	logger.Infof("[flb-go %d] plugin profile parameter = '%s'", operatorID, profile)
+	logger.Infof("[flb-go %d] plugin credentialChain parameter = '%s'", operatorID, credentialChain)
 	logger.Infof("[flb-go %d] plugin accessKeyID parameter = '%s'", operatorID, obfuscateSecret(accessKeyID))
 	logger.Infof("[flb-go %d] plugin secretAccessKey parameter = '%s'", operatorID, obfuscateSecret(secretAccessKey))
 	logger.Infof("[flb-go %d] plugin bucket parameter = '%s'", operatorID, bucket)
@@ -225,9 +423,67 @@ func newS3Output(ctx unsafe.Pointer, operatorID int) (*s3operator, error) {
 	logger.Infof("[flb-go %d] plugin suffixAlgorithm parameter = '%s'", operatorID, suffixAlgorithm)
 	logger.Infof("[flb-go %d] plugin region parameter = '%s'", operatorID, region)
 	logger.Infof("[flb-go %d] plugin compress parameter = '%s'", operatorID, compress)
+	logger.Infof("[flb-go %d] plugin compressionLevel parameter = '%s'", operatorID, compressionLevel)
 	logger.Infof("[flb-go %d] plugin endpoint parameter = '%s'", operatorID, endpoint)
 	logger.Infof("[flb-go %d] plugin autoCreateBucket parameter = '%s'", operatorID, autoCreateBucket)
 	logger.Infof("[flb-go %d] plugin timeZone parameter = '%s'", operatorID, timeZone)
+	logger.Infof("[flb-go %d] plugin totalFileSize parameter = '%s'", operatorID, totalFileSize)
+	logger.Infof("[flb-go %d] plugin uploadTimeout parameter = '%s'", operatorID, uploadTimeout)
+	logger.Infof("[flb-go %d] plugin storeDir parameter = '%s'", operatorID, storeDir)
+	logger.Infof("[flb-go %d] plugin format parameter = '%s'", operatorID, objectFormat)
+	logger.Infof("[flb-go %d] plugin parquetSchema parameter = '%s'", operatorID, parquetSchema)
+	logger.Infof("[flb-go %d] plugin messageKey parameter = '%s'", operatorID, messageKey)
+	logger.Infof("[flb-go %d] plugin fields parameter = '%s'", operatorID, fields)
+	logger.Infof("[flb-go %d] plugin invalidUTF8 parameter = '%s'", operatorID, invalidUTF8)
+	logger.Infof("[flb-go %d] plugin objectKeyFormat parameter = '%s'", operatorID, objectKeyFormat)
+	logger.Infof("[flb-go %d] plugin useEventTime parameter = '%s'", operatorID, useEventTime)
+	logger.Infof("[flb-go %d] plugin timeKey parameter = '%s'", operatorID, timeKey)
+	logger.Infof("[flb-go %d] plugin timeKeyFormat parameter = '%s'", operatorID, timeKeyFormat)
+	logger.Infof("[flb-go %d] plugin includeRecords parameter = '%s'", operatorID, includeRecords)
+	logger.Infof("[flb-go %d] plugin excludeRecords parameter = '%s'", operatorID, excludeRecords)
+	logger.Infof("[flb-go %d] plugin allowKeys parameter = '%s'", operatorID, allowKeys)
+	logger.Infof("[flb-go %d] plugin removeKeys parameter = '%s'", operatorID, removeKeys)
+	logger.Infof("[flb-go %d] plugin renameKeys parameter = '%s'", operatorID, renameKeys)
+	logger.Infof("[flb-go %d] plugin redactPatterns parameter = '%s'", operatorID, redactPatterns)
+	logger.Infof("[flb-go %d] plugin redactDetectors parameter = '%s'", operatorID, redactDetectors)
+	logger.Infof("[flb-go %d] plugin redactMask parameter = '%s'", operatorID, redactMask)
+	logger.Infof("[flb-go %d] plugin hashKeys parameter = '%s'", operatorID, hashKeys)
+	logger.Infof("[flb-go %d] plugin hashKeyFile parameter = '%s'", operatorID, hashKeyFile)
+	logger.Infof("[flb-go %d] plugin serverSideEncryption parameter = '%s'", operatorID, serverSideEncryption)
+	logger.Infof("[flb-go %d] plugin sseKMSKeyId parameter = '%s'", operatorID, obfuscateSecret(sseKMSKeyID))
+	logger.Infof("[flb-go %d] plugin sseBucketKeyEnabled parameter = '%s'", operatorID, sseBucketKeyEnabled)
+	logger.Infof("[flb-go %d] plugin sseCustomerKeyFile parameter = '%s'", operatorID, sseCustomerKeyFile)
+	logger.Infof("[flb-go %d] plugin clientSideEncryption parameter = '%s'", operatorID, clientSideEncryption)
+	logger.Infof("[flb-go %d] plugin csePublicKeyFile parameter = '%s'", operatorID, csePublicKeyFile)
+	logger.Infof("[flb-go %d] plugin cseKMSKeyId parameter = '%s'", operatorID, obfuscateSecret(cseKMSKeyID))
+	logger.Infof("[flb-go %d] plugin checksum parameter = '%s'", operatorID, checksum)
+	logger.Infof("[flb-go %d] plugin verifyUpload parameter = '%s'", operatorID, verifyUpload)
+	logger.Infof("[flb-go %d] plugin storageClass parameter = '%s'", operatorID, storageClass)
+	logger.Infof("[flb-go %d] plugin acl parameter = '%s'", operatorID, acl)
+	logger.Infof("[flb-go %d] plugin contentType parameter = '%s'", operatorID, contentType)
+	logger.Infof("[flb-go %d] plugin tags parameter = '%s'", operatorID, tags)
+	logger.Infof("[flb-go %d] plugin metadata parameter = '%s'", operatorID, metadata)
+	logger.Infof("[flb-go %d] plugin roleARN parameter = '%s'", operatorID, roleARN)
+	logger.Infof("[flb-go %d] plugin externalID parameter = '%s'", operatorID, obfuscateSecret(externalID))
+	logger.Infof("[flb-go %d] plugin roleSessionName parameter = '%s'", operatorID, roleSessionName)
+	logger.Infof("[flb-go %d] plugin webIdentityTokenFile parameter = '%s'", operatorID, webIdentityTokenFile)
+	logger.Infof("[flb-go %d] plugin roleDuration parameter = '%s'", operatorID, roleDuration)
+	logger.Infof("[flb-go %d] plugin workers parameter = '%s'", operatorID, workers)
+	logger.Infof("[flb-go %d] plugin queueSize parameter = '%s'", operatorID, queueSize)
+	logger.Infof("[flb-go %d] plugin maxRetries parameter = '%s'", operatorID, maxRetries)
+	logger.Infof("[flb-go %d] plugin retryBaseDelay parameter = '%s'", operatorID, retryBaseDelay)
+	logger.Infof("[flb-go %d] plugin retryMaxDelay parameter = '%s'", operatorID, retryMaxDelay)
+	logger.Infof("[flb-go %d] plugin deadLetter parameter = '%s'", operatorID, deadLetter)
+	logger.Infof("[flb-go %d] plugin deadLetterRedrive parameter = '%s'", operatorID, deadLetterRedrive)
+	logger.Infof("[flb-go %d] plugin metricsAddress parameter = '%s'", operatorID, metricsAddress)
+	logger.Infof("[flb-go %d] plugin healthAddress parameter = '%s'", operatorID, healthAddress)
+	logger.Infof("[flb-go %d] plugin preflight parameter = '%s'", operatorID, preflight)
+	logger.Infof("[flb-go %d] plugin strict parameter = '%s'", operatorID, strict)
+	logger.Infof("[flb-go %d] plugin partSize parameter = '%s'", operatorID, partSize)
+	logger.Infof("[flb-go %d] plugin uploadConcurrency parameter = '%s'", operatorID, uploadConcurrency)
+	logger.Infof("[flb-go %d] plugin streaming parameter = '%s'", operatorID, streaming)
+	logger.Infof("[flb-go %d] plugin abortIncompleteUploadsAfter parameter = '%s'", operatorID, abortIncompleteUploadsAfter)
+	logger.Infof("[flb-go %d] plugin sweepInterval parameter = '%s'", operatorID, sweepInterval)
 
 	cfg := aws.Config{
 		Region: config.region,
@@ -235,6 +491,14 @@ func newS3Output(ctx unsafe.Pointer, operatorID int) (*s3operator, error) {
 	if config.credentials != nil {
 		cfg.WithCredentials(config.credentials)
 	}
+	if roleConf != nil {
+		// STS is called with the base credentials, so it must not use the Endpoint of S3.
+		stsSess := session.Must(session.NewSessionWithOptions(session.Options{
+			Config:            cfg,
+			SharedConfigState: session.SharedConfigEnable,
+		}))
+		cfg.WithCredentials(newRoleCredentials(sts.New(stsSess), roleConf))
+	}
 	if config.endpoint != "" {
 		cfg.WithEndpoint(config.endpoint).WithS3ForcePathStyle(true)
 	}
@@ -244,6 +508,15 @@ func newS3Output(ctx unsafe.Pointer, operatorID int) (*s3operator, error) {
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
+	// Unavailable credentials are not fatal here, as they may become available later (e.g. IMDS).
+	if value, err := sess.Config.Credentials.Get(); err != nil {
+		logger.Warnf("[flb-go %d] failed to retrieve credentials: %v", operatorID, err)
+	} else {
+		logger.Infof("[flb-go %d] credentials are provided by %s", operatorID, value.ProviderName)
+	}
+
+	cseConf.setup(sess)
+
 	if config.autoCreateBucket == true {
 		_, err = ensureBucket(sess, config.bucket, config.region)
 		if err != nil {
@@ -251,24 +524,139 @@ func newS3Output(ctx unsafe.Pointer, operatorID int) (*s3operator, error) {
 		}
 	}
 
-	if config.suffixAlgorithm == noSuffixAlgorithm {
+	if keyFormatter == nil && config.suffixAlgorithm == noSuffixAlgorithm {
 		logger.Warnf("[flb-go %d] Not using suffix algorithm will cause object key collision. Please consider to use `suffixAlgorithm sha256`.", operatorID)
 	}
 
+	uploads := newMultipartUploads()
 	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
-		u.PartSize = 5 * 1024 * 1024
+		u.PartSize = multipartConf.partSize
+		u.Concurrency = multipartConf.concurrency
 		u.LeavePartsOnError = true
+		u.RequestOptions = append(u.RequestOptions, sseConf.requestOptions()...)
+		u.RequestOptions = append(u.RequestOptions, integrityConf.requestOptions()...)
+		u.RequestOptions = append(u.RequestOptions, uploads.track)
 	})
 
 	s3operator := &s3operator{
-		bucket:          *config.bucket,
-		prefix:          *config.s3prefix,
-		suffixAlgorithm: config.suffixAlgorithm,
-		uploader:        uploader,
-		compressFormat:  config.compress,
-		logger:          logger,
-		timeFormat:      config.timeFormat,
-		location:        config.location,
+		bucket:           *config.bucket,
+		prefix:           *config.s3prefix,
+		suffixAlgorithm:  config.suffixAlgorithm,
+		uploader:         uploader,
+		compressFormat:   config.compress,
+		compressionLevel: level,
+		outputFormat:     formatConf.format,
+		formatter:        formatConf.formatter,
+		filter:           filter,
+		redactor:         redactor,
+		parquetColumns:   formatConf.parquetColumns,
+		logger:           logger,
+		timeFormat:       config.timeFormat,
+		location:         config.location,
+		keyFormatter:     keyFormatter,
+		useEventTime:     timeConf.useEventTime,
+		timeKey:          timeConf.timeKey,
+		timeKeyFormat:    timeConf.timeKeyFormat,
+		sse:              sseConf,
+		cse:              cseConf,
+		integrity:        integrityConf,
+		object:           objectConf,
+		retry:            retryConf,
+		metrics:          newOperatorMetrics(operatorID, *config.bucket),
+		health:           &uploadHealth{},
+		multipart:        multipartConf,
+		uploads:          uploads,
+		progress:         newFlushProgress(),
+		client:           uploader.S3,
+	}
+
+	if preflightConf != nil {
+		if err := s3operator.preflight(*config.region); err != nil {
+			if preflightConf.strict {
+				return nil, err
+			}
+			logger.Warnf("[flb-go %d] %v", operatorID, err)
+		} else {
+			logger.Infof("[flb-go %d] preflight of bucket %s succeeded", operatorID, s3operator.bucket)
+		}
+	}
+
+	if metricsAddress != "" {
+		if err := serveMetrics(metricsAddress); err != nil {
+			return nil, fmt.Errorf("cannot serve metrics on %s: %v", metricsAddress, err)
+		}
+	}
+	if healthAddress != "" {
+		if err := serveHealth(healthAddress); err != nil {
+			return nil, fmt.Errorf("cannot serve health on %s: %v", healthAddress, err)
+		}
+	}
+
+	if deadLetterConf != nil {
+		store, err := newDeadLetterStore(deadLetterConf, uploader.S3)
+		if err != nil {
+			return nil, err
+		}
+		s3operator.deadLetters = store
+	}
+
+	if storeDir != "" {
+		store, err := newFileStore(storeDir, s3operator.bucket, s3operator.prefix)
+		if err != nil {
+			return nil, err
+		}
+		s3operator.store = store
+		if err := s3operator.abortJournaledUploads(); err != nil {
+			logger.Warnf("[flb-go %d] Multipart uploads journaled in %s are aborted on the next start: %v", operatorID, store.dir, err)
+		}
+	}
+
+	if deadLetterConf != nil && deadLetterConf.redrive {
+		if err := s3operator.redriveDeadLetters(); err != nil {
+			logger.Warnf("[flb-go %d] Dead letters in %s are kept for the next re-drive: %v", operatorID, s3operator.deadLetters, err)
+		}
+	}
+
+	if workerConf != nil {
+		s3operator.workers = newUploadWorkers(workerConf, s3operator.uploadBatch, s3operator.givesUp, s3operator.uploadFailed)
+	}
+
+	if bufferConf != nil {
+		if multipartConf.streaming {
+			s3operator.streams = make(map[partition]*multipartStream)
+		} else {
+			s3operator.buffer = newRecordBuffers(s3operator.store)
+		}
+		s3operator.totalFileSize = bufferConf.totalFileSize
+		s3operator.uploadTimeout = bufferConf.uploadTimeout
+		s3operator.done = make(chan struct{})
+		s3operator.wg.Add(1)
+		go s3operator.runUploadTimer()
+	}
+
+	if sweepConf != nil {
+		if s3operator.done == nil {
+			s3operator.done = make(chan struct{})
+		}
+		s3operator.wg.Add(1)
+		go s3operator.runSweeper(sweepConf)
+	}
+
+	if s3operator.store != nil {
+		// Files staged from now on belong to this run, so that the leftovers are listed before Fluent Bit starts flushing.
+		paths, err := s3operator.store.pending()
+		if err != nil {
+			logger.Warnf("[flb-go %d] Pending batches in %s are kept for the next start: %v", operatorID, s3operator.store.dir, err)
+		} else if len(paths) > 0 {
+			if s3operator.done == nil {
+				s3operator.done = make(chan struct{})
+			}
+			s3operator.wg.Add(1)
+			go func() {
+				defer s3operator.wg.Done()
+				s3operator.uploadPending(paths)
+			}()
+		}
 	}
 
 	return s3operator, nil
@@ -294,9 +682,10 @@ func getS3Operator(ctx unsafe.Pointer) *s3operator {
 	return s3operators[operatorID]
 }
 
-//export FLBPluginInit
 // (fluentbit will call this)
 // ctx (context) pointer to fluentbit context (state/ c code)
+//
+//export FLBPluginInit
 func FLBPluginInit(ctx unsafe.Pointer) int {
 	err := addS3Output(ctx)
 	if err != nil {
@@ -317,32 +706,137 @@ func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
 //export FLBPluginFlushCtx
 func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
 	var ret int
+	var ts interface{}
 	var record map[interface{}]interface{}
 
 	s3operator := getS3Operator(ctx)
+	if s3operator.workers != nil && s3operator.workers.full() {
+		s3operator.logger.Warnf("upload queue is full, %d batches are pending", s3operator.workers.pending())
+		return output.FLB_RETRY
+	}
 	dec := plugin.NewDecoder(data, int(length))
-	var lines string
+	tagName := C.GoString(tag)
+	// Records are split into a batch for each partition of the object key.
+	var batches []*batch
+	var records, dropped int
+	redactions := make(map[string]int)
+	partitions := make(map[partition]*batch)
 
 	for {
-		ret, _, record = plugin.GetRecord(dec)
+		ret, ts, record = plugin.GetRecord(dec)
 		if ret != 0 {
 			break
 		}
 
-		line, err := createJSON(record)
+		if !s3operator.filter.keep(record) {
+			dropped++
+			continue
+		}
+		// Object keys refer to the record as it is received, and their values are redacted as the record is.
+		p := s3operator.keyFormatter.partitionOf(tagName, record, s3operator.filter, s3operator.redactor)
+		record = s3operator.filter.transform(record)
+		s3operator.redactor.redact(record, redactions)
+
+		t := eventTime(ts)
+		if s3operator.timeKey != "" {
+			s3operator.injectTime(record, t)
+		}
+		line, err := s3operator.formatter.Format(record)
 		if err != nil {
 			s3operator.logger.Warnf("error creating message for S3: %v", err)
 			continue
 		}
-		lines += line + "\n"
+		if s3operator.useEventTime {
+			p.slice = s3operator.timeSlice(t)
+		}
+		b, ok := partitions[p]
+		if !ok {
+			b = &batch{partition: p}
+			if s3operator.useEventTime {
+				b.eventTime = t
+			}
+			partitions[p] = b
+			batches = append(batches, b)
+		}
+		b.lines += line + "\n"
+		b.records++
+		records++
+	}
+	s3operator.metrics.formatted(records)
+	s3operator.metrics.dropped(dropped)
+	s3operator.metrics.redacted(redactions)
+
+	if s3operator.streaming() {
+		for _, b := range batches {
+			size, err := s3operator.streamBatch(b)
+			if err != nil {
+				s3operator.logger.Warnf("error streaming message for S3: %v", err)
+				return output.FLB_RETRY
+			}
+			if int64(size) >= s3operator.totalFileSize {
+				if err := s3operator.flushStream(b.partition); err != nil {
+					// The object is completed on the next attempt.
+					s3operator.logger.Warnf("error sending message for S3: %v", err)
+				}
+			}
+		}
+		return output.FLB_OK
 	}
 
-	objectKey := GenerateObjectKey(s3operator, time.Now(), lines)
-	err := plugin.Put(s3operator, objectKey, time.Now(), lines)
-	if err != nil {
-		s3operator.logger.Warnf("error sending message for S3: %v", err)
+	if s3operator.buffering() {
+		for _, b := range batches {
+			size, err := s3operator.buffer.append(b.partition, b.eventTime, b.lines, b.records)
+			if err != nil {
+				s3operator.logger.Warnf("error staging message for S3: %v", err)
+				return output.FLB_RETRY
+			}
+			if int64(size) >= s3operator.totalFileSize {
+				if err := s3operator.flushPartition(b.partition); err != nil {
+					// Records are kept in the buffer and uploaded on the next attempt.
+					s3operator.logger.Warnf("error sending message for S3: %v", err)
+				}
+			}
+		}
+		return output.FLB_OK
+	}
+
+	if s3operator.workers != nil {
+		if err := s3operator.queueBatches(batches); err != nil {
+			s3operator.logger.Warnf("error queueing message for S3: %v", err)
+			return output.FLB_RETRY
+		}
+		return output.FLB_OK
+	}
+
+	// Every partition is tried even if another one fails. Partitions which are finished
+	// are skipped when Fluent Bit retries the chunk, so that they are not uploaded twice.
+	id := chunkID(batches)
+	var permanent, transient bool
+	for _, b := range batches {
+		if s3operator.progress.done(id, b.partition) {
+			continue
+		}
+		err := s3operator.putBatch(b)
+		switch {
+		case err == nil:
+		case s3operator.givesUp(err) && s3operator.deadLetterBatch(b, err):
+		case isPermanentError(err):
+			s3operator.logger.Errorf("error sending message for S3, giving up: %v", err)
+			permanent = true
+		default:
+			s3operator.logger.Warnf("error sending message for S3: %v", err)
+			transient = true
+			continue
+		}
+		s3operator.progress.markDone(id, b.partition)
+	}
+	if transient {
 		return output.FLB_RETRY
 	}
+	s3operator.progress.forget(id)
+	if permanent {
+		return output.FLB_ERROR
+	}
 
 	// Return options:
 	//
@@ -352,66 +846,162 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	return output.FLB_OK
 }
 
-// format is S3_PREFIX/S3_TRAILING_PREFIX/date/hour/timestamp_uuid.log
-func GenerateObjectKey(s3operator *s3operator, t time.Time, lines string) string {
-	var fileext string
-	switch s3operator.compressFormat {
-	case plainTextFormat:
-		fileext = ".log"
-	case gzipFormat:
-		fileext = ".log.gz"
+// putBatch uploads b as one object without buffering.
+func (s3operator *s3operator) putBatch(b *batch) error {
+	var staged []string
+	if s3operator.store != nil {
+		path, err := s3operator.store.stage(b.partition, b.eventTime, b.lines)
+		if err != nil {
+			return fmt.Errorf("error staging message: %v", err)
+		}
+		staged = append(staged, path)
+	}
+
+	t := s3operator.objectTime(b)
+	b.objectKey = GenerateObjectKey(s3operator, b.partition, t, b.lines)
+	err := s3operator.put(b.objectKey, t, b.lines)
+	if s3operator.store != nil {
+		// Fluent Bit retries the chunk itself, so the staged copy is not needed anymore.
+		if err := s3operator.store.remove(staged); err != nil {
+			s3operator.logger.Warnf("error removing staged message: %v", err)
+		}
+	}
+	return err
+}
+
+// queueBatches hands batches over to the upload workers. Either all of them are
+// queued or none of them, so that Fluent Bit can retry the chunk as a whole.
+func (s3operator *s3operator) queueBatches(batches []*batch) error {
+	if s3operator.store != nil {
+		// Staged batches survive a crash before the workers upload them.
+		for _, b := range batches {
+			path, err := s3operator.store.stage(b.partition, b.eventTime, b.lines)
+			if err != nil {
+				s3operator.unstage(batches)
+				return fmt.Errorf("error staging message: %v", err)
+			}
+			b.files = append(b.files, path)
+		}
+	}
+	if !s3operator.workers.offer(batches...) {
+		s3operator.unstage(batches)
+		return errUploadQueueFull
+	}
+	return nil
+}
+
+func (s3operator *s3operator) unstage(batches []*batch) {
+	if s3operator.store == nil {
+		return
+	}
+	for _, b := range batches {
+		if err := s3operator.store.remove(b.files); err != nil {
+			s3operator.logger.Warnf("error removing staged message: %v", err)
+		}
+		b.files = nil
+	}
+}
+
+// uploadBatch uploads b as one object and removes its staging files once it is uploaded.
+func (s3operator *s3operator) uploadBatch(b *batch) error {
+	t := s3operator.objectTime(b)
+	if b.objectKey == "" {
+		b.objectKey = GenerateObjectKey(s3operator, b.partition, t, b.lines)
+	}
+	if err := s3operator.put(b.objectKey, t, b.lines); err != nil {
+		return err
+	}
+	s3operator.logger.Debugf("[s3operator] uploaded %d records (%d bytes) to %s", b.records, len(b.lines), b.objectKey)
+
+	if s3operator.store != nil {
+		return s3operator.store.remove(b.files)
+	}
+	return nil
+}
+
+// uploadFailed reports a batch which failed to be uploaded. Batches which are not
+// retried anymore are written into DeadLetter when it is specified.
+func (s3operator *s3operator) uploadFailed(b *batch, err error, retrying bool) {
+	if !retrying && s3operator.deadLetterBatch(b, err) {
+		return
+	}
+
+	switch {
+	case retrying:
+		s3operator.metrics.retried()
+		s3operator.logger.Warnf("error sending message for S3, retrying: %v", err)
+	case len(b.files) > 0:
+		s3operator.logger.Errorf("error sending message for S3, %d records are kept in %s for the next start: %v", b.records, s3operator.store.dir, err)
+	default:
+		s3operator.logger.Errorf("error sending message for S3, %d records are dropped: %v", b.records, err)
 	}
+}
+
+// GenerateObjectKey renders ObjectKeyFormat when it is specified.
+// Otherwise, format is S3_PREFIX/S3_TRAILING_PREFIX/date/hour/timestamp_uuid.log
+func GenerateObjectKey(s3operator *s3operator, p partition, t time.Time, lines string) string {
+	if s3operator.keyFormatter != nil {
+		return s3operator.keyFormatter.render(s3operator, p, t, lines)
+	}
+
+	fileext := objectExtension(s3operator)
 	var suffix string
 	switch s3operator.suffixAlgorithm {
 	case noSuffixAlgorithm:
 		suffix = ""
 	case sha256SuffixAlgorithm:
-		b := sha256.Sum256([]byte(lines))
-		suffix = fmt.Sprintf("-%s", hex.EncodeToString(b[:]))
+		suffix = "-" + sha256Hex([]byte(lines))
+	}
+	// Convert time.Time object with specified TimeZone's. Keys are rendered by
+	// several goroutines, so time.Local must not be replaced here.
+	location := s3operator.location
+	if location == nil {
+		location = time.UTC
 	}
-	// Convert time.Time object's Local with specified TimeZone's
-	time.Local = s3operator.location
-	timestamp := t.Local().Format("20060102150405")
+	t = t.In(location)
+	timestamp := t.Format("20060102150405")
 
 	fileName := strings.Join([]string{timestamp, suffix, fileext}, "")
 
-	objectKey := filepath.Join(s3operator.prefix, t.Local().Format(s3operator.timeFormat), fileName)
+	objectKey := filepath.Join(s3operator.prefix, t.Format(s3operator.timeFormat), fileName)
 	return objectKey
 }
 
-func encodeJSON(record map[interface{}]interface{}) map[string]interface{} {
-	m := make(map[string]interface{})
-
-	for k, v := range record {
-		switch t := v.(type) {
-		case []byte:
-			// prevent encoding to base64
-			m[k.(string)] = string(t)
-		case map[interface{}]interface{}:
-			if nextValue, ok := record[k].(map[interface{}]interface{}); ok {
-				m[k.(string)] = encodeJSON(nextValue)
-			}
-		default:
-			m[k.(string)] = v
-		}
+// objectExtension returns the extension of objects including the compression one.
+func objectExtension(s3operator *s3operator) string {
+	if s3operator.outputFormat == parquetOutputFormat {
+		// Parquet compresses its pages, so the object itself is not compressed.
+		return ".parquet"
 	}
-
-	return m
+	var fileext string
+	switch s3operator.outputFormat {
+	case singleValueOutputFormat:
+		fileext = ".txt"
+	case csvOutputFormat:
+		fileext = ".csv"
+	case tsvOutputFormat:
+		fileext = ".tsv"
+	case ltsvOutputFormat:
+		fileext = ".ltsv"
+	default:
+		fileext = ".log"
+	}
+	return fileext + codecs[s3operator.compressFormat].extension
 }
 
 func createJSON(record map[interface{}]interface{}) (string, error) {
-	m := encodeJSON(record)
-
-	js, err := jsoniter.Marshal(m)
-	if err != nil {
-		return "{}", err
-	}
-
-	return string(js), nil
+	return jsonEncoder{}.marshal(record)
 }
 
 //export FLBPluginExit
 func FLBPluginExit() int {
+	for _, s3operator := range s3operators {
+		if err := s3operator.close(); err != nil {
+			s3operator.logger.Errorf("error sending buffered message for S3: %v", err)
+		}
+		s3operator.abortTrackedUploads()
+	}
+	closeHTTPServers()
 	return output.FLB_OK
 }
 
@@ -13,6 +13,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/fluent/fluent-bit-go/output"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -98,7 +99,7 @@ func TestGenerateObjectKey(t *testing.T) {
 		compressFormat: plainTextFormat,
 	}
 	lines := "exampletext"
-	objectKey := GenerateObjectKey(s3mock, now, lines)
+	objectKey := GenerateObjectKey(s3mock, partition{}, now, lines)
 	fmt.Printf("objectKey: %v\n", objectKey)
 	assert.NotNil(t, objectKey, "objectKey not to be nil")
 }
@@ -113,7 +114,7 @@ func TestGenerateObjectKeyWithNoSuffixAlgorithm(t *testing.T) {
 		compressFormat:  plainTextFormat,
 	}
 	lines := "exampletext"
-	objectKey := GenerateObjectKey(s3mock, now, lines)
+	objectKey := GenerateObjectKey(s3mock, partition{}, now, lines)
 	fmt.Printf("objectKey: %v\n", objectKey)
 	assert.False(t, strings.HasSuffix(objectKey, "-c675f9cd0e59479e5ccca3ea8a03beccd80f662f6a56662bfc9dd0b61d4f73c3.log"), "objectKey has no suffix")
 }
@@ -128,7 +129,7 @@ func TestGenerateObjectKeyWithSha256SuffixAlgorithm(t *testing.T) {
 		compressFormat:  plainTextFormat,
 	}
 	lines := "exampletext"
-	objectKey := GenerateObjectKey(s3mock, now, lines)
+	objectKey := GenerateObjectKey(s3mock, partition{}, now, lines)
 	fmt.Printf("objectKey: %v\n", objectKey)
 	assert.True(t, strings.HasSuffix(objectKey, "-c675f9cd0e59479e5ccca3ea8a03beccd80f662f6a56662bfc9dd0b61d4f73c3.log"), "objectKey has sha256 suffix")
 }
@@ -144,7 +145,7 @@ func TestGenerateObjectKeyWithTokyoLocation(t *testing.T) {
 		location:       loc,
 	}
 	lines := "exampletext"
-	objectKey := GenerateObjectKey(s3mock, now, lines)
+	objectKey := GenerateObjectKey(s3mock, partition{}, now, lines)
 	fmt.Printf("objectKey: %v\n", objectKey)
 	assert.NotNil(t, objectKey, "objectKey not to be nil")
 }
@@ -160,7 +161,7 @@ func TestGenerateObjectKeyWithUSEastLocation(t *testing.T) {
 		location:       loc,
 	}
 	lines := "exampletext"
-	objectKey := GenerateObjectKey(s3mock, now, lines)
+	objectKey := GenerateObjectKey(s3mock, partition{}, now, lines)
 	fmt.Printf("objectKey: %v\n", objectKey)
 	assert.NotNil(t, objectKey, "objectKey not to be nil")
 }
@@ -176,7 +177,7 @@ func TestGenerateObjectKeyWithUTCLocation(t *testing.T) {
 		location:       loc,
 	}
 	lines := "exampletext"
-	objectKey := GenerateObjectKey(s3mock, now, lines)
+	objectKey := GenerateObjectKey(s3mock, partition{}, now, lines)
 	fmt.Printf("objectKey: %v\n", objectKey)
 	assert.NotNil(t, objectKey, "objectKey not to be nil")
 }
@@ -190,11 +191,68 @@ func TestGenerateObjectKeyWithGzip(t *testing.T) {
 		compressFormat: gzipFormat,
 	}
 	lines := "exampletext"
-	objectKey := GenerateObjectKey(s3mock, now, lines)
+	objectKey := GenerateObjectKey(s3mock, partition{}, now, lines)
 	fmt.Printf("objectKey: %v\n", objectKey)
 	assert.NotNil(t, objectKey, "objectKey not to be nil")
 }
 
+func TestGenerateObjectKeyWithFormat(t *testing.T) {
+	now := time.Now()
+	for format, ext := range map[outputFormat]string{
+		jsonOutputFormat:        ".log.gz",
+		singleValueOutputFormat: ".txt.gz",
+		csvOutputFormat:         ".csv.gz",
+		tsvOutputFormat:         ".tsv.gz",
+		ltsvOutputFormat:        ".ltsv.gz",
+	} {
+		s3mock := &s3operator{
+			bucket:         "s3examplebucket",
+			prefix:         "s3exampleprefix",
+			uploader:       nil,
+			compressFormat: gzipFormat,
+			outputFormat:   format,
+		}
+		objectKey := GenerateObjectKey(s3mock, partition{}, now, "exampletext")
+		assert.True(t, strings.HasSuffix(objectKey, ext), "objectKey has %s extension", ext)
+	}
+}
+
+func TestGenerateObjectKeyWithCompression(t *testing.T) {
+	now := time.Now()
+	for compressFormat, ext := range map[format]string{
+		plainTextFormat: ".log",
+		gzipFormat:      ".log.gz",
+		snappyFormat:    ".log.sz",
+		lz4Format:       ".log.lz4",
+		zstdFormat:      ".log.zst",
+		bzip2Format:     ".log.bz2",
+	} {
+		s3mock := &s3operator{
+			bucket:         "s3examplebucket",
+			prefix:         "s3exampleprefix",
+			uploader:       nil,
+			compressFormat: compressFormat,
+		}
+		objectKey := GenerateObjectKey(s3mock, partition{}, now, "exampletext")
+		assert.True(t, strings.HasSuffix(objectKey, ext), "objectKey has %s extension", ext)
+	}
+}
+
+func TestGenerateObjectKeyWithParquet(t *testing.T) {
+	now := time.Now()
+	s3mock := &s3operator{
+		bucket:         "s3examplebucket",
+		prefix:         "s3exampleprefix",
+		uploader:       nil,
+		compressFormat: gzipFormat,
+		outputFormat:   parquetOutputFormat,
+	}
+	lines := "exampletext"
+	objectKey := GenerateObjectKey(s3mock, partition{}, now, lines)
+	fmt.Printf("objectKey: %v\n", objectKey)
+	assert.True(t, strings.HasSuffix(objectKey, ".parquet"), "objectKey has parquet extension")
+}
+
 // based on https://text.baldanders.info/golang/gzip-operation/
 func readGzip(dst io.Writer, src io.Reader) error {
 	zr, err := gzip.NewReader(src)
@@ -231,29 +289,94 @@ type testrecord struct {
 }
 
 type events struct {
-	data []byte
+	objectKey string
+	data      []byte
 }
 type testFluentPlugin struct {
-	credential       string
-	accessKeyID      string
-	secretAccessKey  string
-	bucket           string
-	s3prefix         string
-	region           string
-	compress         string
-	endpoint         string
-	autoCreateBucket string
-	logLevel         string
-	location         string
-	records          []testrecord
-	position         int
-	events           []*events
+	credential                  string
+	profile                     string
+	credentialChain             string
+	accessKeyID                 string
+	secretAccessKey             string
+	bucket                      string
+	s3prefix                    string
+	region                      string
+	compress                    string
+	endpoint                    string
+	autoCreateBucket            string
+	logLevel                    string
+	location                    string
+	compressionLevel            string
+	totalFileSize               string
+	uploadTimeout               string
+	storeDir                    string
+	format                      string
+	parquetSchema               string
+	messageKey                  string
+	fields                      string
+	objectKeyFormat             string
+	useEventTime                string
+	timeKey                     string
+	timeKeyFormat               string
+	serverSideEncryption        string
+	sseKMSKeyID                 string
+	sseBucketKeyEnabled         string
+	sseCustomerKeyFile          string
+	clientSideEncryption        string
+	csePublicKeyFile            string
+	cseKMSKeyID                 string
+	checksum                    string
+	verifyUpload                string
+	storageClass                string
+	acl                         string
+	contentType                 string
+	tags                        string
+	metadata                    string
+	roleARN                     string
+	externalID                  string
+	roleSessionName             string
+	webIdentityTokenFile        string
+	roleDuration                string
+	workers                     string
+	queueSize                   string
+	maxRetries                  string
+	retryBaseDelay              string
+	retryMaxDelay               string
+	deadLetter                  string
+	deadLetterRedrive           string
+	metricsAddress              string
+	healthAddress               string
+	preflight                   string
+	strict                      string
+	partSize                    string
+	uploadConcurrency           string
+	streaming                   string
+	abortIncompleteUploadsAfter string
+	sweepInterval               string
+	includeRecords              string
+	excludeRecords              string
+	allowKeys                   string
+	removeKeys                  string
+	renameKeys                  string
+	redactPatterns              string
+	redactDetectors             string
+	redactMask                  string
+	hashKeys                    string
+	hashKeyFile                 string
+	invalidUTF8                 string
+	records                     []testrecord
+	position                    int
+	events                      []*events
 }
 
 func (p *testFluentPlugin) PluginConfigKey(ctx unsafe.Pointer, key string) string {
 	switch key {
 	case "Credential":
 		return p.credential
+	case "Profile":
+		return p.profile
+	case "CredentialChain":
+		return p.credentialChain
 	case "AccessKeyID":
 		return p.accessKeyID
 	case "SecretAccessKey":
@@ -266,6 +389,8 @@ func (p *testFluentPlugin) PluginConfigKey(ctx unsafe.Pointer, key string) strin
 		return p.region
 	case "Compress":
 		return p.compress
+	case "CompressionLevel":
+		return p.compressionLevel
 	case "Endpoint":
 		return p.endpoint
 	case "AutoCreateBucket":
@@ -274,6 +399,120 @@ func (p *testFluentPlugin) PluginConfigKey(ctx unsafe.Pointer, key string) strin
 		return p.logLevel
 	case "TimeZone":
 		return p.location
+	case "TotalFileSize":
+		return p.totalFileSize
+	case "UploadTimeout":
+		return p.uploadTimeout
+	case "StoreDir":
+		return p.storeDir
+	case "Format":
+		return p.format
+	case "ParquetSchema":
+		return p.parquetSchema
+	case "MessageKey":
+		return p.messageKey
+	case "Fields":
+		return p.fields
+	case "ObjectKeyFormat":
+		return p.objectKeyFormat
+	case "UseEventTime":
+		return p.useEventTime
+	case "TimeKey":
+		return p.timeKey
+	case "TimeKeyFormat":
+		return p.timeKeyFormat
+	case "ServerSideEncryption":
+		return p.serverSideEncryption
+	case "SSEKMSKeyId":
+		return p.sseKMSKeyID
+	case "SSEBucketKeyEnabled":
+		return p.sseBucketKeyEnabled
+	case "SSECustomerKeyFile":
+		return p.sseCustomerKeyFile
+	case "ClientSideEncryption":
+		return p.clientSideEncryption
+	case "CSEPublicKeyFile":
+		return p.csePublicKeyFile
+	case "CSEKMSKeyId":
+		return p.cseKMSKeyID
+	case "Checksum":
+		return p.checksum
+	case "VerifyUpload":
+		return p.verifyUpload
+	case "StorageClass":
+		return p.storageClass
+	case "ACL":
+		return p.acl
+	case "ContentType":
+		return p.contentType
+	case "Tags":
+		return p.tags
+	case "Metadata":
+		return p.metadata
+	case "RoleARN":
+		return p.roleARN
+	case "ExternalID":
+		return p.externalID
+	case "RoleSessionName":
+		return p.roleSessionName
+	case "WebIdentityTokenFile":
+		return p.webIdentityTokenFile
+	case "RoleDuration":
+		return p.roleDuration
+	case "Workers":
+		return p.workers
+	case "QueueSize":
+		return p.queueSize
+	case "MaxRetries":
+		return p.maxRetries
+	case "RetryBaseDelay":
+		return p.retryBaseDelay
+	case "RetryMaxDelay":
+		return p.retryMaxDelay
+	case "DeadLetter":
+		return p.deadLetter
+	case "DeadLetterRedrive":
+		return p.deadLetterRedrive
+	case "MetricsAddress":
+		return p.metricsAddress
+	case "HealthAddress":
+		return p.healthAddress
+	case "Preflight":
+		return p.preflight
+	case "Strict":
+		return p.strict
+	case "PartSize":
+		return p.partSize
+	case "UploadConcurrency":
+		return p.uploadConcurrency
+	case "Streaming":
+		return p.streaming
+	case "AbortIncompleteUploadsAfter":
+		return p.abortIncompleteUploadsAfter
+	case "SweepInterval":
+		return p.sweepInterval
+	case "IncludeRecords":
+		return p.includeRecords
+	case "ExcludeRecords":
+		return p.excludeRecords
+	case "AllowKeys":
+		return p.allowKeys
+	case "RemoveKeys":
+		return p.removeKeys
+	case "RenameKeys":
+		return p.renameKeys
+	case "RedactPatterns":
+		return p.redactPatterns
+	case "RedactDetectors":
+		return p.redactDetectors
+	case "RedactMask":
+		return p.redactMask
+	case "HashKeys":
+		return p.hashKeys
+	case "HashKeyFile":
+		return p.hashKeyFile
+	case "InvalidUTF8":
+		return p.invalidUTF8
 	}
 	return "unknown-" + key
 }
@@ -291,7 +530,7 @@ func (p *testFluentPlugin) NewDecoder(data unsafe.Pointer, length int) *output.F
 func (p *testFluentPlugin) Exit(code int)                                                 {}
 func (p *testFluentPlugin) Put(s3operator *s3operator, objectKey string, timestamp time.Time, line string) error {
 	data := ([]byte)(line)
-	events := &events{data: data}
+	events := &events{objectKey: objectKey, data: data}
 	p.events = append(p.events, events)
 	return nil
 }
@@ -328,7 +567,7 @@ type testS3Credential struct {
 	credential string
 }
 
-func (c *testS3Credential) GetCredentials(accessID, secretkey, credential string) (*credentials.Credentials, error) {
+func (c *testS3Credential) GetCredentials(accessID, secretkey, credential, profile string, chain []credentialSource, region string) (*credentials.Credentials, error) {
 	creds := credentials.NewCredentials(&stubProvider{
 		creds: credentials.Value{
 			AccessKeyID:     "AKID",
@@ -343,7 +582,7 @@ func (c *testS3Credential) GetCredentials(accessID, secretkey, credential string
 
 func TestPluginInitializationWithStaticCredentials(t *testing.T) {
 	s3Creds = &testS3Credential{}
-	_, err := getS3Config("exampleaccessID", "examplesecretkey", "", "exampleprefix", "", "examplebucket", "exampleregion", "", "", "false", "info", "", "")
+	_, err := getS3Config("exampleaccessID", "examplesecretkey", "", "", "", "exampleprefix", "", "examplebucket", "exampleregion", "", "", "false", "info", "", "")
 	if err != nil {
 		t.Fatalf("failed test %#v", err)
 	}
@@ -364,7 +603,7 @@ func TestPluginInitializationWithStaticCredentials(t *testing.T) {
 
 func TestPluginInitializationWithSharedCredentials(t *testing.T) {
 	s3Creds = &testS3Credential{}
-	_, err := getS3Config("", "", "examplecredentials", "exampleprefix", "", "examplebucket", "exampleregion", "", "", "false", "info", "", "")
+	_, err := getS3Config("", "", "examplecredentials", "", "", "exampleprefix", "", "examplebucket", "exampleregion", "", "", "false", "info", "", "")
 	if err != nil {
 		t.Fatalf("failed test %#v", err)
 	}
@@ -402,6 +641,13 @@ func TestPluginFlusher(t *testing.T) {
 	testplugin.addrecord(0, 0, testrecords)
 	plugin = testplugin
 	context = &testPluginContext{}
+	s3operators = []*s3operator{{
+		bucket:    "examplebucket",
+		prefix:    "exampleprefix",
+		logger:    newLogger(log.InfoLevel),
+		location:  time.UTC,
+		formatter: &jsonFormatter{},
+	}}
 	res := FLBPluginFlushCtx(nil, nil, 0, nil)
 	assert.Equal(t, output.FLB_OK, res)
 	assert.Len(t, testplugin.events, 1) // event length should be 1.
@@ -413,3 +659,129 @@ func TestPluginFlusher(t *testing.T) {
 `
 	assert.Equal(t, expected, string(testplugin.events[0].data))
 }
+
+func TestPluginFlusherWithSingleValue(t *testing.T) {
+	testplugin := &testFluentPlugin{}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"log": []byte("first line\n"), "stream": "stdout"})
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"stream": "stderr"})
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"log": "second line"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3operators = []*s3operator{{
+		bucket:       "examplebucket",
+		prefix:       "exampleprefix",
+		logger:       newLogger(log.InfoLevel),
+		location:     time.UTC,
+		outputFormat: singleValueOutputFormat,
+		formatter:    &singleValueFormatter{key: "log"},
+	}}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Len(t, testplugin.events, 1)
+	assert.Equal(t, "first line\nsecond line\n", string(testplugin.events[0].data))
+}
+
+func TestPluginFlusherWithBuffering(t *testing.T) {
+	testplugin := &testFluentPlugin{}
+	testrecords := map[interface{}]interface{}{
+		"mykey": "myvalue",
+	}
+	testplugin.addrecord(0, 0, testrecords)
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3operators = []*s3operator{{
+		bucket:        "examplebucket",
+		prefix:        "exampleprefix",
+		logger:        newLogger(log.InfoLevel),
+		location:      time.UTC,
+		formatter:     &jsonFormatter{},
+		buffer:        newRecordBuffers(nil),
+		totalFileSize: 40,
+		uploadTimeout: time.Hour,
+		done:          make(chan struct{}),
+	}}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Len(t, testplugin.events, 0) // below TotalFileSize, still buffered.
+
+	testplugin.addrecord(0, 0, testrecords)
+	testplugin.addrecord(0, 0, testrecords)
+	res = FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Len(t, testplugin.events, 1)
+	expected := `{"mykey":"myvalue"}
+{"mykey":"myvalue"}
+{"mykey":"myvalue"}
+`
+	assert.Equal(t, expected, string(testplugin.events[0].data))
+
+	testplugin.addrecord(0, 0, testrecords)
+	res = FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Len(t, testplugin.events, 1)
+
+	res = FLBPluginExit()
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Len(t, testplugin.events, 2) // remaining records are uploaded on exit.
+	assert.Equal(t, "{\"mykey\":\"myvalue\"}\n", string(testplugin.events[1].data))
+}
+
+func TestPluginFlusherWithRecordKeyPartitions(t *testing.T) {
+	f, err := newObjectKeyFormatter("%{path}/%{$.kubernetes.namespace_name}/%{index}.log")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	testplugin := &testFluentPlugin{}
+	for _, namespace := range []string{"default", "kube-system", "default"} {
+		testplugin.addrecord(0, 0, map[interface{}]interface{}{
+			"kubernetes": map[interface{}]interface{}{"namespace_name": namespace},
+		})
+	}
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3operators = []*s3operator{{
+		prefix:       "exampleprefix",
+		logger:       newLogger(log.InfoLevel),
+		location:     time.UTC,
+		formatter:    &jsonFormatter{},
+		keyFormatter: f,
+	}}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Len(t, testplugin.events, 2, "records are split by namespace")
+	assert.Equal(t, "exampleprefix/default/0.log", testplugin.events[0].objectKey)
+	assert.Equal(t, "exampleprefix/kube-system/0.log", testplugin.events[1].objectKey)
+}
+
+func TestPluginFlusherWithEventTime(t *testing.T) {
+	testplugin := &testFluentPlugin{}
+	ts := time.Date(2019, time.March, 10, 10, 59, 59, 0, time.UTC)
+	testplugin.addrecord(0, output.FLBTime{Time: ts}, map[interface{}]interface{}{"mykey": "first"})
+	testplugin.addrecord(0, output.FLBTime{Time: ts.Add(time.Second)}, map[interface{}]interface{}{"mykey": "second"})
+	testplugin.addrecord(0, output.FLBTime{Time: ts.Add(-time.Minute)}, map[interface{}]interface{}{"mykey": "third"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3operators = []*s3operator{{
+		prefix:        "exampleprefix",
+		logger:        newLogger(log.InfoLevel),
+		timeFormat:    "20060102/15",
+		location:      time.UTC,
+		formatter:     &jsonFormatter{},
+		useEventTime:  true,
+		timeKey:       "time",
+		timeKeyFormat: time.RFC3339,
+	}}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Len(t, testplugin.events, 2, "records are split by hour")
+	assert.Equal(t, "exampleprefix/20190310/10/20190310105959.log", testplugin.events[0].objectKey)
+	lines := strings.Split(string(testplugin.events[0].data), "\n")
+	assert.Len(t, lines, 3)
+	assert.JSONEq(t, `{"mykey":"first","time":"2019-03-10T10:59:59Z"}`, lines[0])
+	assert.JSONEq(t, `{"mykey":"third","time":"2019-03-10T10:58:59Z"}`, lines[1])
+	assert.Equal(t, "exampleprefix/20190310/11/20190310110000.log", testplugin.events[1].objectKey)
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/json-iterator/go"
+	"github.com/klauspost/compress/snappy"
+)
+
+// Minimal Apache Parquet writer. Each object is written as a single row group
+// with one PLAIN encoded data page per column. All columns are OPTIONAL and flat;
+// nested values are stored as JSON text.
+// See https://github.com/apache/parquet-format
+
+type parquetType int32
+
+// Physical types of parquet.thrift
+const (
+	parquetBoolean   parquetType = 0
+	parquetInt64     parquetType = 2
+	parquetDouble    parquetType = 5
+	parquetByteArray parquetType = 6
+)
+
+const (
+	parquetMagic            = "PAR1"
+	parquetCreatedBy        = "fluent-bit-go-s3"
+	parquetRepetitionOpt    = 1
+	parquetConvertedUTF8    = 0
+	parquetEncodingPlain    = 0
+	parquetEncodingRLE      = 3
+	parquetCodecUncompress  = 0
+	parquetCodecSnappy      = 1
+	parquetCodecGzip        = 2
+	parquetCodecZstd        = 6
+	parquetCodecLZ4Raw      = 7
+	parquetPageTypeDataPage = 0
+)
+
+type parquetColumn struct {
+	name string
+	typ  parquetType
+}
+
+// parseParquetSchema parses a schema such as "time:string,status:int64,ratio:double,ok:boolean".
+func parseParquetSchema(schema string) ([]parquetColumn, error) {
+	var columns []parquetColumn
+	for _, field := range strings.Split(schema, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid parquetSchema field: %v", field)
+		}
+		column := parquetColumn{name: strings.TrimSpace(parts[0])}
+		switch strings.ToLower(strings.TrimSpace(parts[1])) {
+		case "string":
+			column.typ = parquetByteArray
+		case "int", "int64":
+			column.typ = parquetInt64
+		case "float", "double":
+			column.typ = parquetDouble
+		case "bool", "boolean":
+			column.typ = parquetBoolean
+		default:
+			return nil, fmt.Errorf("invalid parquetSchema type: %v", parts[1])
+		}
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("parquetSchema has no fields: %v", schema)
+	}
+	return columns, nil
+}
+
+type jsonKind int
+
+const (
+	jsonNull jsonKind = iota
+	jsonBool
+	jsonInt
+	jsonFloat
+	jsonString
+	jsonOther
+)
+
+func kindOfJSON(raw jsoniter.RawMessage) jsonKind {
+	s := strings.TrimSpace(string(raw))
+	switch {
+	case s == "" || s == "null":
+		return jsonNull
+	case s == "true" || s == "false":
+		return jsonBool
+	case s[0] == '"':
+		return jsonString
+	case s[0] == '{' || s[0] == '[':
+		return jsonOther
+	}
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return jsonInt
+	}
+	return jsonFloat
+}
+
+// inferParquetSchema builds columns from the keys of all rows, sorted by name.
+func inferParquetSchema(rows []map[string]jsoniter.RawMessage) []parquetColumn {
+	kinds := make(map[string]map[jsonKind]bool)
+	for _, row := range rows {
+		for k, v := range row {
+			if kinds[k] == nil {
+				kinds[k] = make(map[jsonKind]bool)
+			}
+			kinds[k][kindOfJSON(v)] = true
+		}
+	}
+
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	columns := make([]parquetColumn, 0, len(names))
+	for _, name := range names {
+		k := kinds[name]
+		delete(k, jsonNull)
+		typ := parquetByteArray
+		switch {
+		case len(k) == 0 || k[jsonString] || k[jsonOther]:
+			typ = parquetByteArray
+		case k[jsonBool] && len(k) == 1:
+			typ = parquetBoolean
+		case k[jsonBool]:
+			typ = parquetByteArray
+		case k[jsonFloat]:
+			typ = parquetDouble
+		case k[jsonInt]:
+			typ = parquetInt64
+		}
+		columns = append(columns, parquetColumn{name: name, typ: typ})
+	}
+	return columns
+}
+
+// makeParquet converts JSON lines into a parquet file. When columns is nil,
+// the schema is inferred from the records, and nil is returned if they have no
+// keys since readers reject a file without columns.
+func makeParquet(lines []byte, columns []parquetColumn, compressFormat format, level int) ([]byte, error) {
+	var rows []map[string]jsoniter.RawMessage
+	for _, line := range bytes.Split(lines, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var row map[string]jsoniter.RawMessage
+		if err := jsoniter.Unmarshal(line, &row); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	if columns == nil {
+		columns = inferParquetSchema(rows)
+	}
+	if len(columns) == 0 {
+		return nil, nil
+	}
+
+	codec := int32(parquetCodecUncompress)
+	compress := func(page []byte) ([]byte, error) {
+		return page, nil
+	}
+	switch compressFormat {
+	case gzipFormat:
+		codec = parquetCodecGzip
+		compress = func(page []byte) ([]byte, error) {
+			return makeGzipWithLevel(page, level)
+		}
+	case snappyFormat:
+		codec = parquetCodecSnappy
+		compress = func(page []byte) ([]byte, error) {
+			return snappy.Encode(nil, page), nil
+		}
+	case lz4Format:
+		codec = parquetCodecLZ4Raw
+		compress = func(page []byte) ([]byte, error) {
+			return encodeLZ4Block(page, level)
+		}
+	case zstdFormat:
+		codec = parquetCodecZstd
+		compress = func(page []byte) ([]byte, error) {
+			return makeZstd(page, level)
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString(parquetMagic)
+
+	chunks := make([]*thriftStruct, 0, len(columns))
+	var totalByteSize int64
+	for _, column := range columns {
+		page, err := encodeParquetPage(rows, column)
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := compress(page)
+		if err != nil {
+			return nil, err
+		}
+
+		header := newThriftStruct()
+		header.i32(1, parquetPageTypeDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(compressed)))
+		dataPageHeader := newThriftStruct()
+		dataPageHeader.i32(1, int32(len(rows)))
+		dataPageHeader.i32(2, parquetEncodingPlain)
+		dataPageHeader.i32(3, parquetEncodingRLE)
+		dataPageHeader.i32(4, parquetEncodingRLE)
+		header.structField(5, dataPageHeader)
+		headerBytes := header.bytes()
+
+		offset := int64(b.Len())
+		b.Write(headerBytes)
+		b.Write(compressed)
+
+		metaData := newThriftStruct()
+		metaData.i32(1, int32(column.typ))
+		metaData.i32List(2, []int32{parquetEncodingPlain, parquetEncodingRLE})
+		metaData.stringList(3, []string{column.name})
+		metaData.i32(4, codec)
+		metaData.i64(5, int64(len(rows)))
+		metaData.i64(6, int64(len(headerBytes)+len(page)))
+		metaData.i64(7, int64(len(headerBytes)+len(compressed)))
+		metaData.i64(9, offset)
+		totalByteSize += int64(len(headerBytes) + len(page))
+
+		chunk := newThriftStruct()
+		chunk.i64(2, offset)
+		chunk.structField(3, metaData)
+		chunks = append(chunks, chunk)
+	}
+
+	schema := make([]*thriftStruct, 0, len(columns)+1)
+	root := newThriftStruct()
+	root.binary(4, "schema")
+	root.i32(5, int32(len(columns)))
+	schema = append(schema, root)
+	for _, column := range columns {
+		element := newThriftStruct()
+		element.i32(1, int32(column.typ))
+		element.i32(3, parquetRepetitionOpt)
+		element.binary(4, column.name)
+		if column.typ == parquetByteArray {
+			element.i32(6, parquetConvertedUTF8)
+		}
+		schema = append(schema, element)
+	}
+
+	rowGroup := newThriftStruct()
+	rowGroup.structList(1, chunks)
+	rowGroup.i64(2, totalByteSize)
+	rowGroup.i64(3, int64(len(rows)))
+
+	fileMetaData := newThriftStruct()
+	fileMetaData.i32(1, 1)
+	fileMetaData.structList(2, schema)
+	fileMetaData.i64(3, int64(len(rows)))
+	fileMetaData.structList(4, []*thriftStruct{rowGroup})
+	fileMetaData.binary(6, parquetCreatedBy)
+	footer := fileMetaData.bytes()
+
+	b.Write(footer)
+	binary.Write(&b, binary.LittleEndian, uint32(len(footer)))
+	b.WriteString(parquetMagic)
+	return b.Bytes(), nil
+}
+
+// encodeParquetPage returns the definition levels and PLAIN encoded values of a column.
+func encodeParquetPage(rows []map[string]jsoniter.RawMessage, column parquetColumn) ([]byte, error) {
+	levels := make([]byte, 0, len(rows))
+	var values bytes.Buffer
+	var bits []bool
+
+	for _, row := range rows {
+		raw, ok := row[column.name]
+		if !ok || kindOfJSON(raw) == jsonNull {
+			levels = append(levels, 0)
+			continue
+		}
+
+		switch column.typ {
+		case parquetByteArray:
+			s := string(raw)
+			if kindOfJSON(raw) == jsonString {
+				if err := jsoniter.Unmarshal(raw, &s); err != nil {
+					return nil, err
+				}
+			}
+			binary.Write(&values, binary.LittleEndian, uint32(len(s)))
+			values.WriteString(s)
+		case parquetInt64:
+			n, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+			if err != nil {
+				levels = append(levels, 0)
+				continue
+			}
+			binary.Write(&values, binary.LittleEndian, n)
+		case parquetDouble:
+			f, err := strconv.ParseFloat(strings.TrimSpace(string(raw)), 64)
+			if err != nil {
+				levels = append(levels, 0)
+				continue
+			}
+			binary.Write(&values, binary.LittleEndian, math.Float64bits(f))
+		case parquetBoolean:
+			if kindOfJSON(raw) != jsonBool {
+				levels = append(levels, 0)
+				continue
+			}
+			bits = append(bits, strings.TrimSpace(string(raw)) == "true")
+		}
+		levels = append(levels, 1)
+	}
+
+	if column.typ == parquetBoolean {
+		packed := make([]byte, (len(bits)+7)/8)
+		for i, bit := range bits {
+			if bit {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		values.Write(packed)
+	}
+
+	encodedLevels := encodeRLE(levels)
+	var page bytes.Buffer
+	binary.Write(&page, binary.LittleEndian, uint32(len(encodedLevels)))
+	page.Write(encodedLevels)
+	page.Write(values.Bytes())
+	return page.Bytes(), nil
+}
+
+// encodeRLE encodes definition levels of bit width 1 as RLE runs of the hybrid encoding.
+func encodeRLE(levels []byte) []byte {
+	var b []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		b = appendUvarint(b, uint64(j-i)<<1)
+		b = append(b, levels[i])
+		i = j
+	}
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	return append(b, buf[:n]...)
+}
+
+// Thrift compact protocol types
+const (
+	thriftTypeI32    = 5
+	thriftTypeI64    = 6
+	thriftTypeBinary = 8
+	thriftTypeList   = 9
+	thriftTypeStruct = 12
+)
+
+// thriftStruct serializes a struct with the thrift compact protocol.
+// Fields must be added in ascending order of their ids.
+type thriftStruct struct {
+	b    bytes.Buffer
+	last int16
+}
+
+func newThriftStruct() *thriftStruct {
+	return &thriftStruct{}
+}
+
+func (s *thriftStruct) fieldHeader(id int16, typ byte) {
+	delta := id - s.last
+	if delta > 0 && delta <= 15 {
+		s.b.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		s.b.WriteByte(typ)
+		s.b.Write(appendUvarint(nil, zigzag(int64(id))))
+	}
+	s.last = id
+}
+
+func (s *thriftStruct) listHeader(size int, typ byte) {
+	if size < 15 {
+		s.b.WriteByte(byte(size)<<4 | typ)
+	} else {
+		s.b.WriteByte(0xf0 | typ)
+		s.b.Write(appendUvarint(nil, uint64(size)))
+	}
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (s *thriftStruct) i32(id int16, v int32) {
+	s.fieldHeader(id, thriftTypeI32)
+	s.b.Write(appendUvarint(nil, zigzag(int64(v))))
+}
+
+func (s *thriftStruct) i64(id int16, v int64) {
+	s.fieldHeader(id, thriftTypeI64)
+	s.b.Write(appendUvarint(nil, zigzag(v)))
+}
+
+func (s *thriftStruct) binary(id int16, v string) {
+	s.fieldHeader(id, thriftTypeBinary)
+	s.b.Write(appendUvarint(nil, uint64(len(v))))
+	s.b.WriteString(v)
+}
+
+func (s *thriftStruct) structField(id int16, v *thriftStruct) {
+	s.fieldHeader(id, thriftTypeStruct)
+	s.b.Write(v.bytes())
+}
+
+func (s *thriftStruct) i32List(id int16, vs []int32) {
+	s.fieldHeader(id, thriftTypeList)
+	s.listHeader(len(vs), thriftTypeI32)
+	for _, v := range vs {
+		s.b.Write(appendUvarint(nil, zigzag(int64(v))))
+	}
+}
+
+func (s *thriftStruct) stringList(id int16, vs []string) {
+	s.fieldHeader(id, thriftTypeList)
+	s.listHeader(len(vs), thriftTypeBinary)
+	for _, v := range vs {
+		s.b.Write(appendUvarint(nil, uint64(len(v))))
+		s.b.WriteString(v)
+	}
+}
+
+func (s *thriftStruct) structList(id int16, vs []*thriftStruct) {
+	s.fieldHeader(id, thriftTypeList)
+	s.listHeader(len(vs), thriftTypeStruct)
+	for _, v := range vs {
+		s.b.Write(v.bytes())
+	}
+}
+
+// bytes returns the serialized struct terminated by a stop field.
+func (s *thriftStruct) bytes() []byte {
+	return append(append([]byte(nil), s.b.Bytes()...), 0)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/json-iterator/go"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseParquetSchema(t *testing.T) {
+	columns, err := parseParquetSchema("log:string, status:int64,ratio:double,ok:boolean")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, []parquetColumn{
+		{name: "log", typ: parquetByteArray},
+		{name: "status", typ: parquetInt64},
+		{name: "ratio", typ: parquetDouble},
+		{name: "ok", typ: parquetBoolean},
+	}, columns)
+
+	_, err = parseParquetSchema("log:text")
+	assert.Equal(t, errors.New("invalid parquetSchema type: text"), err)
+	_, err = parseParquetSchema("log")
+	assert.Equal(t, errors.New("invalid parquetSchema field: log"), err)
+}
+
+func TestInferParquetSchema(t *testing.T) {
+	rows := []map[string]jsoniter.RawMessage{
+		{"log": jsoniter.RawMessage(`"hello"`), "n": jsoniter.RawMessage(`1`), "f": jsoniter.RawMessage(`1`), "ok": jsoniter.RawMessage(`true`)},
+		{"n": jsoniter.RawMessage(`null`), "f": jsoniter.RawMessage(`1.5`), "nested": jsoniter.RawMessage(`{"a":1}`), "mixed": jsoniter.RawMessage(`true`)},
+		{"mixed": jsoniter.RawMessage(`1`)},
+	}
+	assert.Equal(t, []parquetColumn{
+		{name: "f", typ: parquetDouble},
+		{name: "log", typ: parquetByteArray},
+		{name: "mixed", typ: parquetByteArray},
+		{name: "n", typ: parquetInt64},
+		{name: "nested", typ: parquetByteArray},
+		{name: "ok", typ: parquetBoolean},
+	}, inferParquetSchema(rows))
+}
+
+func TestEncodeRLE(t *testing.T) {
+	assert.Equal(t, []byte{0x06, 0x01, 0x02, 0x00, 0x02, 0x01}, encodeRLE([]byte{1, 1, 1, 0, 1}))
+}
+
+func TestThriftStruct(t *testing.T) {
+	s := newThriftStruct()
+	s.i32(1, 1)
+	s.binary(4, "ab")
+	s.i64(20, -1)
+	assert.Equal(t, []byte{0x15, 0x02, 0x38, 0x02, 'a', 'b', 0x06, 0x28, 0x01, 0x00}, s.bytes())
+}
+
+// thriftReader decodes the thrift compact protocol into maps keyed by field ids.
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftTypeI32, thriftTypeI64:
+		v := r.uvarint()
+		return int64(v>>1) ^ -int64(v&1)
+	case thriftTypeBinary:
+		n := int(r.uvarint())
+		r.pos += n
+		return string(r.b[r.pos-n : r.pos])
+	case thriftTypeList:
+		header := r.b[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case thriftTypeStruct:
+		return r.structValue()
+	}
+	return fmt.Errorf("unexpected thrift type %d at %d", typ, r.pos)
+}
+
+func (r *thriftReader) structValue() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var last int16
+	for {
+		header := r.b[r.pos]
+		r.pos++
+		if header == 0 {
+			return fields
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			v := r.uvarint()
+			id = int16(int64(v>>1) ^ -int64(v&1))
+		}
+		fields[id] = r.value(header & 0x0f)
+		last = id
+	}
+}
+
+type parquetFile struct {
+	numRows int64
+	columns []parquetColumn
+	values  map[string][]interface{}
+}
+
+// readParquet reads back the footer and the data pages of a parquet file.
+func readParquet(t *testing.T, body []byte) *parquetFile {
+	t.Helper()
+	if !bytes.HasPrefix(body, []byte(parquetMagic)) || !bytes.HasSuffix(body, []byte(parquetMagic)) {
+		t.Fatalf("parquet file is not enclosed by magic: %q", body)
+	}
+	footerLen := int(binary.LittleEndian.Uint32(body[len(body)-8 : len(body)-4]))
+	footer := &thriftReader{b: body[:len(body)-8], pos: len(body) - 8 - footerLen}
+	fileMetaData := footer.structValue()
+	if footer.pos != len(body)-8 {
+		t.Fatalf("footer is %d bytes, but %d bytes are read", footerLen, footer.pos-(len(body)-8-footerLen))
+	}
+	assert.Equal(t, int64(1), fileMetaData[1], "version")
+	assert.Equal(t, parquetCreatedBy, fileMetaData[6])
+
+	file := &parquetFile{numRows: fileMetaData[3].(int64), values: make(map[string][]interface{})}
+	schema := fileMetaData[2].([]interface{})
+	root := schema[0].(map[int16]interface{})
+	assert.Equal(t, "schema", root[4])
+	assert.Equal(t, int64(len(schema)-1), root[5], "num_children")
+	for _, element := range schema[1:] {
+		element := element.(map[int16]interface{})
+		assert.Equal(t, int64(parquetRepetitionOpt), element[3])
+		column := parquetColumn{name: element[4].(string), typ: parquetType(element[1].(int64))}
+		if column.typ == parquetByteArray {
+			assert.Equal(t, int64(parquetConvertedUTF8), element[6], "strings are UTF8")
+		}
+		file.columns = append(file.columns, column)
+	}
+
+	rowGroups := fileMetaData[4].([]interface{})
+	assert.Len(t, rowGroups, 1)
+	rowGroup := rowGroups[0].(map[int16]interface{})
+	assert.Equal(t, file.numRows, rowGroup[3])
+	chunks := rowGroup[1].([]interface{})
+	assert.Len(t, chunks, len(file.columns))
+	var totalByteSize int64
+	for i, chunk := range chunks {
+		chunk := chunk.(map[int16]interface{})
+		metaData := chunk[3].(map[int16]interface{})
+		column := file.columns[i]
+		assert.Equal(t, int64(column.typ), metaData[1])
+		assert.Equal(t, []interface{}{column.name}, metaData[3], "path_in_schema")
+		assert.Equal(t, file.numRows, metaData[5], "num_values")
+		offset := metaData[9].(int64)
+		assert.Equal(t, offset, chunk[2], "file_offset")
+
+		page := &thriftReader{b: body, pos: int(offset)}
+		header := page.structValue()
+		headerLen := int64(page.pos) - offset
+		assert.Equal(t, int64(parquetPageTypeDataPage), header[1])
+		assert.Equal(t, headerLen+header[2].(int64), metaData[6], "total_uncompressed_size")
+		assert.Equal(t, headerLen+header[3].(int64), metaData[7], "total_compressed_size")
+		totalByteSize += metaData[6].(int64)
+		dataPageHeader := header[5].(map[int16]interface{})
+		assert.Equal(t, file.numRows, dataPageHeader[1])
+		assert.Equal(t, int64(parquetEncodingPlain), dataPageHeader[2])
+
+		compressed := body[page.pos : page.pos+int(header[3].(int64))]
+		data := decompressParquetPage(t, metaData[4].(int64), compressed)
+		assert.Len(t, data, int(header[2].(int64)))
+		file.values[column.name] = decodeParquetPage(t, data, column.typ, int(file.numRows))
+	}
+	assert.Equal(t, totalByteSize, rowGroup[2], "total_byte_size")
+	return file
+}
+
+func decompressParquetPage(t *testing.T, codec int64, page []byte) []byte {
+	t.Helper()
+	switch codec {
+	case parquetCodecUncompress:
+		return page
+	case parquetCodecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(page))
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		return data
+	case parquetCodecSnappy:
+		data, err := snappy.Decode(nil, page)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		return data
+	case parquetCodecLZ4Raw:
+		data := make([]byte, 1<<20)
+		n, err := lz4.UncompressBlock(page, data)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		return data[:n]
+	case parquetCodecZstd:
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		defer decoder.Close()
+		data, err := decoder.DecodeAll(page, nil)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		return data
+	}
+	t.Fatalf("unexpected codec %d", codec)
+	return nil
+}
+
+// decodeParquetPage decodes the definition levels and PLAIN values of a page,
+// where nulls are nil.
+func decodeParquetPage(t *testing.T, page []byte, typ parquetType, numValues int) []interface{} {
+	t.Helper()
+	levelsLen := int(binary.LittleEndian.Uint32(page))
+	levels := &thriftReader{b: page[4 : 4+levelsLen]}
+	var defined []bool
+	for levels.pos < len(levels.b) {
+		header := levels.uvarint()
+		if header&1 == 1 {
+			// A bit-packed run of groups of 8 values
+			for i := 0; i < int(header>>1)*8; i++ {
+				defined = append(defined, levels.b[levels.pos+i/8]&(1<<uint(i%8)) != 0)
+			}
+			levels.pos += int(header >> 1)
+			continue
+		}
+		value := levels.b[levels.pos]
+		levels.pos++
+		for i := 0; i < int(header>>1); i++ {
+			defined = append(defined, value == 1)
+		}
+	}
+	if len(defined) < numValues {
+		t.Fatalf("%d definition levels for %d values", len(defined), numValues)
+	}
+
+	data := page[4+levelsLen:]
+	values := make([]interface{}, numValues)
+	bit := 0
+	for i := range values {
+		if !defined[i] {
+			continue
+		}
+		switch typ {
+		case parquetByteArray:
+			n := int(binary.LittleEndian.Uint32(data))
+			values[i] = string(data[4 : 4+n])
+			data = data[4+n:]
+		case parquetInt64:
+			values[i] = int64(binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case parquetDouble:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case parquetBoolean:
+			values[i] = data[bit/8]&(1<<uint(bit%8)) != 0
+			bit++
+		}
+	}
+	if typ == parquetBoolean {
+		data = data[(bit+7)/8:]
+	}
+	assert.Len(t, data, 0, "all values are read")
+	return values
+}
+
+func TestMakeParquet(t *testing.T) {
+	lines := []byte("{\"log\":\"hello\",\"n\":1,\"f\":1.5,\"ok\":true}\n" +
+		"{\"log\":\"world\",\"n\":null,\"f\":2,\"ok\":false,\"nested\":{\"a\":1}}\n" +
+		"\n" +
+		"{\"n\":-3}\n")
+
+	for compressFormat, c := range codecs {
+		body, err := makeParquet(lines, nil, compressFormat, c.defaultLevel)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		file := readParquet(t, body)
+		assert.Equal(t, int64(3), file.numRows)
+		assert.Equal(t, []parquetColumn{
+			{name: "f", typ: parquetDouble},
+			{name: "log", typ: parquetByteArray},
+			{name: "n", typ: parquetInt64},
+			{name: "nested", typ: parquetByteArray},
+			{name: "ok", typ: parquetBoolean},
+		}, file.columns)
+		assert.Equal(t, map[string][]interface{}{
+			"f":      {1.5, 2.0, nil},
+			"log":    {"hello", "world", nil},
+			"n":      {int64(1), nil, int64(-3)},
+			"nested": {nil, `{"a":1}`, nil},
+			"ok":     {true, false, nil},
+		}, file.values)
+	}
+}
+
+func TestMakeParquetWithSchema(t *testing.T) {
+	columns := []parquetColumn{
+		{name: "log", typ: parquetByteArray},
+		{name: "status", typ: parquetInt64},
+	}
+	body, err := makeParquet([]byte("{\"log\":\"hello\",\"status\":\"ok\",\"dropped\":1}\n"), columns, plainTextFormat, -1)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	file := readParquet(t, body)
+	assert.Equal(t, columns, file.columns)
+	assert.Equal(t, map[string][]interface{}{
+		"log":    {"hello"},
+		"status": {nil},
+	}, file.values, "values which do not fit the column type are null")
+
+	body, err = makeParquet(nil, columns, plainTextFormat, -1)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	file = readParquet(t, body)
+	assert.Equal(t, int64(0), file.numRows)
+	assert.Equal(t, columns, file.columns, "the schema is written without rows")
+}
+
+func TestNewS3OutputWithParquetAndBzip2(t *testing.T) {
+	s3Creds = &testS3Credential{}
+	plugin = &testFluentPlugin{
+		credential:       "examplecredentials",
+		bucket:           "examplebucket",
+		s3prefix:         "exampleprefix",
+		region:           "exampleregion",
+		autoCreateBucket: "false",
+		logLevel:         "info",
+		format:           "parquet",
+		compress:         "bzip2",
+	}
+	_, err := newS3Output(nil, 0)
+	assert.Equal(t, errors.New("compress bzip2 is not available with format parquet"), err)
+}
+
+func TestMakeParquetWithoutColumns(t *testing.T) {
+	for _, lines := range []string{"", "\n", "{}\n{}\n"} {
+		body, err := makeParquet([]byte(lines), nil, plainTextFormat, -1)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		assert.Nil(t, body, "a file without columns is not written")
+	}
+
+	svc := newFakeS3()
+	s3operator := &s3operator{
+		bucket:       "examplebucket",
+		uploader:     s3manager.NewUploaderWithClient(svc),
+		outputFormat: parquetOutputFormat,
+		logger:       newLogger(log.InfoLevel),
+		metrics:      newOperatorMetrics(0, "examplebucket"),
+	}
+	if err := (&fluentPlugin{}).Put(s3operator, "exampleprefix/object.parquet", time.Now(), "{}\n"); err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Len(t, svc.requests, 0, "nothing is uploaded")
+}
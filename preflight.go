@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	// context is the name of the plugin context in this package.
+	gocontext "context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// preflightTimeout bounds each request of the preflight.
+	preflightTimeout = 10 * time.Second
+	// preflightObjectName is the name of the object written under the prefix by the preflight.
+	preflightObjectName = ".fluent-bit-go-s3-preflight"
+)
+
+// preflightConfig enables the validation of the bucket on start.
+type preflightConfig struct {
+	// strict aborts the initialization when the preflight fails.
+	strict bool
+}
+
+func getPreflightConfig(preflight, strict string) (*preflightConfig, error) {
+	enabled := false
+	if preflight != "" {
+		var err error
+		enabled, err = strconv.ParseBool(preflight)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preflight: %v", preflight)
+		}
+	}
+
+	conf := &preflightConfig{}
+	if strict != "" {
+		isStrict, err := strconv.ParseBool(strict)
+		if err != nil {
+			return nil, fmt.Errorf("invalid strict: %v", strict)
+		}
+		if isStrict && !enabled {
+			return nil, fmt.Errorf("strict requires preflight")
+		}
+		conf.strict = isStrict
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+	return conf, nil
+}
+
+// preflightFailure is a check of the preflight which failed.
+type preflightFailure struct {
+	// check is the request or the comparison which failed, e.g. HeadBucket.
+	check string
+	// permissions are the IAM permissions which the check requires.
+	permissions []string
+	reason      string
+	err         error
+}
+
+func (f *preflightFailure) String() string {
+	var b strings.Builder
+	b.WriteString(f.check)
+	if len(f.permissions) > 0 {
+		fmt.Fprintf(&b, " (requires %s)", strings.Join(f.permissions, ", "))
+	}
+	fmt.Fprintf(&b, ": %s", f.reason)
+	if f.err != nil {
+		fmt.Fprintf(&b, ": %v", f.err)
+	}
+	return b.String()
+}
+
+// preflightError describes every check of the preflight which failed.
+type preflightError struct {
+	bucket   string
+	failures []*preflightFailure
+}
+
+func (e *preflightError) Error() string {
+	messages := make([]string, 0, len(e.failures))
+	for _, f := range e.failures {
+		messages = append(messages, f.String())
+	}
+	return fmt.Sprintf("preflight of bucket %s failed: %s", e.bucket, strings.Join(messages, "; "))
+}
+
+// preflight confirms that the bucket exists in the configured region and that
+// objects can be written under the prefix with the configured attributes and
+// encryption. It returns a *preflightError which lists every failed check.
+func (s3operator *s3operator) preflight(region string) error {
+	e := &preflightError{bucket: s3operator.bucket}
+
+	if f := s3operator.preflightHeadBucket(region); f != nil {
+		e.failures = append(e.failures, f)
+		// The bucket is not usable at all, so writing objects fails for the same reason.
+		return e
+	}
+
+	objectKey := path.Join(s3operator.prefix, preflightObjectName)
+	written, failures := s3operator.preflightPutObject(objectKey)
+	e.failures = append(e.failures, failures...)
+	if written {
+		if f := s3operator.preflightDeleteObject(objectKey); f != nil {
+			e.failures = append(e.failures, f)
+		}
+	}
+
+	if len(e.failures) > 0 {
+		return e
+	}
+	return nil
+}
+
+func (s3operator *s3operator) preflightHeadBucket(region string) *preflightFailure {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), preflightTimeout)
+	defer cancel()
+
+	err := s3operator.checkBucket(ctx)
+	if err == nil {
+		return nil
+	}
+	f := &preflightFailure{check: "HeadBucket", err: err}
+	code := ""
+	if aerr, ok := err.(awserr.Error); ok {
+		code = aerr.Code()
+	}
+	switch code {
+	case "BucketRegionError":
+		f.reason = fmt.Sprintf("the bucket is not in the configured region %s", region)
+	case "NotFound", s3.ErrCodeNoSuchBucket:
+		f.reason = "the bucket does not exist (see AutoCreateBucket)"
+	case "Forbidden", "AccessDenied":
+		f.permissions = []string{"s3:ListBucket"}
+		f.reason = "access to the bucket is denied"
+	default:
+		f.reason = "the bucket is not reachable"
+	}
+	return f
+}
+
+// preflightPutObject writes an empty object with the attributes of uploads. It
+// reports whether the object was written.
+func (s3operator *s3operator) preflightPutObject(objectKey string) (bool, []*preflightFailure) {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), preflightTimeout)
+	defer cancel()
+
+	// Uploads of s3manager are PutObject requests copied from UploadInput in the same way.
+	input := &s3.PutObjectInput{}
+	awsutil.Copy(input, newUploadInput(s3operator, objectKey, nil))
+	input.Body = bytes.NewReader(nil)
+	opts := append(s3operator.sse.requestOptions(), s3operator.integrity.requestOptions()...)
+	output, err := s3operator.client.PutObjectWithContext(ctx, input, opts...)
+	if err != nil {
+		f := &preflightFailure{
+			check:       "PutObject",
+			permissions: s3operator.putObjectPermissions(),
+			reason:      fmt.Sprintf("cannot write %s", objectKey),
+			err:         err,
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "AccessDenied" && (s3operator.sse == nil || s3operator.sse.algorithm == "") {
+			f.reason += " (the bucket policy may require ServerSideEncryption)"
+		}
+		return false, []*preflightFailure{f}
+	}
+
+	var failures []*preflightFailure
+	if s3operator.sse != nil && s3operator.sse.algorithm != "" {
+		if actual := aws.StringValue(output.ServerSideEncryption); actual != s3operator.sse.algorithm {
+			failures = append(failures, &preflightFailure{
+				check:  "ServerSideEncryption",
+				reason: fmt.Sprintf("%s is encrypted with '%s' instead of %s", objectKey, actual, s3operator.sse.algorithm),
+			})
+		}
+	}
+	return true, failures
+}
+
+func (s3operator *s3operator) preflightDeleteObject(objectKey string) *preflightFailure {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), preflightTimeout)
+	defer cancel()
+
+	_, err := s3operator.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s3operator.bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err == nil {
+		return nil
+	}
+	return &preflightFailure{
+		check:       "DeleteObject",
+		permissions: []string{"s3:DeleteObject"},
+		reason:      fmt.Sprintf("cannot remove %s", objectKey),
+		err:         err,
+	}
+}
+
+// putObjectPermissions returns the IAM permissions which uploads require.
+func (s3operator *s3operator) putObjectPermissions() []string {
+	permissions := []string{"s3:PutObject"}
+	if c := s3operator.object; c != nil {
+		if c.acl != "" {
+			permissions = append(permissions, "s3:PutObjectAcl")
+		}
+		if c.tagging != "" {
+			permissions = append(permissions, "s3:PutObjectTagging")
+		}
+	}
+	if c := s3operator.sse; c != nil && c.algorithm == s3.ServerSideEncryptionAwsKms {
+		permissions = append(permissions, "kms:GenerateDataKey")
+	}
+	if c := s3operator.integrity; c != nil && c.verify {
+		permissions = append(permissions, "s3:GetObject")
+	}
+	return permissions
+}
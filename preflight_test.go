@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// preflightS3 answers the requests of the preflight with the given errors.
+type preflightS3 struct {
+	s3iface.S3API
+	headErr   error
+	putErr    error
+	deleteErr error
+	// encryption is the ServerSideEncryption which the bucket applies.
+	encryption string
+	puts       []*s3.PutObjectInput
+	deletes    []string
+}
+
+func (s *preflightS3) HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, s.headErr
+}
+
+func (s *preflightS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	s.puts = append(s.puts, input)
+	if s.putErr != nil {
+		return nil, s.putErr
+	}
+	output := &s3.PutObjectOutput{}
+	if s.encryption != "" {
+		output.ServerSideEncryption = aws.String(s.encryption)
+	}
+	return output, nil
+}
+
+func (s *preflightS3) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	s.deletes = append(s.deletes, *input.Key)
+	return &s3.DeleteObjectOutput{}, s.deleteErr
+}
+
+func TestGetPreflightConfig(t *testing.T) {
+	conf, err := getPreflightConfig("", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, conf, "the preflight is disabled by default")
+
+	conf, err = getPreflightConfig("true", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &preflightConfig{}, conf)
+
+	conf, err = getPreflightConfig("true", "true")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &preflightConfig{strict: true}, conf)
+
+	_, err = getPreflightConfig("always", "")
+	assert.Equal(t, errors.New("invalid preflight: always"), err)
+	_, err = getPreflightConfig("true", "yes!")
+	assert.Equal(t, errors.New("invalid strict: yes!"), err)
+	_, err = getPreflightConfig("", "true")
+	assert.Equal(t, errors.New("strict requires preflight"), err)
+}
+
+func newPreflightOperator(svc s3iface.S3API) *s3operator {
+	return &s3operator{
+		bucket:         "examplebucket",
+		prefix:         "exampleprefix",
+		logger:         newLogger(log.InfoLevel),
+		compressFormat: gzipFormat,
+		client:         svc,
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	svc := &preflightS3{}
+	s3mock := newPreflightOperator(svc)
+	s3mock.object = &objectConfig{storageClass: s3.StorageClassStandardIa}
+
+	assert.Nil(t, s3mock.preflight("us-east-1"))
+	assert.Len(t, svc.puts, 1)
+	assert.Equal(t, "exampleprefix/"+preflightObjectName, *svc.puts[0].Key)
+	assert.Equal(t, s3.StorageClassStandardIa, *svc.puts[0].StorageClass, "the object is written with the attributes of uploads")
+	assert.Equal(t, "gzip", *svc.puts[0].ContentEncoding)
+	assert.Equal(t, []string{"exampleprefix/" + preflightObjectName}, svc.deletes)
+}
+
+func TestPreflightReportsMissingBucket(t *testing.T) {
+	svc := &preflightS3{headErr: awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "id")}
+	err := newPreflightOperator(svc).preflight("us-east-1")
+
+	perr, ok := err.(*preflightError)
+	if !ok {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Len(t, perr.failures, 1)
+	assert.Equal(t, "HeadBucket", perr.failures[0].check)
+	assert.Contains(t, err.Error(), "preflight of bucket examplebucket failed: HeadBucket: the bucket does not exist")
+	assert.Len(t, svc.puts, 0, "objects are not written to a missing bucket")
+}
+
+func TestPreflightReportsRegionMismatch(t *testing.T) {
+	svc := &preflightS3{headErr: awserr.NewRequestFailure(awserr.New("BucketRegionError", "incorrect region, the bucket is not in 'us-east-1' region", nil), 301, "id")}
+	err := newPreflightOperator(svc).preflight("us-east-1")
+	assert.Contains(t, err.Error(), "HeadBucket: the bucket is not in the configured region us-east-1")
+}
+
+func TestPreflightReportsMissingPermissions(t *testing.T) {
+	svc := &preflightS3{
+		putErr: awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"),
+	}
+	s3mock := newPreflightOperator(svc)
+	s3mock.object = &objectConfig{acl: s3.ObjectCannedACLBucketOwnerFullControl, tagging: "team=infra"}
+	s3mock.sse = &sseConfig{algorithm: s3.ServerSideEncryptionAwsKms}
+	s3mock.integrity = &integrityConfig{verify: true}
+
+	err := s3mock.preflight("us-east-1")
+	assert.Contains(t, err.Error(), "PutObject (requires s3:PutObject, s3:PutObjectAcl, s3:PutObjectTagging, kms:GenerateDataKey, s3:GetObject): cannot write exampleprefix/"+preflightObjectName)
+	assert.Len(t, svc.deletes, 0)
+
+	svc = &preflightS3{
+		deleteErr: awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"),
+	}
+	err = newPreflightOperator(svc).preflight("us-east-1")
+	assert.Contains(t, err.Error(), "DeleteObject (requires s3:DeleteObject)")
+}
+
+func TestPreflightReportsEncryptionMismatch(t *testing.T) {
+	svc := &preflightS3{encryption: s3.ServerSideEncryptionAes256}
+	s3mock := newPreflightOperator(svc)
+	s3mock.sse = &sseConfig{algorithm: s3.ServerSideEncryptionAwsKms}
+
+	err := s3mock.preflight("us-east-1")
+	perr, ok := err.(*preflightError)
+	if !ok {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Len(t, perr.failures, 1)
+	assert.Equal(t, "ServerSideEncryption", perr.failures[0].check)
+	assert.True(t, strings.HasSuffix(err.Error(), "is encrypted with 'AES256' instead of aws:kms"), err.Error())
+	assert.Len(t, svc.deletes, 1, "the test object is removed anyway")
+}
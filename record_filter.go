@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// recordRuleSeparator separates the rules of IncludeRecords and ExcludeRecords.
+// Commas are not used since they often appear in regular expressions.
+const recordRuleSeparator = ";"
+
+// recordRule matches the value at path in a record with re.
+type recordRule struct {
+	path []string
+	re   *regexp.Regexp
+}
+
+func (r recordRule) match(record map[interface{}]interface{}) bool {
+	if _, ok := recordValue(record, r.path); !ok {
+		return false
+	}
+	return r.re.MatchString(recordKeyValue(record, r.path))
+}
+
+type renameRule struct {
+	from, to []string
+}
+
+// recordFilter drops and transforms records before they are formatted.
+// A nil recordFilter keeps records as they are.
+type recordFilter struct {
+	// Records are kept only when all of include match, and dropped when any of exclude matches.
+	include []recordRule
+	exclude []recordRule
+	// allow is the allow-list of keys. Any keys are kept when it is empty.
+	allow  [][]string
+	remove [][]string
+	rename []renameRule
+}
+
+// getRecordFilter returns nil unless any of the options is specified.
+func getRecordFilter(includeRecords, excludeRecords, allowKeys, removeKeys, renameKeys string) (*recordFilter, error) {
+	if includeRecords == "" && excludeRecords == "" && allowKeys == "" && removeKeys == "" && renameKeys == "" {
+		return nil, nil
+	}
+
+	f := &recordFilter{}
+	var err error
+	if f.include, err = parseRecordRules(includeRecords); err != nil {
+		return nil, fmt.Errorf("invalid includeRecords: %v", err)
+	}
+	if f.exclude, err = parseRecordRules(excludeRecords); err != nil {
+		return nil, fmt.Errorf("invalid excludeRecords: %v", err)
+	}
+	if f.allow, err = parseRecordKeyPaths(allowKeys); err != nil {
+		return nil, fmt.Errorf("invalid allowKeys: %v", err)
+	}
+	if f.remove, err = parseRecordKeyPaths(removeKeys); err != nil {
+		return nil, fmt.Errorf("invalid removeKeys: %v", err)
+	}
+
+	pairs, err := parseKeyValuePairs(renameKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid renameKeys: %v", err)
+	}
+	for _, pair := range pairs {
+		from, to := recordKeyPath(pair[0]), recordKeyPath(pair[1])
+		if len(from) == 0 || len(to) == 0 || isPathPrefix(from, to) || isPathPrefix(to, from) {
+			return nil, fmt.Errorf("invalid renameKeys: %s=%s", pair[0], pair[1])
+		}
+		f.rename = append(f.rename, renameRule{from: from, to: to})
+	}
+
+	return f, nil
+}
+
+// parseRecordRules parses rules such as "kubernetes.labels.app=^web$;level=debug".
+func parseRecordRules(s string) ([]recordRule, error) {
+	var rules []recordRule
+	for _, item := range strings.Split(s, recordRuleSeparator) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.IndexByte(item, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s is not key=regex", item)
+		}
+		path := recordKeyPath(strings.TrimSpace(item[:i]))
+		if len(path) == 0 {
+			return nil, fmt.Errorf("%s is not a record key", item[:i])
+		}
+		re, err := regexp.Compile(strings.TrimSpace(item[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, recordRule{path: path, re: re})
+	}
+	return rules, nil
+}
+
+// parseRecordKeyPaths parses comma separated keys such as "log,kubernetes.labels.app".
+func parseRecordKeyPaths(s string) ([][]string, error) {
+	var paths [][]string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		path := recordKeyPath(name)
+		if len(path) == 0 {
+			return nil, fmt.Errorf("%s is not a record key", name)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// isPathPrefix reports whether path is prefix itself or is under it.
+func isPathPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i, key := range prefix {
+		if path[i] != key {
+			return false
+		}
+	}
+	return true
+}
+
+// keep reports whether record passes IncludeRecords and ExcludeRecords.
+func (f *recordFilter) keep(record map[interface{}]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	for _, rule := range f.include {
+		if !rule.match(record) {
+			return false
+		}
+	}
+	for _, rule := range f.exclude {
+		if rule.match(record) {
+			return false
+		}
+	}
+	return true
+}
+
+// transform applies AllowKeys, RemoveKeys and RenameKeys in this order. Record may be
+// modified in place, so the returned record must be used instead.
+func (f *recordFilter) transform(record map[interface{}]interface{}) map[interface{}]interface{} {
+	if f == nil {
+		return record
+	}
+	if len(f.allow) > 0 {
+		allowed := make(map[interface{}]interface{})
+		for _, path := range f.allow {
+			if value, ok := recordValue(record, path); ok {
+				setRecordValue(allowed, path, value)
+			}
+		}
+		record = allowed
+	}
+	for _, path := range f.remove {
+		deleteRecordValue(record, path)
+	}
+	for _, rule := range f.rename {
+		value, ok := recordValue(record, rule.from)
+		if !ok {
+			continue
+		}
+		// The key is left when the destination is under a value which is not a map.
+		if setRecordValue(record, rule.to, value) {
+			deleteRecordValue(record, rule.from)
+		}
+	}
+	return record
+}
+
+// keyPaths returns path and the paths where RenameKeys moves its value, so that a key
+// of the record as it is received can be compared with keys after the transformation.
+func (f *recordFilter) keyPaths(path []string) [][]string {
+	paths := [][]string{path}
+	if f == nil {
+		return paths
+	}
+	for _, rule := range f.rename {
+		if !isPathPrefix(rule.from, path) {
+			continue
+		}
+		path = append(append([]string{}, rule.to...), path[len(rule.from):]...)
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// recordValue returns the value at path in record.
+func recordValue(record map[interface{}]interface{}, path []string) (interface{}, bool) {
+	var value interface{} = record
+	for _, key := range path {
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// setRecordValue sets value at path in record, creating the maps on the way. It
+// returns false when a value on the way is not a map.
+func setRecordValue(record map[interface{}]interface{}, path []string, value interface{}) bool {
+	m := record
+	for _, key := range path[:len(path)-1] {
+		next, ok := m[key]
+		if !ok {
+			child := make(map[interface{}]interface{})
+			m[key] = child
+			m = child
+			continue
+		}
+		if m, ok = next.(map[interface{}]interface{}); !ok {
+			return false
+		}
+	}
+	m[path[len(path)-1]] = value
+	return true
+}
+
+func deleteRecordValue(record map[interface{}]interface{}, path []string) {
+	parent, ok := recordValue(record, path[:len(path)-1])
+	if !ok {
+		return
+	}
+	if m, ok := parent.(map[interface{}]interface{}); ok {
+		delete(m, path[len(path)-1])
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRecordFilter(t *testing.T) {
+	f, err := getRecordFilter("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, f, "records are not filtered by default")
+
+	f, err = getRecordFilter("kubernetes.labels.app=^(web|api)$", "log=healthcheck;level=^debug$", "log,$.kubernetes.labels", "stream", "log=message")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Len(t, f.include, 1)
+	assert.Equal(t, []string{"kubernetes", "labels", "app"}, f.include[0].path)
+	assert.Len(t, f.exclude, 2)
+	assert.Equal(t, [][]string{{"log"}, {"kubernetes", "labels"}}, f.allow)
+	assert.Equal(t, [][]string{{"stream"}}, f.remove)
+	assert.Equal(t, []renameRule{{from: []string{"log"}, to: []string{"message"}}}, f.rename)
+
+	_, err = getRecordFilter("level", "", "", "", "")
+	assert.EqualError(t, err, "invalid includeRecords: level is not key=regex")
+	_, err = getRecordFilter("", "log=(", "", "", "")
+	assert.Contains(t, err.Error(), "invalid excludeRecords: error parsing regexp")
+	_, err = getRecordFilter("", "", "kubernetes..labels", "", "")
+	assert.EqualError(t, err, "invalid allowKeys: kubernetes..labels is not a record key")
+	_, err = getRecordFilter("", "", "", "", "log=")
+	assert.EqualError(t, err, "invalid renameKeys: log=")
+	_, err = getRecordFilter("", "", "", "", "log=log.message")
+	assert.EqualError(t, err, "invalid renameKeys: log=log.message")
+}
+
+func newFilterTestRecord() map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"log":    "GET /index.html",
+		"level":  "info",
+		"stream": "stdout",
+		"kubernetes": map[interface{}]interface{}{
+			"pod_name": "web-0",
+			"labels": map[interface{}]interface{}{
+				"app": []byte("web"),
+			},
+		},
+	}
+}
+
+func TestRecordFilterKeep(t *testing.T) {
+	f, _ := getRecordFilter("kubernetes.labels.app=^(web|api)$", "log=healthcheck;level=^debug$", "", "", "")
+	assert.True(t, f.keep(newFilterTestRecord()))
+
+	record := newFilterTestRecord()
+	record["level"] = "debug"
+	assert.False(t, f.keep(record), "records matching any exclude rule are dropped")
+
+	record = newFilterTestRecord()
+	record["kubernetes"].(map[interface{}]interface{})["labels"] = map[interface{}]interface{}{"app": "batch"}
+	assert.False(t, f.keep(record))
+
+	record = newFilterTestRecord()
+	delete(record, "kubernetes")
+	assert.False(t, f.keep(record), "records without included keys are dropped")
+
+	var nilFilter *recordFilter
+	assert.True(t, nilFilter.keep(record))
+}
+
+func TestRecordFilterTransform(t *testing.T) {
+	f, _ := getRecordFilter("", "", "log,level,kubernetes.labels.app", "level", "log=message,kubernetes.labels.app=app")
+	record := f.transform(newFilterTestRecord())
+	assert.Equal(t, map[interface{}]interface{}{
+		"message":    "GET /index.html",
+		"app":        []byte("web"),
+		"kubernetes": map[interface{}]interface{}{"labels": map[interface{}]interface{}{}},
+	}, record)
+
+	f, _ = getRecordFilter("", "", "", "kubernetes.pod_name,missing.key", "log=level.message,stream=output.stream")
+	record = f.transform(newFilterTestRecord())
+	assert.Equal(t, "GET /index.html", record["log"], "keys are not moved under a value which is not a map")
+	assert.Equal(t, map[interface{}]interface{}{"stream": "stdout"}, record["output"])
+	assert.NotContains(t, record, "stream")
+	assert.Equal(t, map[interface{}]interface{}{
+		"labels": map[interface{}]interface{}{"app": []byte("web")},
+	}, record["kubernetes"])
+}
+
+func TestPluginFlusherWithRecordFilter(t *testing.T) {
+	testplugin := &testFluentPlugin{}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"log": "GET /", "level": "info", "secret": "s3cr3t"})
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"log": "cache miss", "level": "debug", "secret": "s3cr3t"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	filter, _ := getRecordFilter("", "level=^debug$", "", "secret", "log=message")
+	keyFormatter, _ := newObjectKeyFormatter("%{path}/%{$.level}/%{index}.log")
+	s3operators = []*s3operator{{
+		bucket:       "examplebucket",
+		prefix:       "exampleprefix",
+		logger:       newLogger(log.InfoLevel),
+		location:     time.UTC,
+		formatter:    &jsonFormatter{},
+		filter:       filter,
+		keyFormatter: keyFormatter,
+	}}
+	defer func() { s3operators = nil }()
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Len(t, testplugin.events, 1)
+	assert.JSONEq(t, `{"level":"info","message":"GET /"}`, string(testplugin.events[0].data))
+	assert.Equal(t, "exampleprefix/info/0.log", testplugin.events[0].objectKey)
+}
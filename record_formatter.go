@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// recordFormatter converts a record into a line of an S3 object.
+type recordFormatter interface {
+	Format(record map[interface{}]interface{}) (string, error)
+}
+
+func newRecordFormatter(format outputFormat, messageKey string, fields []string, encoder jsonEncoder) recordFormatter {
+	switch format {
+	case singleValueOutputFormat:
+		return &singleValueFormatter{key: messageKey, encoder: encoder}
+	case csvOutputFormat:
+		return &csvFormatter{fields: fields, delimiter: ',', encoder: encoder}
+	case tsvOutputFormat:
+		return &csvFormatter{fields: fields, delimiter: '\t', encoder: encoder}
+	case ltsvOutputFormat:
+		return &ltsvFormatter{encoder: encoder}
+	}
+	// Parquet objects are converted from JSON lines when they are uploaded.
+	return &jsonFormatter{encoder: encoder}
+}
+
+type jsonFormatter struct {
+	encoder jsonEncoder
+}
+
+func (f *jsonFormatter) Format(record map[interface{}]interface{}) (string, error) {
+	return f.encoder.marshal(record)
+}
+
+// singleValueFormatter emits the value of one key verbatim like fluentd's single_value format.
+type singleValueFormatter struct {
+	key     string
+	encoder jsonEncoder
+}
+
+func (f *singleValueFormatter) Format(record map[interface{}]interface{}) (string, error) {
+	value, ok := record[f.key]
+	if !ok {
+		return "", fmt.Errorf("record has no %s key", f.key)
+	}
+	s, err := f.encoder.stringify(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(s, "\n"), nil
+}
+
+// csvFormatter emits the values of the configured fields as a CSV or TSV row.
+type csvFormatter struct {
+	fields    []string
+	delimiter rune
+	encoder   jsonEncoder
+}
+
+func (f *csvFormatter) Format(record map[interface{}]interface{}) (string, error) {
+	row := make([]string, len(f.fields))
+	for i, field := range f.fields {
+		s, err := f.encoder.stringify(record[field])
+		if err != nil {
+			return "", err
+		}
+		row[i] = s
+	}
+
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Comma = f.delimiter
+	if err := w.Write(row); err != nil {
+		return "", err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+var ltsvEscaper = strings.NewReplacer("\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// ltsvFormatter emits all keys of a record as Labeled Tab-separated Values.
+// See http://ltsv.org/
+type ltsvFormatter struct {
+	encoder jsonEncoder
+}
+
+func (f *ltsvFormatter) Format(record map[interface{}]interface{}) (string, error) {
+	m := f.encoder.encode(record)
+	labels := make([]string, 0, len(m))
+	for label := range m {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	fields := make([]string, 0, len(labels))
+	for _, label := range labels {
+		s, err := f.encoder.stringify(m[label])
+		if err != nil {
+			return "", err
+		}
+		fields = append(fields, label+":"+ltsvEscaper.Replace(s))
+	}
+	return strings.Join(fields, "\t"), nil
+}
+
+// stringifyValue returns strings as they are and encodes other values as JSON.
+func stringifyValue(value interface{}) (string, error) {
+	return jsonEncoder{}.stringify(value)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSingleValueFormatter(t *testing.T) {
+	f := &singleValueFormatter{key: "message"}
+	line, err := f.Format(map[interface{}]interface{}{"message": []byte("hello\n"), "level": "info"})
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", line)
+
+	_, err = f.Format(map[interface{}]interface{}{"level": "info"})
+	assert.NotNil(t, err, "record without the key is skipped")
+}
+
+func TestCSVFormatter(t *testing.T) {
+	record := map[interface{}]interface{}{
+		"time":   "2019-03-10T10:11:12Z",
+		"log":    []byte(`say "hello", world`),
+		"status": 200,
+	}
+
+	f := &csvFormatter{fields: []string{"time", "status", "log", "missing"}, delimiter: ','}
+	line, err := f.Format(record)
+	assert.Nil(t, err)
+	assert.Equal(t, `2019-03-10T10:11:12Z,200,"say ""hello"", world",`, line)
+
+	f = &csvFormatter{fields: []string{"time", "status"}, delimiter: '\t'}
+	line, err = f.Format(record)
+	assert.Nil(t, err)
+	assert.Equal(t, "2019-03-10T10:11:12Z\t200", line)
+}
+
+func TestLTSVFormatter(t *testing.T) {
+	f := &ltsvFormatter{}
+	line, err := f.Format(map[interface{}]interface{}{
+		"time":   "2019-03-10T10:11:12Z",
+		"log":    []byte("first\tsecond\n"),
+		"status": 200,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "log:first\\tsecond\\n\tstatus:200\ttime:2019-03-10T10:11:12Z", line)
+}
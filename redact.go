@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultRedactMask = "[REDACTED]"
+	minHashKeySize    = 16
+	// redactPatternRule and hashRule label the redactions of RedactPatterns and HashKeys.
+	redactPatternRule = "pattern"
+	hashRule          = "hash"
+)
+
+// piiDetector finds a kind of personal or secret data in string values.
+type piiDetector struct {
+	name string
+	re   *regexp.Regexp
+	// valid filters out matches which only look like the data, or is nil.
+	valid func(match string) bool
+}
+
+// piiDetectors are the built-in detectors of RedactDetectors.
+var piiDetectors = []piiDetector{
+	{name: "email", re: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)},
+	{name: "credit_card", re: regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`), valid: luhnValid},
+	{name: "jwt", re: regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+`)},
+	{name: "bearer_token", re: regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`)},
+	{name: "aws_access_key", re: regexp.MustCompile(`\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`)},
+}
+
+func lookupPIIDetector(name string) (piiDetector, bool) {
+	for _, d := range piiDetectors {
+		if d.name == name {
+			return d, true
+		}
+	}
+	return piiDetector{}, false
+}
+
+func piiDetectorNames() []string {
+	names := make([]string, len(piiDetectors))
+	for i, d := range piiDetectors {
+		names[i] = d.name
+	}
+	return names
+}
+
+// luhnValid reports whether the digits of s pass the Luhn checksum of card numbers.
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
+
+// redactor masks personal data in the string values of records and replaces the
+// values of HashKeys with their HMAC-SHA256. A nil redactor leaves records as they are.
+type redactor struct {
+	detectors []piiDetector
+	mask      string
+	hashKeys  [][]string
+	hashKey   []byte
+}
+
+// getRedactor returns nil unless RedactPatterns, RedactDetectors or HashKeys is specified.
+func getRedactor(redactPatterns, redactDetectors, redactMask, hashKeys, hashKeyFile string) (*redactor, error) {
+	if redactPatterns == "" && redactDetectors == "" && hashKeys == "" {
+		if redactMask != "" {
+			return nil, fmt.Errorf("redactMask requires redactPatterns or redactDetectors")
+		}
+		if hashKeyFile != "" {
+			return nil, fmt.Errorf("hashKeyFile requires hashKeys")
+		}
+		return nil, nil
+	}
+
+	r := &redactor{mask: defaultRedactMask}
+	if redactMask != "" {
+		r.mask = redactMask
+	}
+
+	// Patterns are separated like the rules of IncludeRecords since they are regular expressions.
+	for _, pattern := range strings.Split(redactPatterns, recordRuleSeparator) {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redactPatterns: %v", err)
+		}
+		r.detectors = append(r.detectors, piiDetector{name: redactPatternRule, re: re})
+	}
+
+	for _, name := range strings.Split(redactDetectors, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "all":
+			r.detectors = append(r.detectors, piiDetectors...)
+			continue
+		}
+		d, ok := lookupPIIDetector(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid redactDetectors: %v (%s or all)", name, strings.Join(piiDetectorNames(), ", "))
+		}
+		r.detectors = append(r.detectors, d)
+	}
+
+	var err error
+	if r.hashKeys, err = parseRecordKeyPaths(hashKeys); err != nil {
+		return nil, fmt.Errorf("invalid hashKeys: %v", err)
+	}
+	if len(r.hashKeys) > 0 {
+		if hashKeyFile == "" {
+			return nil, fmt.Errorf("hashKeys requires hashKeyFile")
+		}
+		if r.hashKey, err = readHashKey(hashKeyFile); err != nil {
+			return nil, err
+		}
+	} else if hashKeyFile != "" {
+		return nil, fmt.Errorf("hashKeyFile requires hashKeys")
+	}
+
+	return r, nil
+}
+
+// readHashKey reads the secret of HMAC-SHA256. A trailing newline is not a part of the key.
+func readHashKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read hashKeyFile: %v", err)
+	}
+	key := []byte(strings.TrimRight(string(data), "\r\n"))
+	if len(key) < minHashKeySize {
+		return nil, fmt.Errorf("hashKeyFile must contain a key of %d bytes or longer", minHashKeySize)
+	}
+	return key, nil
+}
+
+// redact hashes HashKeys and then masks the string values of record in place. The
+// number of redactions is added to counts by rule.
+func (r *redactor) redact(record map[interface{}]interface{}, counts map[string]int) {
+	if r == nil {
+		return
+	}
+	for _, path := range r.hashKeys {
+		value, ok := recordValue(record, path)
+		if !ok || value == nil {
+			continue
+		}
+		setRecordValue(record, path, r.hash(value))
+		counts[hashRule]++
+	}
+	if len(r.detectors) > 0 {
+		r.maskMap(record, counts)
+	}
+}
+
+// redactKeyValue redacts value, which is rendered into object keys from the record at
+// one of paths, as the record is redacted. Values at or under HashKeys are hashed.
+func (r *redactor) redactKeyValue(paths [][]string, value string) string {
+	if r == nil || value == "" {
+		return value
+	}
+	for _, hashPath := range r.hashKeys {
+		for _, path := range paths {
+			if isPathPrefix(hashPath, path) {
+				return r.hash(value)
+			}
+		}
+	}
+	if len(r.detectors) > 0 {
+		value = r.maskString(value, make(map[string]int))
+	}
+	return value
+}
+
+func (r *redactor) hash(value interface{}) string {
+	s, err := stringifyValue(value)
+	if err != nil {
+		s = fmt.Sprint(value)
+	}
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (r *redactor) maskMap(m map[interface{}]interface{}, counts map[string]int) {
+	for k, v := range m {
+		m[k] = r.maskValue(v, counts)
+	}
+}
+
+func (r *redactor) maskValue(value interface{}, counts map[string]int) interface{} {
+	switch v := value.(type) {
+	case string:
+		return r.maskString(v, counts)
+	case []byte:
+		if s := r.maskString(string(v), counts); s != string(v) {
+			return s
+		}
+	case map[interface{}]interface{}:
+		r.maskMap(v, counts)
+	case []interface{}:
+		for i, item := range v {
+			v[i] = r.maskValue(item, counts)
+		}
+	}
+	return value
+}
+
+func (r *redactor) maskString(s string, counts map[string]int) string {
+	for _, d := range r.detectors {
+		s = d.re.ReplaceAllStringFunc(s, func(match string) string {
+			if d.valid != nil && !d.valid(match) {
+				return match
+			}
+			counts[d.name]++
+			return r.mask
+		})
+	}
+	return s
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+type retryConfig struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+// permanentErrorCodes are the error codes which do not succeed however often they are retried.
+var permanentErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AccountProblem":        true,
+	"AllAccessDisabled":     true,
+	"InvalidAccessKeyId":    true,
+	"InvalidBucketName":     true,
+	"NoSuchBucket":          true,
+	"SignatureDoesNotMatch": true,
+}
+
+// transientErrorCodes are the error codes which usually succeed later, in addition
+// to the throttling codes known by the SDK.
+var transientErrorCodes = map[string]bool{
+	request.ErrCodeRequestError:    true,
+	request.ErrCodeResponseTimeout: true,
+	"BadDigest":                    true,
+	"InternalError":                true,
+	"RequestTimeout":               true,
+	"ServiceUnavailable":           true,
+	"SlowDown":                     true,
+	"XAmzContentSHA256Mismatch":    true,
+	errCodeUploadVerification:      true,
+}
+
+// getRetryConfig returns the config of retries in the plugin. MaxRetries is 0 by
+// default, so that failed chunks are retried by Fluent Bit.
+func getRetryConfig(maxRetries, retryBaseDelay, retryMaxDelay string) (*retryConfig, error) {
+	conf := &retryConfig{
+		baseDelay: defaultRetryBaseDelay,
+		maxDelay:  defaultRetryMaxDelay,
+	}
+
+	if maxRetries != "" {
+		n, err := strconv.Atoi(maxRetries)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid maxRetries: %v", maxRetries)
+		}
+		conf.maxRetries = n
+	}
+
+	if retryBaseDelay != "" {
+		d, err := time.ParseDuration(retryBaseDelay)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid retryBaseDelay: %v", retryBaseDelay)
+		}
+		conf.baseDelay = d
+	}
+
+	if retryMaxDelay != "" {
+		d, err := time.ParseDuration(retryMaxDelay)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid retryMaxDelay: %v", retryMaxDelay)
+		}
+		conf.maxDelay = d
+	}
+
+	if conf.maxDelay < conf.baseDelay {
+		return nil, fmt.Errorf("retryMaxDelay must not be shorter than retryBaseDelay")
+	}
+
+	return conf, nil
+}
+
+// backoff returns how long to wait before the retry following attempt, which starts
+// from 0. The delay doubles on each attempt up to maxDelay, and a random half of it
+// is cut off so that plugins failing together do not retry together.
+func (c *retryConfig) backoff(attempt int) time.Duration {
+	d := c.maxDelay
+	if attempt < 32 && c.baseDelay<<uint(attempt) < c.maxDelay {
+		d = c.baseDelay << uint(attempt)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// maxErrorCauses bounds how many wrapped errors are examined, in case errors wrap each other.
+const maxErrorCauses = 32
+
+// errorCauses returns err followed by the errors it wraps, such as the failed part
+// wrapped by the MultipartUpload error of s3manager, or the errors of a batch.
+func errorCauses(err error) []error {
+	var causes []error
+	for queue := []error{err}; len(queue) > 0 && len(causes) < maxErrorCauses; queue = queue[1:] {
+		if queue[0] == nil {
+			continue
+		}
+		causes = append(causes, queue[0])
+		switch e := queue[0].(type) {
+		case awserr.BatchedErrors:
+			queue = append(queue, e.OrigErrs()...)
+		case awserr.Error:
+			queue = append(queue, e.OrigErr())
+		}
+	}
+	return causes
+}
+
+// isPermanentError reports whether err is caused by the configuration, such as
+// credentials or the bucket, rather than by S3 or the network.
+func isPermanentError(err error) bool {
+	for _, cause := range errorCauses(err) {
+		if aerr, ok := cause.(awserr.Error); ok && permanentErrorCodes[aerr.Code()] {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientError reports whether err is caused by throttling, a server error or a timeout.
+func isTransientError(err error) bool {
+	if err == nil || isPermanentError(err) {
+		return false
+	}
+	for _, cause := range errorCauses(err) {
+		if request.IsErrorThrottle(cause) {
+			return true
+		}
+		if rerr, ok := cause.(awserr.RequestFailure); ok {
+			if rerr.StatusCode() >= http.StatusInternalServerError || rerr.StatusCode() == http.StatusTooManyRequests {
+				return true
+			}
+		}
+		if aerr, ok := cause.(awserr.Error); ok && transientErrorCodes[aerr.Code()] {
+			return true
+		}
+		if nerr, ok := cause.(net.Error); ok && nerr.Timeout() {
+			return true
+		}
+	}
+	return false
+}
+
+// givesUp reports whether a batch failing with err is not retried anymore. Once the
+// retries in the plugin are exhausted, batches go to DeadLetter instead of being retried later.
+func (s3operator *s3operator) givesUp(err error) bool {
+	if isPermanentError(err) {
+		return true
+	}
+	return s3operator.deadLetters != nil && s3operator.retry != nil && s3operator.retry.maxRetries > 0
+}
+
+// put uploads lines as objectKey, and retries transient errors up to MaxRetries times.
+func (s3operator *s3operator) put(objectKey string, t time.Time, lines string) error {
+	return s3operator.withRetries(func() error {
+		started := time.Now()
+		err := plugin.Put(s3operator, objectKey, t, lines)
+		s3operator.metrics.attempted(lines, time.Since(started), err)
+		return err
+	})
+}
+
+// withRetries calls do until it succeeds, fails with an error which is not
+// transient, or runs out of MaxRetries.
+func (s3operator *s3operator) withRetries(do func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := do()
+		if err != nil {
+			s3operator.health.failed(err)
+		} else {
+			s3operator.health.succeeded()
+		}
+		if err == nil || s3operator.retry == nil || attempt >= s3operator.retry.maxRetries || !isTransientError(err) {
+			return err
+		}
+		delay := s3operator.retry.backoff(attempt)
+		s3operator.logger.Warnf("error sending message for S3, retrying in %v (%d/%d): %v", delay, attempt+1, s3operator.retry.maxRetries, err)
+		s3operator.metrics.retried()
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/fluent/fluent-bit-go/output"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingPlugin fails Put with errs in order before it succeeds. A nil error succeeds.
+type failingPlugin struct {
+	*testFluentPlugin
+	errs     []error
+	attempts int
+}
+
+func (p *failingPlugin) Put(s3operator *s3operator, objectKey string, timestamp time.Time, line string) error {
+	p.attempts++
+	if len(p.errs) > 0 {
+		err := p.errs[0]
+		p.errs = p.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	return p.testFluentPlugin.Put(s3operator, objectKey, timestamp, line)
+}
+
+func TestGetRetryConfig(t *testing.T) {
+	conf, err := getRetryConfig("", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &retryConfig{maxRetries: 0, baseDelay: defaultRetryBaseDelay, maxDelay: defaultRetryMaxDelay}, conf)
+
+	conf, err = getRetryConfig("5", "200ms", "10s")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &retryConfig{maxRetries: 5, baseDelay: 200 * time.Millisecond, maxDelay: 10 * time.Second}, conf)
+
+	_, err = getRetryConfig("-1", "", "")
+	assert.Equal(t, errors.New("invalid maxRetries: -1"), err)
+	_, err = getRetryConfig("3", "soon", "")
+	assert.Equal(t, errors.New("invalid retryBaseDelay: soon"), err)
+	_, err = getRetryConfig("3", "", "0s")
+	assert.Equal(t, errors.New("invalid retryMaxDelay: 0s"), err)
+	_, err = getRetryConfig("3", "1m", "10s")
+	assert.Equal(t, errors.New("retryMaxDelay must not be shorter than retryBaseDelay"), err)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	conf := &retryConfig{baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			d := conf.backoff(attempt)
+			assert.True(t, d >= max/2 && d <= max, "backoff(%d) = %v", attempt, d)
+		}
+	}
+	assert.True(t, conf.backoff(100) <= time.Second, "large attempts do not overflow")
+}
+
+func TestErrorClassification(t *testing.T) {
+	assert.True(t, isPermanentError(awserr.New("AccessDenied", "Access Denied", nil)))
+	assert.True(t, isPermanentError(awserr.NewRequestFailure(awserr.New("NoSuchBucket", "The specified bucket does not exist", nil), 404, "id")))
+	assert.False(t, isPermanentError(awserr.New("SlowDown", "Please reduce your request rate.", nil)))
+	assert.False(t, isPermanentError(errors.New("unknown")))
+
+	assert.True(t, isTransientError(awserr.New("SlowDown", "Please reduce your request rate.", nil)))
+	assert.True(t, isTransientError(awserr.New("Throttling", "Rate exceeded", nil)))
+	assert.True(t, isTransientError(awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error.", nil), 500, "id")))
+	assert.True(t, isTransientError(awserr.NewRequestFailure(awserr.New("BadGateway", "", nil), 502, "id")))
+	assert.True(t, isTransientError(awserr.New("RequestError", "send request failed", errors.New("connection reset by peer"))))
+	assert.False(t, isTransientError(awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id")))
+	assert.False(t, isTransientError(awserr.NewRequestFailure(awserr.New("InvalidArgument", "", nil), 400, "id")))
+	assert.False(t, isTransientError(errors.New("unknown")))
+}
+
+// multipartUploadError returns the error of s3manager for a multipart upload whose part failed with partErr.
+func multipartUploadError(t *testing.T, partErr error) error {
+	svc := newMultipartS3()
+	svc.partErrs = []error{partErr}
+	uploader := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		u.Concurrency = 1
+	})
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String("examplebucket"),
+		Key:    aws.String("exampleprefix/object.log"),
+		Body:   bytes.NewReader(make([]byte, s3manager.DefaultUploadPartSize+1)),
+	})
+	if _, ok := err.(s3manager.MultiUploadFailure); !ok {
+		t.Fatalf("failed test %#v", err)
+	}
+	return err
+}
+
+func TestWrappedErrorClassification(t *testing.T) {
+	accessDenied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id")
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "id")
+
+	for _, c := range []struct {
+		name      string
+		err       error
+		permanent bool
+		transient bool
+	}{
+		{"permanent error of a part", multipartUploadError(t, accessDenied), true, false},
+		{"throttled part", multipartUploadError(t, slowDown), false, true},
+		{"server error of a part", multipartUploadError(t, awserr.NewRequestFailure(awserr.New("BadGateway", "", nil), 502, "id")), false, true},
+		{"timed out part", multipartUploadError(t, awserr.New("SerializationError", "", &net.DNSError{IsTimeout: true})), false, true},
+		{"client error of a part", multipartUploadError(t, awserr.NewRequestFailure(awserr.New("InvalidArgument", "", nil), 400, "id")), false, false},
+		{"permanent error wrapped twice", awserr.New("MultipartUpload", "upload multipart failed", awserr.New("ReadRequestBody", "", accessDenied)), true, false},
+		{"permanent error in a batch", awserr.NewBatchError("BatchedErrors", "multiple errors occurred", []error{errors.New("unknown"), accessDenied}), true, false},
+		{"throttled request in a batch", awserr.NewBatchError("BatchedErrors", "multiple errors occurred", []error{errors.New("unknown"), slowDown}), false, true},
+		{"permanent error before a transient one", awserr.NewBatchError("BatchedErrors", "multiple errors occurred", []error{slowDown, accessDenied}), true, false},
+		{"upload verification of a part", multipartUploadError(t, newVerificationError("ETag of part %d does not match", 1)), false, true},
+	} {
+		assert.Equal(t, c.permanent, isPermanentError(c.err), "isPermanentError: %s", c.name)
+		assert.Equal(t, c.transient, isTransientError(c.err), "isTransientError: %s", c.name)
+	}
+}
+
+func TestPluginFlusherRetriesTransientErrors(t *testing.T) {
+	testplugin := &failingPlugin{
+		testFluentPlugin: &testFluentPlugin{},
+		errs: []error{
+			awserr.New("SlowDown", "Please reduce your request rate.", nil),
+			awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), 503, "id"),
+		},
+	}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"mykey": "myvalue"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3operators = []*s3operator{{
+		bucket:    "examplebucket",
+		prefix:    "exampleprefix",
+		logger:    newLogger(log.InfoLevel),
+		location:  time.UTC,
+		formatter: &jsonFormatter{},
+		retry:     &retryConfig{maxRetries: 2, baseDelay: time.Millisecond, maxDelay: time.Millisecond},
+	}}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Equal(t, 3, testplugin.attempts)
+	assert.Len(t, testplugin.events, 1)
+}
+
+func TestPluginFlusherGivesUpRetries(t *testing.T) {
+	testplugin := &failingPlugin{
+		testFluentPlugin: &testFluentPlugin{},
+		errs: []error{
+			awserr.New("SlowDown", "Please reduce your request rate.", nil),
+			awserr.New("SlowDown", "Please reduce your request rate.", nil),
+		},
+	}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"mykey": "myvalue"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3operators = []*s3operator{{
+		logger:    newLogger(log.InfoLevel),
+		location:  time.UTC,
+		formatter: &jsonFormatter{},
+		retry:     &retryConfig{maxRetries: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond},
+	}}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_RETRY, res, "Fluent Bit retries the chunk after the retries in the plugin")
+	assert.Equal(t, 2, testplugin.attempts)
+}
+
+func TestPluginFlusherWithPermanentError(t *testing.T) {
+	testplugin := &failingPlugin{
+		testFluentPlugin: &testFluentPlugin{},
+		errs: []error{
+			awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"),
+		},
+	}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"mykey": "myvalue"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3operators = []*s3operator{{
+		logger:    newLogger(log.InfoLevel),
+		location:  time.UTC,
+		formatter: &jsonFormatter{},
+		retry:     &retryConfig{maxRetries: 3, baseDelay: time.Millisecond, maxDelay: time.Millisecond},
+	}}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_ERROR, res)
+	assert.Equal(t, 1, testplugin.attempts, "permanent errors are not retried")
+}
+
+func TestPluginFlusherRetriesFailedPartitionsOnly(t *testing.T) {
+	testplugin := &failingPlugin{
+		testFluentPlugin: &testFluentPlugin{},
+		errs: []error{
+			nil,
+			awserr.New("SlowDown", "Please reduce your request rate.", nil),
+		},
+	}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"level": "info"})
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"level": "error"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	keyFormatter, err := newObjectKeyFormatter("%{path}/%{$.level}/%{uuid}.log")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	s3mock := &s3operator{
+		prefix:       "exampleprefix",
+		logger:       newLogger(log.InfoLevel),
+		location:     time.UTC,
+		formatter:    &jsonFormatter{},
+		keyFormatter: keyFormatter,
+		progress:     newFlushProgress(),
+	}
+	s3operators = []*s3operator{s3mock}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_RETRY, res)
+	assert.Len(t, testplugin.events, 1)
+	assert.Contains(t, testplugin.events[0].objectKey, "exampleprefix/info/")
+
+	// Fluent Bit retries the same chunk.
+	testplugin.position = 0
+	res = FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Equal(t, 3, testplugin.attempts, "the uploaded partition is not uploaded again")
+	assert.Len(t, testplugin.events, 2)
+	assert.Contains(t, testplugin.events[1].objectKey, "exampleprefix/error/")
+	assert.Empty(t, s3mock.progress.chunks, "the chunk is forgotten once it is flushed")
+}
+
+func TestPluginFlusherWithPermanentErrorOfPartition(t *testing.T) {
+	testplugin := &failingPlugin{
+		testFluentPlugin: &testFluentPlugin{},
+		errs: []error{
+			awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"),
+		},
+	}
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"level": "info"})
+	testplugin.addrecord(0, 0, map[interface{}]interface{}{"level": "error"})
+	plugin = testplugin
+	context = &testPluginContext{}
+	keyFormatter, err := newObjectKeyFormatter("%{path}/%{$.level}/%{uuid}.log")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	s3operators = []*s3operator{{
+		prefix:       "exampleprefix",
+		logger:       newLogger(log.InfoLevel),
+		location:     time.UTC,
+		formatter:    &jsonFormatter{},
+		keyFormatter: keyFormatter,
+		progress:     newFlushProgress(),
+	}}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_ERROR, res)
+	assert.Len(t, testplugin.events, 1, "the other partition is uploaded anyway")
+	assert.Contains(t, testplugin.events[0].objectKey, "exampleprefix/error/")
+}
@@ -18,6 +18,21 @@ type format int
 const (
 	plainTextFormat format = iota
 	gzipFormat
+	snappyFormat
+	lz4Format
+	zstdFormat
+	bzip2Format
+)
+
+type outputFormat int
+
+const (
+	jsonOutputFormat outputFormat = iota
+	singleValueOutputFormat
+	csvOutputFormat
+	tsvOutputFormat
+	ltsvOutputFormat
+	parquetOutputFormat
 )
 
 type algorithm int
@@ -41,17 +56,46 @@ type s3Config struct {
 	autoCreateBucket bool
 }
 
+type bufferConfig struct {
+	totalFileSize int64
+	uploadTimeout time.Duration
+}
+
+type timeConfig struct {
+	useEventTime  bool
+	timeKey       string
+	timeKeyFormat string
+}
+
+type formatConfig struct {
+	format         outputFormat
+	formatter      recordFormatter
+	parquetColumns []parquetColumn
+}
+
+const (
+	defaultTotalFileSize = 100 * 1024 * 1024
+	defaultUploadTimeout = 10 * time.Minute
+)
+
 type S3Credential interface {
-	GetCredentials(accessID, secretkey, credentials string) (*credentials.Credentials, error)
+	GetCredentials(accessID, secretkey, credentials, profile string, chain []credentialSource, region string) (*credentials.Credentials, error)
 }
 
 type s3PluginConfig struct{}
 
 var s3Creds S3Credential = &s3PluginConfig{}
 
-func (c *s3PluginConfig) GetCredentials(accessKeyID, secretKey, credential string) (*credentials.Credentials, error) {
-	if credential != "" {
-		creds := credentials.NewSharedCredentials(credential, "default")
+func (c *s3PluginConfig) GetCredentials(accessKeyID, secretKey, credential, profile string, chain []credentialSource, region string) (*credentials.Credentials, error) {
+	if len(chain) > 0 {
+		// Sources are tried on each retrieval, so that unavailable ones do not fail the start.
+		return newCredentialChain(chain, accessKeyID, secretKey, credential, profile, region)
+	}
+	if credential != "" || profile != "" {
+		if profile == "" {
+			profile = "default"
+		}
+		creds := credentials.NewSharedCredentials(credential, profile)
 		if _, err := creds.Get(); err != nil {
 			return nil, fmt.Errorf("[SharedCredentials] ERROR: %s", err)
 		}
@@ -68,11 +112,15 @@ func (c *s3PluginConfig) GetCredentials(accessKeyID, secretKey, credential strin
 	return nil, nil
 }
 
-func getS3Config(accessID, secretKey, credential, s3prefix, suffixAlgorithm, bucket, region, compress, endpoint, autoCreateBucket, logLevel, timeFormat, timeZone string) (*s3Config, error) {
+func getS3Config(accessID, secretKey, credential, profile, credentialChain, s3prefix, suffixAlgorithm, bucket, region, compress, endpoint, autoCreateBucket, logLevel, timeFormat, timeZone string) (*s3Config, error) {
 	conf := &s3Config{}
-	creds, err := s3Creds.GetCredentials(accessID, secretKey, credential)
+	chain, err := parseCredentialChain(credentialChain)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create credentials")
+		return nil, err
+	}
+	creds, err := s3Creds.GetCredentials(accessID, secretKey, credential, profile, chain, region)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create credentials: %v", err)
 	}
 	conf.credentials = creds
 
@@ -98,10 +146,9 @@ func getS3Config(accessID, secretKey, credential, s3prefix, suffixAlgorithm, buc
 	}
 	conf.region = aws.String(region)
 
-	switch compress {
-	case "gzip":
-		conf.compress = gzipFormat
-	default:
+	if compressFormat, ok := lookupCodec(compress); ok {
+		conf.compress = compressFormat
+	} else {
 		conf.compress = plainTextFormat
 	}
 
@@ -147,3 +194,137 @@ func getS3Config(accessID, secretKey, credential, s3prefix, suffixAlgorithm, buc
 
 	return conf, nil
 }
+
+// getBufferConfig returns nil when neither TotalFileSize nor UploadTimeout is
+// specified, which keeps uploading one object per flushed chunk.
+func getBufferConfig(totalFileSize, uploadTimeout string) (*bufferConfig, error) {
+	if totalFileSize == "" && uploadTimeout == "" {
+		return nil, nil
+	}
+
+	conf := &bufferConfig{
+		totalFileSize: defaultTotalFileSize,
+		uploadTimeout: defaultUploadTimeout,
+	}
+
+	if totalFileSize != "" {
+		size, err := parseSize(totalFileSize)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid totalFileSize: %v", totalFileSize)
+		}
+		conf.totalFileSize = size
+	}
+
+	if uploadTimeout != "" {
+		timeout, err := time.ParseDuration(uploadTimeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid uploadTimeout: %v", uploadTimeout)
+		}
+		conf.uploadTimeout = timeout
+	}
+
+	return conf, nil
+}
+
+// parseSize parses sizes such as "512", "256K", "50M" or "1G".
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(s, "B")
+
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1024
+	case strings.HasSuffix(s, "M"):
+		unit = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		unit = 1024 * 1024 * 1024
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * unit, nil
+}
+
+func getFormatConfig(format, parquetSchema, messageKey, fields, invalidUTF8 string) (*formatConfig, error) {
+	conf := &formatConfig{}
+
+	switch format {
+	case "", "json":
+		conf.format = jsonOutputFormat
+	case "single_value":
+		conf.format = singleValueOutputFormat
+	case "csv":
+		conf.format = csvOutputFormat
+	case "tsv":
+		conf.format = tsvOutputFormat
+	case "ltsv":
+		conf.format = ltsvOutputFormat
+	case "parquet":
+		conf.format = parquetOutputFormat
+	default:
+		return nil, fmt.Errorf("invalid format: %v", format)
+	}
+
+	if messageKey == "" {
+		messageKey = "log"
+	}
+
+	var columns []string
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			columns = append(columns, field)
+		}
+	}
+	if (conf.format == csvOutputFormat || conf.format == tsvOutputFormat) && len(columns) == 0 {
+		return nil, fmt.Errorf("fields must be specified with %s format", format)
+	}
+
+	mode, err := getInvalidUTF8Mode(invalidUTF8)
+	if err != nil {
+		return nil, err
+	}
+	conf.formatter = newRecordFormatter(conf.format, messageKey, columns, jsonEncoder{invalidUTF8: mode})
+
+	if parquetSchema != "" {
+		if conf.format != parquetOutputFormat {
+			return nil, fmt.Errorf("parquetSchema is only available with parquet format")
+		}
+		columns, err := parseParquetSchema(parquetSchema)
+		if err != nil {
+			return nil, err
+		}
+		conf.parquetColumns = columns
+	}
+
+	return conf, nil
+}
+
+func getTimeConfig(useEventTime, timeKey, timeKeyFormat string) (*timeConfig, error) {
+	conf := &timeConfig{
+		timeKey:       timeKey,
+		timeKeyFormat: time.RFC3339,
+	}
+
+	if useEventTime != "" {
+		isUseEventTime, err := strconv.ParseBool(useEventTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid useEventTime: %v", useEventTime)
+		}
+		conf.useEventTime = isUseEventTime
+	}
+
+	if timeKeyFormat != "" {
+		if timeKey == "" {
+			return nil, fmt.Errorf("timeKeyFormat is only available with timeKey")
+		}
+		conf.timeKeyFormat = timeKeyFormat
+	}
+
+	return conf, nil
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func TestGetS3ConfigStaticCredentials(t *testing.T) {
-	conf, err := getS3Config("exampleaccessID", "examplesecretkey", "", "exampleprefix", "", "examplebucket", "exampleregion", "", "", "", "", "", "")
+	conf, err := getS3Config("exampleaccessID", "examplesecretkey", "", "", "", "exampleprefix", "", "examplebucket", "exampleregion", "", "", "", "", "", "")
 	if err != nil {
 		t.Fatalf("failed test %#v", err)
 	}
@@ -23,7 +23,7 @@ func TestGetS3ConfigStaticCredentials(t *testing.T) {
 
 func TestGetS3ConfigSharedCredentials(t *testing.T) {
 	s3Creds = &testS3Credential{}
-	conf, err := getS3Config("", "", "examplecredentials", "exampleprefix", "", "examplebucket", "exampleregion", "", "", "", "", "", "")
+	conf, err := getS3Config("", "", "examplecredentials", "", "", "exampleprefix", "", "examplebucket", "exampleregion", "", "", "", "", "", "")
 	if err != nil {
 		t.Fatalf("failed test %#v", err)
 	}
@@ -38,7 +38,7 @@ func TestGetS3ConfigSharedCredentials(t *testing.T) {
 
 func TestGetS3ConfigCompression(t *testing.T) {
 	s3Creds = &testS3Credential{}
-	conf, err := getS3Config("", "", "examplecredentials", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "", "", "", "", "")
+	conf, err := getS3Config("", "", "examplecredentials", "", "", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "", "", "", "", "")
 	if err != nil {
 		t.Fatalf("failed test %#v", err)
 	}
@@ -51,9 +51,28 @@ func TestGetS3ConfigCompression(t *testing.T) {
 	assert.Equal(t, false, conf.autoCreateBucket, "Specify true/false")
 }
 
+func TestGetS3ConfigCompressionCodecs(t *testing.T) {
+	s3Creds = &testS3Credential{}
+	for compress, expected := range map[string]format{
+		"":          plainTextFormat,
+		"plainText": plainTextFormat,
+		"gzip":      gzipFormat,
+		"snappy":    snappyFormat,
+		"lz4":       lz4Format,
+		"zstd":      zstdFormat,
+		"bzip2":     bzip2Format,
+	} {
+		conf, err := getS3Config("", "", "examplecredentials", "", "", "exampleprefix", "", "examplebucket", "exampleregion", compress, "", "", "", "", "")
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		assert.Equal(t, expected, conf.compress, "Specify %s compression", compress)
+	}
+}
+
 func TestGetS3ConfigEndpoint(t *testing.T) {
 	s3Creds = &testS3Credential{}
-	conf, err := getS3Config("", "", "examplecredentials", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "http://localhost:9000", "false", "", "", "")
+	conf, err := getS3Config("", "", "examplecredentials", "", "", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "http://localhost:9000", "false", "", "", "")
 	if err != nil {
 		t.Fatalf("failed test %#v", err)
 	}
@@ -69,7 +88,7 @@ func TestGetS3ConfigEndpoint(t *testing.T) {
 
 func TestGetS3ConfigInvalidEndpoint(t *testing.T) {
 	s3Creds = &testS3Credential{}
-	_, err := getS3Config("", "", "examplecredentials", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "https://your-bucketname.s3.amazonaws.com", "false", "", "", "")
+	_, err := getS3Config("", "", "examplecredentials", "", "", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "https://your-bucketname.s3.amazonaws.com", "false", "", "", "")
 	if err != nil {
 		expected := errors.New("Endpoint is not supported for AWS S3. This parameter is intended for S3 compatible services. Use Region instead.")
 		assert.Equal(t, expected, err)
@@ -78,7 +97,7 @@ func TestGetS3ConfigInvalidEndpoint(t *testing.T) {
 
 func TestGetS3ConfigTimeFormat(t *testing.T) {
 	s3Creds = &testS3Credential{}
-	conf, err := getS3Config("", "", "examplecredentials", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "", "", "", "dt=2006-01-02", "Asia/Tokyo")
+	conf, err := getS3Config("", "", "examplecredentials", "", "", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "", "", "", "dt=2006-01-02", "Asia/Tokyo")
 	if err != nil {
 		t.Fatalf("failed test %#v", err)
 	}
@@ -96,7 +115,7 @@ func TestGetS3ConfigTimeFormat(t *testing.T) {
 
 func TestGetS3ConfigTimeZone(t *testing.T) {
 	s3Creds = &testS3Credential{}
-	conf, err := getS3Config("", "", "examplecredentials", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "", "", "", "", "Asia/Tokyo")
+	conf, err := getS3Config("", "", "examplecredentials", "", "", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "", "", "", "", "Asia/Tokyo")
 	if err != nil {
 		t.Fatalf("failed test %#v", err)
 	}
@@ -114,9 +133,127 @@ func TestGetS3ConfigTimeZone(t *testing.T) {
 
 func TestGetS3ConfigInvalidTimeZone(t *testing.T) {
 	s3Creds = &testS3Credential{}
-	_, err := getS3Config("", "", "examplecredentials", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "", "", "", "", "Asia/Nonexistent")
+	_, err := getS3Config("", "", "examplecredentials", "", "", "exampleprefix", "", "examplebucket", "exampleregion", "gzip", "", "", "", "", "Asia/Nonexistent")
 	if err != nil {
 		expected := errors.New("invalid timeZone: unknown time zone Asia/Nonexistent")
 		assert.Equal(t, expected, err)
 	}
 }
+
+func TestGetBufferConfigDisabled(t *testing.T) {
+	conf, err := getBufferConfig("", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, conf, "buffering is disabled by default")
+}
+
+func TestGetBufferConfig(t *testing.T) {
+	conf, err := getBufferConfig("50M", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, int64(50*1024*1024), conf.totalFileSize, "Specify total file size")
+	assert.Equal(t, 10*time.Minute, conf.uploadTimeout, "Use default upload timeout")
+
+	conf, err = getBufferConfig("", "30s")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, int64(100*1024*1024), conf.totalFileSize, "Use default total file size")
+	assert.Equal(t, 30*time.Second, conf.uploadTimeout, "Specify upload timeout")
+}
+
+func TestGetBufferConfigInvalid(t *testing.T) {
+	_, err := getBufferConfig("50X", "")
+	assert.Equal(t, errors.New("invalid totalFileSize: 50X"), err)
+
+	_, err = getBufferConfig("", "10")
+	assert.Equal(t, errors.New("invalid uploadTimeout: 10"), err)
+}
+
+func TestParseSize(t *testing.T) {
+	for input, expected := range map[string]int64{
+		"512":  512,
+		"256K": 256 * 1024,
+		"50m":  50 * 1024 * 1024,
+		"1GB":  1024 * 1024 * 1024,
+	} {
+		size, err := parseSize(input)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		assert.Equal(t, expected, size, "Parse %s", input)
+	}
+}
+
+func TestGetFormatConfig(t *testing.T) {
+	conf, err := getFormatConfig("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, jsonOutputFormat, conf.format, "JSON lines by default")
+
+	conf, err = getFormatConfig("parquet", "log:string,status:int64", "", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, parquetOutputFormat, conf.format, "Specify parquet format")
+	assert.Len(t, conf.parquetColumns, 2, "Specify parquet schema")
+
+	conf, err = getFormatConfig("tsv", "", "", "time, log", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, tsvOutputFormat, conf.format, "Specify tsv format")
+	assert.Equal(t, &csvFormatter{fields: []string{"time", "log"}, delimiter: '\t'}, conf.formatter, "Specify fields")
+
+	conf, err = getFormatConfig("single_value", "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &singleValueFormatter{key: "log"}, conf.formatter, "log key by default")
+
+	conf, err = getFormatConfig("ltsv", "", "", "", "escape")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &ltsvFormatter{encoder: jsonEncoder{invalidUTF8: escapeInvalidUTF8}}, conf.formatter, "Specify invalidUTF8")
+}
+
+func TestGetFormatConfigInvalid(t *testing.T) {
+	_, err := getFormatConfig("xml", "", "", "", "")
+	assert.Equal(t, errors.New("invalid format: xml"), err)
+
+	_, err = getFormatConfig("json", "log:string", "", "", "")
+	assert.Equal(t, errors.New("parquetSchema is only available with parquet format"), err)
+
+	_, err = getFormatConfig("csv", "", "", "", "")
+	assert.Equal(t, errors.New("fields must be specified with csv format"), err)
+
+	_, err = getFormatConfig("json", "", "", "", "drop")
+	assert.Equal(t, errors.New("invalid invalidUTF8: drop (replace, escape or base64)"), err)
+}
+
+func TestGetTimeConfig(t *testing.T) {
+	conf, err := getTimeConfig("", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.False(t, conf.useEventTime, "Use upload time by default")
+	assert.Equal(t, "", conf.timeKey, "Do not inject time by default")
+
+	conf, err = getTimeConfig("true", "time", "unix")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.True(t, conf.useEventTime)
+	assert.Equal(t, "time", conf.timeKey)
+	assert.Equal(t, "unix", conf.timeKeyFormat)
+
+	_, err = getTimeConfig("yes", "", "")
+	assert.Equal(t, errors.New("invalid useEventTime: yes"), err)
+
+	_, err = getTimeConfig("", "", "unix")
+	assert.Equal(t, errors.New("timeKeyFormat is only available with timeKey"), err)
+}
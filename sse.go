@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	sseCustomerKeySize = 32
+	// The vendored aws-sdk-go predates BucketKeyEnabled of PutObjectInput.
+	sseBucketKeyEnabledHeader = "X-Amz-Server-Side-Encryption-Bucket-Key-Enabled"
+)
+
+// sseConfig describes the server-side encryption of uploaded objects.
+type sseConfig struct {
+	// algorithm is AES256 for SSE-S3 or aws:kms for SSE-KMS.
+	algorithm        string
+	kmsKeyID         string
+	bucketKeyEnabled bool
+	// customerKey is the raw 256-bit key of SSE-C.
+	customerKey string
+}
+
+func getSSEConfig(serverSideEncryption, kmsKeyID, bucketKeyEnabled, customerKeyFile string) (*sseConfig, error) {
+	conf := &sseConfig{}
+
+	switch serverSideEncryption {
+	case "":
+	case s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+		conf.algorithm = serverSideEncryption
+	default:
+		return nil, fmt.Errorf("invalid serverSideEncryption: %v (%s or %s)", serverSideEncryption, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+
+	if kmsKeyID != "" {
+		if conf.algorithm != s3.ServerSideEncryptionAwsKms {
+			return nil, fmt.Errorf("sseKMSKeyId is only available with serverSideEncryption %s", s3.ServerSideEncryptionAwsKms)
+		}
+		conf.kmsKeyID = kmsKeyID
+	}
+
+	if bucketKeyEnabled != "" {
+		enabled, err := strconv.ParseBool(bucketKeyEnabled)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sseBucketKeyEnabled: %v", bucketKeyEnabled)
+		}
+		if enabled && conf.algorithm != s3.ServerSideEncryptionAwsKms {
+			return nil, fmt.Errorf("sseBucketKeyEnabled is only available with serverSideEncryption %s", s3.ServerSideEncryptionAwsKms)
+		}
+		conf.bucketKeyEnabled = enabled
+	}
+
+	if customerKeyFile != "" {
+		if conf.algorithm != "" {
+			return nil, fmt.Errorf("sseCustomerKeyFile cannot be used with serverSideEncryption")
+		}
+		key, err := readSSECustomerKey(customerKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.customerKey = key
+	}
+
+	return conf, nil
+}
+
+// readSSECustomerKey reads a 256-bit key which is written either as raw bytes or in base64.
+func readSSECustomerKey(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read sseCustomerKeyFile: %v", err)
+	}
+	if len(data) == sseCustomerKeySize {
+		return string(data), nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != sseCustomerKeySize {
+		return "", fmt.Errorf("sseCustomerKeyFile must contain a %d bytes key in raw or base64", sseCustomerKeySize)
+	}
+	return string(key), nil
+}
+
+// apply sets the encryption headers of an upload.
+func (c *sseConfig) apply(input *s3manager.UploadInput) {
+	if c == nil {
+		return
+	}
+	if c.algorithm != "" {
+		input.ServerSideEncryption = aws.String(c.algorithm)
+	}
+	if c.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(c.kmsKeyID)
+	}
+	if c.customerKey != "" {
+		// The SDK encodes the key and computes its MD5.
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(c.customerKey)
+	}
+}
+
+// applyPart sets the encryption headers of a part of a multipart upload. Only
+// SSE-C needs them on every part.
+func (c *sseConfig) applyPart(input *s3.UploadPartInput) {
+	if c == nil || c.customerKey == "" {
+		return
+	}
+	input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+	input.SSECustomerKey = aws.String(c.customerKey)
+}
+
+// applyHead sets the headers which HeadObject needs to read an object of SSE-C.
+func (c *sseConfig) applyHead(input *s3.HeadObjectInput) {
+	if c == nil || c.customerKey == "" {
+		return
+	}
+	input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+	input.SSECustomerKey = aws.String(c.customerKey)
+}
+
+// requestOptions returns the options of the uploader which UploadInput cannot express.
+func (c *sseConfig) requestOptions() []request.Option {
+	if c == nil || !c.bucketKeyEnabled {
+		return nil
+	}
+	return []request.Option{func(r *request.Request) {
+		r.Handlers.Build.PushBack(setBucketKeyEnabledHeader)
+	}}
+}
+
+// setBucketKeyEnabledHeader enables the S3 Bucket Key on requests which create objects.
+// Parts of multipart uploads inherit it from CreateMultipartUpload.
+func setBucketKeyEnabledHeader(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "CreateMultipartUpload":
+		r.HTTPRequest.Header.Set(sseBucketKeyEnabledHeader, "true")
+	}
+}
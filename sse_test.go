@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSSEConfig(t *testing.T) {
+	conf, err := getSSEConfig("", "", "", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	input := &s3manager.UploadInput{}
+	conf.apply(input)
+	assert.Nil(t, input.ServerSideEncryption, "No encryption by default")
+	assert.Len(t, conf.requestOptions(), 0)
+
+	conf, err = getSSEConfig("aws:kms", "arn:aws:kms:us-east-1:123456789012:key/example", "true", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	input = &s3manager.UploadInput{}
+	conf.apply(input)
+	assert.Equal(t, "aws:kms", *input.ServerSideEncryption)
+	assert.Equal(t, "arn:aws:kms:us-east-1:123456789012:key/example", *input.SSEKMSKeyId)
+	assert.Len(t, conf.requestOptions(), 1)
+}
+
+func TestGetSSEConfigInvalid(t *testing.T) {
+	_, err := getSSEConfig("aws:kms:dsse", "", "", "")
+	assert.Equal(t, errors.New("invalid serverSideEncryption: aws:kms:dsse (AES256 or aws:kms)"), err)
+
+	_, err = getSSEConfig("AES256", "example", "", "")
+	assert.Equal(t, errors.New("sseKMSKeyId is only available with serverSideEncryption aws:kms"), err)
+
+	_, err = getSSEConfig("AES256", "", "true", "")
+	assert.Equal(t, errors.New("sseBucketKeyEnabled is only available with serverSideEncryption aws:kms"), err)
+
+	_, err = getSSEConfig("aws:kms", "", "yes", "")
+	assert.Equal(t, errors.New("invalid sseBucketKeyEnabled: yes"), err)
+
+	_, err = getSSEConfig("AES256", "", "", "/path/to/key")
+	assert.Equal(t, errors.New("sseCustomerKeyFile cannot be used with serverSideEncryption"), err)
+}
+
+func TestGetSSEConfigWithCustomerKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := strings.Repeat("k", sseCustomerKeySize)
+	raw := filepath.Join(dir, "raw.key")
+	ioutil.WriteFile(raw, []byte(key), 0600)
+	encoded := filepath.Join(dir, "base64.key")
+	ioutil.WriteFile(encoded, []byte(base64.StdEncoding.EncodeToString([]byte(key))+"\n"), 0600)
+	short := filepath.Join(dir, "short.key")
+	ioutil.WriteFile(short, []byte("short"), 0600)
+
+	for _, path := range []string{raw, encoded} {
+		conf, err := getSSEConfig("", "", "", path)
+		if err != nil {
+			t.Fatalf("failed test %#v", err)
+		}
+		input := &s3manager.UploadInput{}
+		conf.apply(input)
+		assert.Equal(t, "AES256", *input.SSECustomerAlgorithm)
+		assert.Equal(t, key, *input.SSECustomerKey)
+		assert.Nil(t, input.ServerSideEncryption)
+	}
+
+	_, err = getSSEConfig("", "", "", short)
+	assert.Equal(t, errors.New("sseCustomerKeyFile must contain a 32 bytes key in raw or base64"), err)
+}
+
+func TestSetBucketKeyEnabledHeader(t *testing.T) {
+	for operation, expected := range map[string]string{
+		"PutObject":             "true",
+		"CreateMultipartUpload": "true",
+		"UploadPart":            "",
+	} {
+		r := &request.Request{
+			Operation:   &request.Operation{Name: operation},
+			HTTPRequest: &http.Request{Header: http.Header{}},
+		}
+		setBucketKeyEnabledHeader(r)
+		assert.Equal(t, expected, r.HTTPRequest.Header.Get(sseBucketKeyEnabledHeader), "Bucket key header of %s", operation)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stagingFileExt = ".log"
+	journalFileExt = ".upload"
+)
+
+// fileStore keeps pending batches on disk until they are uploaded,
+// so that they survive a crash or a restart of Fluent Bit.
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(storeDir, bucket, prefix string) (*fileStore, error) {
+	dir := filepath.Join(storeDir, bucket, strings.Replace(prefix, "/", "_", -1))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create storeDir: %v", err)
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+// create opens a new staging file for records of p. Names start with the creation
+// time so that pending files sort in the order they were written, followed by a
+// hash of the partition. The partition itself is kept in the first line of the file
+// because tags and partition values can be longer than a file name may be.
+func (s *fileStore) create(p partition, eventTime time.Time) (*os.File, error) {
+	header := encodePartition(p, eventTime)
+	f, err := ioutil.TempFile(s.dir, fmt.Sprintf("%d-*.%s%s", time.Now().UnixNano(), hashPartition(header), stagingFileExt))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.write(f, header+"\n"); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *fileStore) write(f *os.File, lines string) error {
+	if _, err := f.WriteString(lines); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// stage writes lines into a staging file of their own and returns its path.
+func (s *fileStore) stage(p partition, eventTime time.Time, lines string) (string, error) {
+	f, err := s.create(p, eventTime)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := s.write(f, lines); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func (s *fileStore) remove(paths []string) error {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodePartition returns the header line of staging files which keeps the partition
+// and the event time of their records. The time slice of the partition is not kept
+// because it is not needed to render the key.
+func encodePartition(p partition, eventTime time.Time) string {
+	var nanos string
+	if !eventTime.IsZero() {
+		nanos = strconv.FormatInt(eventTime.UnixNano(), 10)
+	}
+	encoded := strings.Join([]string{nanos, p.tag, p.values}, partitionValueSeparator)
+	return base64.RawURLEncoding.EncodeToString([]byte(encoded))
+}
+
+// hashPartition returns the fixed-length part of staging file names which tells
+// files of different partitions apart.
+func hashPartition(header string) string {
+	sum := sha256.Sum256([]byte(header))
+	return hex.EncodeToString(sum[:8])
+}
+
+// decodePartition returns the partition and the event time kept in a header line.
+// A malformed header yields the zero partition, so that its lines are still uploaded.
+func decodePartition(header string) (partition, time.Time) {
+	decoded, err := base64.RawURLEncoding.DecodeString(header)
+	if err != nil {
+		return partition{}, time.Time{}
+	}
+	parts := strings.SplitN(string(decoded), partitionValueSeparator, 3)
+	if len(parts) != 3 {
+		return partition{}, time.Time{}
+	}
+	var eventTime time.Time
+	if nanos, err := strconv.ParseInt(parts[0], 10, 64); err == nil {
+		eventTime = time.Unix(0, nanos)
+	}
+	return partition{tag: parts[1], values: parts[2]}, eventTime
+}
+
+// readStaged returns the partition, the event time and the lines of a staging file.
+// A file without a complete header line has no lines.
+func readStaged(path string) (partition, time.Time, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return partition{}, time.Time{}, "", err
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return partition{}, time.Time{}, "", nil
+	}
+	p, eventTime := decodePartition(string(data[:i]))
+	return p, eventTime, string(data[i+1:]), nil
+}
+
+// pending returns staging files left by a previous run, oldest first.
+func (s *fileStore) pending() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+stagingFileExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// read returns the lines written into the staging files at paths.
+func (s *fileStore) read(paths []string) (string, error) {
+	var b strings.Builder
+	for _, path := range paths {
+		_, _, lines, err := readStaged(path)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(lines)
+	}
+	return b.String(), nil
+}
+
+// multipartUpload is a multipart upload started by a stream. It is journaled in
+// the store until it is completed or aborted.
+type multipartUpload struct {
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+}
+
+// journal writes u into a journal file of its own and returns its path.
+func (s *fileStore) journal(u *multipartUpload) (string, error) {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(s.dir, fmt.Sprintf("%d-*%s", time.Now().UnixNano(), journalFileExt))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// journaled returns journal files left by a previous run.
+func (s *fileStore) journaled() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+journalFileExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// uploadPending re-uploads the batches staged in paths, which were not uploaded
+// before the previous shutdown. Files which cannot be uploaded are logged and kept
+// for the next start, and the rest are uploaded anyway. It stops when the plugin exits.
+func (s3operator *s3operator) uploadPending(paths []string) {
+	for _, path := range paths {
+		select {
+		case <-s3operator.done:
+			return
+		default:
+		}
+		if err := s3operator.uploadStaged(path); err != nil {
+			s3operator.logger.Warnf("[s3operator] pending batch %s is kept for the next start: %v", path, err)
+		}
+	}
+}
+
+// uploadStaged uploads the records of a staging file with retries, and removes the file.
+func (s3operator *s3operator) uploadStaged(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	p, t, lines, err := readStaged(path)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return s3operator.store.remove([]string{path})
+	}
+
+	if t.IsZero() {
+		t = info.ModTime()
+	}
+	objectKey := GenerateObjectKey(s3operator, p, t, lines)
+	if err := s3operator.put(objectKey, t, lines); err != nil {
+		return err
+	}
+	if err := s3operator.store.remove([]string{path}); err != nil {
+		return err
+	}
+	s3operator.logger.Infof("[s3operator] uploaded pending batch %s to %s", path, objectKey)
+	return nil
+}
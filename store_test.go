@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFileStore(t *testing.T) (*fileStore, func()) {
+	dir, err := ioutil.TempDir("", "fluent-bit-go-s3")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	store, err := newFileStore(dir, "examplebucket", "example/prefix")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestFileStoreStage(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	assert.Equal(t, "example_prefix", filepath.Base(store.dir))
+
+	path, err := store.stage(partition{}, time.Time{}, "line1\n")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	_, _, lines, err := readStaged(path)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, "line1\n", lines)
+
+	pending, _ := store.pending()
+	assert.Equal(t, []string{path}, pending)
+
+	assert.Nil(t, store.remove(pending))
+	pending, _ = store.pending()
+	assert.Len(t, pending, 0)
+}
+
+func TestRecordBufferWithStore(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	testplugin := &testFluentPlugin{}
+	plugin = testplugin
+	s3mock := &s3operator{
+		prefix:   "exampleprefix",
+		logger:   newLogger(log.InfoLevel),
+		location: time.UTC,
+		buffer:   newRecordBuffers(store),
+		store:    store,
+	}
+
+	s3mock.buffer.append(partition{}, time.Time{}, "line1\n", 1)
+	s3mock.buffer.append(partition{}, time.Time{}, "line2\n", 1)
+	pending, _ := store.pending()
+	assert.Len(t, pending, 1, "buffered records are staged in one file")
+	lines, _ := store.read(pending)
+	assert.Equal(t, "line1\nline2\n", lines)
+
+	assert.Nil(t, s3mock.flushBuffer())
+	assert.Len(t, testplugin.events, 1)
+	pending, _ = store.pending()
+	assert.Len(t, pending, 0, "staged file is removed after upload")
+}
+
+func TestUploadPending(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	store.stage(partition{}, time.Time{}, "line1\n")
+	store.stage(partition{}, time.Time{}, "line2\n")
+
+	testplugin := &testFluentPlugin{}
+	plugin = testplugin
+	s3mock := &s3operator{
+		prefix:   "exampleprefix",
+		logger:   newLogger(log.InfoLevel),
+		location: time.UTC,
+		store:    store,
+	}
+
+	pending, _ := store.pending()
+	s3mock.uploadPending(pending)
+	assert.Len(t, testplugin.events, 2)
+	assert.Equal(t, "line1\n", string(testplugin.events[0].data))
+	assert.Equal(t, "line2\n", string(testplugin.events[1].data))
+	pending, _ = store.pending()
+	assert.Len(t, pending, 0)
+}
+
+func TestUploadPendingSkipsFailures(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	denied, _ := store.stage(partition{}, time.Time{}, "line1\n")
+	store.stage(partition{}, time.Time{}, "line2\n")
+
+	testplugin := &failingPlugin{
+		testFluentPlugin: &testFluentPlugin{},
+		errs: []error{
+			awserr.New("AccessDenied", "Access Denied", nil),
+			awserr.New("SlowDown", "Please reduce your request rate.", nil),
+		},
+	}
+	plugin = testplugin
+	s3mock := &s3operator{
+		prefix:   "exampleprefix",
+		logger:   newLogger(log.InfoLevel),
+		location: time.UTC,
+		store:    store,
+		retry:    &retryConfig{maxRetries: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond},
+	}
+
+	pending, _ := store.pending()
+	s3mock.uploadPending(pending)
+	assert.Equal(t, 3, testplugin.attempts, "permanent errors are not retried, but transient ones are")
+	assert.Len(t, testplugin.events, 1)
+	assert.Equal(t, "line2\n", string(testplugin.events[0].data))
+	pending, _ = store.pending()
+	assert.Equal(t, []string{denied}, pending, "the failed batch is kept for the next start")
+
+	s3mock.done = make(chan struct{})
+	close(s3mock.done)
+	s3mock.uploadPending(pending)
+	assert.Equal(t, 3, testplugin.attempts, "pending batches are not uploaded once the plugin exits")
+}
+
+func TestUploadPendingWithPartition(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	path, _ := store.stage(partition{tag: "kube.var.log"}, time.Time{}, "line1\n")
+	p, eventTime, _, _ := readStaged(path)
+	assert.Equal(t, partition{tag: "kube.var.log"}, p)
+	assert.True(t, eventTime.IsZero())
+
+	ts := time.Date(2019, time.March, 10, 10, 11, 12, 0, time.UTC)
+	p, eventTime = decodePartition(encodePartition(partition{values: "default"}, ts))
+	assert.Equal(t, partition{values: "default"}, p)
+	assert.True(t, ts.Equal(eventTime))
+
+	f, _ := newObjectKeyFormatter("%{path}/%{tag}.%{file_extension}")
+	testplugin := &testFluentPlugin{}
+	plugin = testplugin
+	s3mock := &s3operator{
+		prefix:       "exampleprefix",
+		logger:       newLogger(log.InfoLevel),
+		location:     time.UTC,
+		keyFormatter: f,
+		store:        store,
+	}
+
+	pending, _ := store.pending()
+	s3mock.uploadPending(pending)
+	assert.Len(t, testplugin.events, 1)
+	assert.Equal(t, "exampleprefix/kube.var.log.log", testplugin.events[0].objectKey)
+}
+
+func TestUploadPendingWithLongTag(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	tag := "kube.var.log.containers." + strings.Repeat("fluent-bit-go-s3-7d9f8b6c5d-x2k4p_logging_", 6) + "0123456789abcdef.log"
+	assert.True(t, len(tag) > 255)
+	ts := time.Date(2019, time.March, 10, 10, 11, 12, 0, time.UTC)
+	values := strings.Join([]string{"default", tag}, partitionValueSeparator)
+
+	path, err := store.stage(partition{tag: tag, values: values}, ts, "line1\n")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	other, err := store.stage(partition{tag: tag + ".other"}, ts, "line2\n")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.True(t, len(filepath.Base(path)) < 64, "names do not grow with the partition")
+	assert.NotEqual(t, filepath.Ext(strings.TrimSuffix(path, stagingFileExt)), filepath.Ext(strings.TrimSuffix(other, stagingFileExt)))
+
+	p, eventTime, lines, err := readStaged(path)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, partition{tag: tag, values: values}, p)
+	assert.True(t, ts.Equal(eventTime))
+	assert.Equal(t, "line1\n", lines)
+
+	f, _ := newObjectKeyFormatter("%{path}/%{tag}.%{file_extension}")
+	testplugin := &testFluentPlugin{}
+	plugin = testplugin
+	s3mock := &s3operator{
+		prefix:       "exampleprefix",
+		logger:       newLogger(log.InfoLevel),
+		location:     time.UTC,
+		keyFormatter: f,
+		store:        store,
+	}
+
+	pending, _ := store.pending()
+	s3mock.uploadPending(pending)
+	assert.Len(t, testplugin.events, 2)
+	assert.Equal(t, "exampleprefix/"+tag+".log", testplugin.events[0].objectKey)
+	assert.Equal(t, "line1\n", string(testplugin.events[0].data))
+	assert.Equal(t, "exampleprefix/"+tag+".other.log", testplugin.events[1].objectKey)
+	pending, _ = store.pending()
+	assert.Len(t, pending, 0)
+}
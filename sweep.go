@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const defaultSweepInterval = time.Hour
+
+// sweepConfig enables to abort incomplete multipart uploads under S3Prefix periodically.
+type sweepConfig struct {
+	// olderThan is the age of multipart uploads which are aborted.
+	olderThan time.Duration
+	interval  time.Duration
+}
+
+// getSweepConfig returns nil unless AbortIncompleteUploadsAfter is specified.
+func getSweepConfig(abortIncompleteUploadsAfter, sweepInterval string) (*sweepConfig, error) {
+	if abortIncompleteUploadsAfter == "" {
+		if sweepInterval != "" {
+			return nil, fmt.Errorf("sweepInterval requires abortIncompleteUploadsAfter")
+		}
+		return nil, nil
+	}
+
+	conf := &sweepConfig{interval: defaultSweepInterval}
+	olderThan, err := time.ParseDuration(abortIncompleteUploadsAfter)
+	if err != nil || olderThan <= 0 {
+		return nil, fmt.Errorf("invalid abortIncompleteUploadsAfter: %v", abortIncompleteUploadsAfter)
+	}
+	conf.olderThan = olderThan
+
+	if sweepInterval != "" {
+		interval, err := time.ParseDuration(sweepInterval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid sweepInterval: %v", sweepInterval)
+		}
+		conf.interval = interval
+	}
+
+	return conf, nil
+}
+
+// multipartUploads tracks the multipart uploads which the plugin started and has
+// neither completed nor aborted yet. A nil multipartUploads tracks nothing.
+type multipartUploads struct {
+	mu sync.Mutex
+	// uploads maps upload IDs to their object keys.
+	uploads map[string]string
+}
+
+func newMultipartUploads() *multipartUploads {
+	return &multipartUploads{uploads: make(map[string]string)}
+}
+
+func (u *multipartUploads) started(uploadID, objectKey string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.uploads[uploadID] = objectKey
+}
+
+func (u *multipartUploads) finished(uploadID string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delete(u.uploads, uploadID)
+}
+
+func (u *multipartUploads) contains(uploadID string) bool {
+	if u == nil {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	_, ok := u.uploads[uploadID]
+	return ok
+}
+
+// list returns the tracked uploads as a map from upload IDs to object keys.
+func (u *multipartUploads) list() map[string]string {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	uploads := make(map[string]string, len(u.uploads))
+	for uploadID, objectKey := range u.uploads {
+		uploads[uploadID] = objectKey
+	}
+	return uploads
+}
+
+// track is a request option of the uploader which tracks the multipart uploads of s3manager.
+func (u *multipartUploads) track(r *request.Request) {
+	r.Handlers.Complete.PushBack(func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		switch input := r.Params.(type) {
+		case *s3.CreateMultipartUploadInput:
+			if output, ok := r.Data.(*s3.CreateMultipartUploadOutput); ok {
+				u.started(aws.StringValue(output.UploadId), aws.StringValue(input.Key))
+			}
+		case *s3.CompleteMultipartUploadInput:
+			u.finished(aws.StringValue(input.UploadId))
+		case *s3.AbortMultipartUploadInput:
+			u.finished(aws.StringValue(input.UploadId))
+		}
+	})
+}
+
+// abortTrackedUploads aborts the multipart uploads which are still tracked on exit.
+func (s3operator *s3operator) abortTrackedUploads() {
+	for uploadID, objectKey := range s3operator.uploads.list() {
+		if err := s3operator.abortUpload(objectKey, uploadID); err != nil {
+			s3operator.logger.Warnf("error aborting multipart upload %s of %s: %v", uploadID, objectKey, err)
+			continue
+		}
+		s3operator.logger.Infof("[s3operator] aborted multipart upload %s of %s on exit", uploadID, objectKey)
+	}
+}
+
+// sweepUploads aborts the multipart uploads under S3Prefix which were initiated
+// before olderThan, except for the uploads which the plugin is running.
+func (s3operator *s3operator) sweepUploads(olderThan time.Duration) (int, error) {
+	deadline := time.Now().Add(-olderThan)
+	var stale []*s3.MultipartUpload
+	err := s3operator.client.ListMultipartUploadsPagesWithContext(aws.BackgroundContext(), &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s3operator.bucket),
+		Prefix: aws.String(s3operator.prefix),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if upload.Initiated == nil || !upload.Initiated.Before(deadline) {
+				continue
+			}
+			if s3operator.uploads.contains(aws.StringValue(upload.UploadId)) {
+				continue
+			}
+			stale = append(stale, upload)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	aborted := 0
+	for _, upload := range stale {
+		objectKey, uploadID := aws.StringValue(upload.Key), aws.StringValue(upload.UploadId)
+		if err := s3operator.abortUpload(objectKey, uploadID); err != nil {
+			return aborted, err
+		}
+		s3operator.logger.Infof("[s3operator] aborted multipart upload %s of %s initiated at %v", uploadID, objectKey, upload.Initiated)
+		aborted++
+	}
+	return aborted, nil
+}
+
+// runSweeper sweeps incomplete multipart uploads on start and every interval.
+func (s3operator *s3operator) runSweeper(conf *sweepConfig) {
+	defer s3operator.wg.Done()
+
+	ticker := time.NewTicker(conf.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s3operator.sweepUploads(conf.olderThan); err != nil {
+			s3operator.logger.Warnf("error sweeping incomplete multipart uploads: %v", err)
+		}
+		select {
+		case <-s3operator.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
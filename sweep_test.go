@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// sweepS3 lists listed as the multipart uploads of the bucket.
+type sweepS3 struct {
+	*multipartS3
+	listed   []*s3.MultipartUpload
+	prefixes []string
+}
+
+func (s *sweepS3) ListMultipartUploadsPagesWithContext(ctx aws.Context, input *s3.ListMultipartUploadsInput, fn func(*s3.ListMultipartUploadsOutput, bool) bool, opts ...request.Option) error {
+	s.prefixes = append(s.prefixes, *input.Prefix)
+	for i, upload := range s.listed {
+		if !fn(&s3.ListMultipartUploadsOutput{Uploads: []*s3.MultipartUpload{upload}}, i == len(s.listed)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestGetSweepConfig(t *testing.T) {
+	conf, err := getSweepConfig("", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, conf, "incomplete multipart uploads are not swept by default")
+
+	conf, err = getSweepConfig("24h", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &sweepConfig{olderThan: 24 * time.Hour, interval: defaultSweepInterval}, conf)
+
+	conf, err = getSweepConfig("6h", "10m")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, &sweepConfig{olderThan: 6 * time.Hour, interval: 10 * time.Minute}, conf)
+
+	_, err = getSweepConfig("1d", "")
+	assert.Equal(t, errors.New("invalid abortIncompleteUploadsAfter: 1d"), err)
+	_, err = getSweepConfig("24h", "-1m")
+	assert.Equal(t, errors.New("invalid sweepInterval: -1m"), err)
+	_, err = getSweepConfig("", "10m")
+	assert.Equal(t, errors.New("sweepInterval requires abortIncompleteUploadsAfter"), err)
+}
+
+func TestMultipartUploadsTrack(t *testing.T) {
+	uploads := newMultipartUploads()
+	complete := func(params, data interface{}, err error) {
+		r := &request.Request{Params: params, Data: data, Error: err}
+		uploads.track(r)
+		r.Handlers.Complete.Run(r)
+	}
+
+	complete(&s3.CreateMultipartUploadInput{Key: aws.String("key1")}, &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil)
+	complete(&s3.CreateMultipartUploadInput{Key: aws.String("key2")}, &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-2")}, nil)
+	complete(&s3.CreateMultipartUploadInput{Key: aws.String("key3")}, &s3.CreateMultipartUploadOutput{}, errors.New("RequestError"))
+	assert.Equal(t, map[string]string{"upload-1": "key1", "upload-2": "key2"}, uploads.list())
+
+	complete(&s3.CompleteMultipartUploadInput{UploadId: aws.String("upload-1")}, &s3.CompleteMultipartUploadOutput{}, nil)
+	complete(&s3.AbortMultipartUploadInput{UploadId: aws.String("upload-2")}, &s3.AbortMultipartUploadOutput{}, errors.New("RequestError"))
+	assert.Equal(t, map[string]string{"upload-2": "key2"}, uploads.list(), "failed aborts are still tracked")
+}
+
+func TestAbortTrackedUploads(t *testing.T) {
+	svc := newMultipartS3()
+	s3mock := newStreamingOperator(svc, plainTextFormat)
+	s3mock.uploads = newMultipartUploads()
+
+	if _, err := s3mock.streamBatch(&batch{lines: "line1\n", records: 1}); err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.True(t, s3mock.uploads.contains("upload-0"), "streams are tracked")
+	assert.Nil(t, s3mock.flushStream(partition{}))
+	assert.False(t, s3mock.uploads.contains("upload-0"), "completed streams are not tracked anymore")
+
+	s3mock.uploads.started("upload-9", "exampleprefix/interrupted.log")
+	svc.uploads["upload-9"] = make(map[int64][]byte)
+	s3mock.abortTrackedUploads()
+	assert.Equal(t, []string{"upload-9"}, svc.aborted)
+	assert.Len(t, s3mock.uploads.list(), 0)
+}
+
+func TestSweepUploads(t *testing.T) {
+	now := time.Now()
+	svc := &sweepS3{multipartS3: newMultipartS3()}
+	svc.listed = []*s3.MultipartUpload{
+		{Key: aws.String("exampleprefix/old.log"), UploadId: aws.String("old"), Initiated: aws.Time(now.Add(-48 * time.Hour))},
+		{Key: aws.String("exampleprefix/recent.log"), UploadId: aws.String("recent"), Initiated: aws.Time(now.Add(-time.Hour))},
+		{Key: aws.String("exampleprefix/running.log"), UploadId: aws.String("running"), Initiated: aws.Time(now.Add(-48 * time.Hour))},
+	}
+	for _, upload := range svc.listed {
+		svc.uploads[*upload.UploadId] = make(map[int64][]byte)
+	}
+	s3mock := newStreamingOperator(svc, plainTextFormat)
+	s3mock.uploads = newMultipartUploads()
+	s3mock.uploads.started("running", "exampleprefix/running.log")
+
+	aborted, err := s3mock.sweepUploads(24 * time.Hour)
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, 1, aborted)
+	assert.Equal(t, []string{"exampleprefix"}, svc.prefixes, "uploads are listed under S3Prefix")
+	assert.Equal(t, []string{"old"}, svc.aborted, "recent uploads and uploads of the plugin are left")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueSize = 64
+	// uploadRetryInterval is how long a worker waits before it retries a failed batch.
+	uploadRetryInterval = time.Second
+)
+
+var errUploadQueueFull = errors.New("upload queue is full")
+
+type workerConfig struct {
+	workers   int
+	queueSize int
+}
+
+// getWorkerConfig returns nil unless Workers is specified, in which case batches are
+// uploaded in the background instead of in the flush callback.
+func getWorkerConfig(workers, queueSize string) (*workerConfig, error) {
+	if workers == "" {
+		if queueSize != "" {
+			return nil, fmt.Errorf("queueSize requires workers")
+		}
+		return nil, nil
+	}
+
+	conf := &workerConfig{queueSize: defaultQueueSize}
+
+	n, err := strconv.Atoi(workers)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid workers: %v", workers)
+	}
+	conf.workers = n
+
+	if queueSize != "" {
+		size, err := strconv.Atoi(queueSize)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid queueSize: %v", queueSize)
+		}
+		conf.queueSize = size
+	}
+
+	return conf, nil
+}
+
+// uploadWorkers uploads batches with a fixed number of goroutines. Batches wait in
+// a queue bounded by queueSize, so that callers can push back when S3 is slow.
+type uploadWorkers struct {
+	upload    func(*batch) error
+	giveUp    func(error) bool
+	onFailure func(*batch, error, bool)
+	queueSize int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*batch
+	closing bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newUploadWorkers starts workers which call upload for each queued batch. onFailure
+// is called when upload fails, with whether the batch is going to be retried.
+// Batches are not retried when giveUp returns true for the error.
+func newUploadWorkers(conf *workerConfig, upload func(*batch) error, giveUp func(error) bool, onFailure func(*batch, error, bool)) *uploadWorkers {
+	w := &uploadWorkers{
+		upload:    upload,
+		giveUp:    giveUp,
+		onFailure: onFailure,
+		queueSize: conf.queueSize,
+		done:      make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	w.wg.Add(conf.workers)
+	for i := 0; i < conf.workers; i++ {
+		go w.run()
+	}
+	return w
+}
+
+// offer queues all of batches, or none of them when they do not fit in the queue.
+func (w *uploadWorkers) offer(batches ...*batch) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closing || len(w.queue)+len(batches) > w.queueSize {
+		return false
+	}
+	w.queue = append(w.queue, batches...)
+	w.cond.Broadcast()
+	return true
+}
+
+// push queues b even when the queue is full. It is used for batches which were
+// already accepted from Fluent Bit and must not be dropped.
+func (w *uploadWorkers) push(b *batch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.queue = append(w.queue, b)
+	w.cond.Broadcast()
+}
+
+func (w *uploadWorkers) full() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.queue) >= w.queueSize
+}
+
+// pending returns the number of batches waiting for a worker.
+func (w *uploadWorkers) pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.queue)
+}
+
+// next blocks until a batch is queued. It returns false once the workers are
+// closing and the queue is drained.
+func (w *uploadWorkers) next() (*batch, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(w.queue) == 0 && !w.closing {
+		w.cond.Wait()
+	}
+	if len(w.queue) == 0 {
+		return nil, false
+	}
+	b := w.queue[0]
+	w.queue[0] = nil
+	w.queue = w.queue[1:]
+	return b, true
+}
+
+func (w *uploadWorkers) run() {
+	defer w.wg.Done()
+
+	for {
+		b, ok := w.next()
+		if !ok {
+			return
+		}
+		err := w.upload(b)
+		if err == nil {
+			continue
+		}
+		if w.giveUp(err) {
+			w.onFailure(b, err, false)
+			continue
+		}
+		// Failed batches are retried until the workers are closed.
+		select {
+		case <-w.done:
+			w.onFailure(b, err, false)
+		case <-time.After(uploadRetryInterval):
+			w.onFailure(b, err, true)
+			w.push(b)
+		}
+	}
+}
+
+// close waits for the workers to upload every queued batch.
+func (w *uploadWorkers) close() {
+	w.mu.Lock()
+	w.closing = true
+	close(w.done)
+	w.cond.Broadcast()
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
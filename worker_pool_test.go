@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetWorkerConfig(t *testing.T) {
+	conf, err := getWorkerConfig("", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Nil(t, conf, "uploads are synchronous by default")
+
+	conf, err = getWorkerConfig("4", "")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, 4, conf.workers)
+	assert.Equal(t, defaultQueueSize, conf.queueSize)
+
+	conf, err = getWorkerConfig("2", "8")
+	if err != nil {
+		t.Fatalf("failed test %#v", err)
+	}
+	assert.Equal(t, 8, conf.queueSize)
+
+	_, err = getWorkerConfig("0", "")
+	assert.Equal(t, errors.New("invalid workers: 0"), err)
+	_, err = getWorkerConfig("2", "none")
+	assert.Equal(t, errors.New("invalid queueSize: none"), err)
+	_, err = getWorkerConfig("", "8")
+	assert.Equal(t, errors.New("queueSize requires workers"), err)
+}
+
+// blockingUploads holds uploads until release is closed.
+type blockingUploads struct {
+	mu       sync.Mutex
+	started  chan struct{}
+	release  chan struct{}
+	uploaded []string
+}
+
+func newBlockingUploads() *blockingUploads {
+	return &blockingUploads{
+		started: make(chan struct{}, 16),
+		release: make(chan struct{}),
+	}
+}
+
+func (u *blockingUploads) upload(b *batch) error {
+	u.started <- struct{}{}
+	<-u.release
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.uploaded = append(u.uploaded, b.lines)
+	return nil
+}
+
+func TestUploadWorkersOfferAllOrNothing(t *testing.T) {
+	uploads := newBlockingUploads()
+	w := newUploadWorkers(&workerConfig{workers: 1, queueSize: 2}, uploads.upload, isPermanentError, func(*batch, error, bool) {})
+
+	assert.True(t, w.offer(&batch{lines: "line1\n"}))
+	<-uploads.started // the worker is busy with line1.
+
+	assert.True(t, w.offer(&batch{lines: "line2\n"}, &batch{lines: "line3\n"}))
+	assert.True(t, w.full())
+	assert.False(t, w.offer(&batch{lines: "line4\n"}))
+	assert.Equal(t, 2, w.pending())
+
+	close(uploads.release)
+	w.close()
+	assert.Equal(t, []string{"line1\n", "line2\n", "line3\n"}, uploads.uploaded, "queued batches are drained on close")
+	assert.False(t, w.offer(&batch{lines: "line5\n"}), "closed workers do not accept batches")
+}
+
+func TestUploadWorkersRetryFailedBatch(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	var retried []bool
+	uploaded := make(chan *batch, 1)
+	upload := func(b *batch) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			return errors.New("SlowDown")
+		}
+		uploaded <- b
+		return nil
+	}
+	onFailure := func(b *batch, err error, retrying bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		retried = append(retried, retrying)
+	}
+	w := newUploadWorkers(&workerConfig{workers: 1, queueSize: 1}, upload, isPermanentError, onFailure)
+
+	assert.True(t, w.offer(&batch{lines: "line1\n"}))
+	select {
+	case b := <-uploaded:
+		assert.Equal(t, "line1\n", b.lines)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("failed test: the batch was not retried")
+	}
+	w.close()
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, []bool{true}, retried)
+}
+
+func TestPluginFlusherWithWorkers(t *testing.T) {
+	testplugin := &testFluentPlugin{}
+	testrecords := map[interface{}]interface{}{
+		"mykey": "myvalue",
+	}
+	testplugin.addrecord(0, 0, testrecords)
+	plugin = testplugin
+	context = &testPluginContext{}
+	s3mock := &s3operator{
+		bucket:    "examplebucket",
+		prefix:    "exampleprefix",
+		logger:    newLogger(log.InfoLevel),
+		location:  time.UTC,
+		formatter: &jsonFormatter{},
+	}
+	uploads := newBlockingUploads()
+	s3mock.workers = newUploadWorkers(&workerConfig{workers: 1, queueSize: 1}, func(b *batch) error {
+		if err := uploads.upload(b); err != nil {
+			return err
+		}
+		return s3mock.uploadBatch(b)
+	}, s3mock.givesUp, s3mock.uploadFailed)
+	s3operators = []*s3operator{s3mock}
+
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res, "the flush does not wait for S3")
+	<-uploads.started
+
+	testplugin.addrecord(0, 0, testrecords)
+	res = FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_OK, res)
+
+	testplugin.addrecord(0, 0, testrecords)
+	res = FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_RETRY, res, "records are pushed back while the queue is full")
+
+	close(uploads.release)
+	res = FLBPluginExit()
+	assert.Equal(t, output.FLB_OK, res)
+	assert.Len(t, testplugin.events, 2) // queued batches are uploaded on exit.
+	assert.Equal(t, "{\"mykey\":\"myvalue\"}\n", string(testplugin.events[0].data))
+	assert.Equal(t, "{\"mykey\":\"myvalue\"}\n", string(testplugin.events[1].data))
+}